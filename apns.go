@@ -0,0 +1,257 @@
+package titan
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/titan-x/titan/models"
+)
+
+const (
+	// APNS production endpoint
+	apnsHostProduction = "https://api.push.apple.com"
+
+	// maximum size of the payload of an APNS notification
+	apnsMaxPayload = 4096
+
+	// provider authentication tokens are valid for an hour, and should not be refreshed more than once every 20 minutes
+	apnsTokenTTL = time.Minute * 40
+
+	apnsTimeout = time.Second * 30
+)
+
+// apnsClient is an APNS provider client for sending notifications to iOS devices over HTTP/2.
+// It authenticates either with a provider authentication token signed with a .p8 key (see setAuthKey),
+// or with a provider certificate supplied in the TLS configuration.
+type apnsClient struct {
+	host   string
+	topic  string // bundle ID of the app
+	client *http.Client
+
+	// token-based authentication
+	keyID, teamID string
+	key           *ecdsa.PrivateKey
+	mutex         sync.Mutex
+	token         string
+	tokenTime     time.Time
+}
+
+// apnsNotification is a single notification to be sent to a device.
+type apnsNotification struct {
+	DeviceToken string
+	PushType    string // "alert" or "background"
+	Expiration  time.Time
+	Payload     interface{}
+}
+
+// apnsError is an error response returned by APNS.
+type apnsError struct {
+	Status int
+	Reason string
+}
+
+func (e *apnsError) Error() string {
+	return fmt.Sprintf("apns: request failed with status %v: %v", e.Status, e.Reason)
+}
+
+// unregistered returns true if the device token is no longer active for the topic (410 Unregistered), so it should not be used again.
+// Other errors like BadDeviceToken can be caused by a misconfiguration (i.e. sandbox token sent to production host), so they do not denote a stale token.
+func (e *apnsError) unregistered() bool {
+	return e.Status == http.StatusGone
+}
+
+// newAPNSClient creates an APNS client. Provider certificate, if any, should be in the certificates of the TLS configuration.
+func newAPNSClient(host, topic string, tlsConf *tls.Config) *apnsClient {
+	return &apnsClient{
+		host:  host,
+		topic: topic,
+		client: &http.Client{
+			Timeout:   apnsTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConf, ForceAttemptHTTP2: true},
+		},
+	}
+}
+
+// newAPNSClientFromConf creates an APNS client using the key or the certificate files given in the configuration.
+func newAPNSClientFromConf(conf APNS) (*apnsClient, error) {
+	host := conf.Host
+	if host == "" {
+		host = apnsHostProduction
+	}
+
+	if conf.AuthKeyFile != "" {
+		key, err := ioutil.ReadFile(conf.AuthKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("apns: failed to read auth key file: %v", err)
+		}
+		a := newAPNSClient(host, conf.Topic, &tls.Config{})
+		if err := a.setAuthKey(conf.KeyID, conf.TeamID, key); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.CertKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("apns: failed to load provider certificate: %v", err)
+	}
+	return newAPNSClient(host, conf.Topic, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+}
+
+// setAuthKey enables token-based authentication using the given PEM encoded .p8 key.
+func (a *apnsClient) setAuthKey(keyID, teamID string, keyPEM []byte) error {
+	b, _ := pem.Decode(keyPEM)
+	if b == nil {
+		return errors.New("apns: auth key is not PEM encoded")
+	}
+
+	var key interface{}
+	key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		if key, err = x509.ParseECPrivateKey(b.Bytes); err != nil {
+			return fmt.Errorf("apns: failed to parse auth key: %v", err)
+		}
+	}
+
+	ek, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("apns: auth key is not an ECDSA key")
+	}
+
+	a.keyID, a.teamID, a.key = keyID, teamID, ek
+	return nil
+}
+
+// authToken returns the current provider authentication token, creating a new one if it is about to expire.
+func (a *apnsClient) authToken() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.token != "" && time.Since(a.tokenTime) < apnsTokenTTL {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	t := jwt.New(jwt.SigningMethodES256)
+	t.Header["kid"] = a.keyID
+	t.Claims["iss"] = a.teamID
+	t.Claims["iat"] = now.Unix()
+	s, err := t.SignedString(a.key)
+	if err != nil {
+		return "", fmt.Errorf("apns: failed to sign auth token: %v", err)
+	}
+
+	a.token, a.tokenTime = s, now
+	return s, nil
+}
+
+// send sends a notification. If APNS rejects the notification, an *apnsError is returned.
+func (a *apnsClient) send(n *apnsNotification) error {
+	b, err := json.Marshal(n.Payload)
+	if err != nil {
+		return fmt.Errorf("apns: failed to serialize payload: %v", err)
+	}
+
+	// device token is a part of the request path so it should be nothing but hex digits
+	if _, err := hex.DecodeString(n.DeviceToken); err != nil || n.DeviceToken == "" {
+		return fmt.Errorf("apns: invalid device token: %q", n.DeviceToken)
+	}
+
+	req, err := http.NewRequest("POST", a.host+"/3/device/"+n.DeviceToken, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("apns: failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", n.PushType)
+	if n.PushType == "background" {
+		req.Header.Set("apns-priority", "5")
+	} else {
+		req.Header.Set("apns-priority", "10")
+	}
+	if !n.Expiration.IsZero() {
+		req.Header.Set("apns-expiration", strconv.FormatInt(n.Expiration.Unix(), 10))
+	}
+	if a.key != nil {
+		t, err := a.authToken()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "bearer "+t)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("apns: request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var r struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(res.Body).Decode(&r)
+
+	// provider token was rejected so the next request should use a fresh one
+	if r.Reason == "ExpiredProviderToken" || r.Reason == "InvalidProviderToken" {
+		a.mutex.Lock()
+		a.token = ""
+		a.mutex.Unlock()
+	}
+
+	return &apnsError{Status: res.StatusCode, Reason: r.Reason}
+}
+
+func (a *apnsClient) close() {
+	if t, ok := a.client.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// apnsNotificationFor creates a notification for a message.
+// Message is included as an alert if it fits in the APNS payload limit, otherwise a background notification signals the app
+// to fetch it over WebSocket.
+func apnsNotificationFor(deviceToken string, m models.Message, expires time.Time) *apnsNotification {
+	n := &apnsNotification{
+		DeviceToken: deviceToken,
+		PushType:    "alert",
+		Expiration:  expires,
+		Payload: map[string]interface{}{
+			"aps":       map[string]interface{}{"alert": map[string]string{"title": m.From, "body": m.Message}, "sound": "default"},
+			"n.id":      m.ID,
+			"n.from":    m.From,
+			"n.group":   m.Group,
+			"n.message": m.Message,
+		},
+	}
+
+	if b, err := json.Marshal(n.Payload); err == nil && len(b) <= apnsMaxPayload {
+		return n
+	}
+
+	n.PushType = "background"
+	n.Payload = map[string]interface{}{
+		"aps":     map[string]interface{}{"content-available": 1},
+		"n.id":    m.ID,
+		"n.from":  m.From,
+		"n.group": m.Group,
+	}
+	return n
+}
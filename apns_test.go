@@ -0,0 +1,256 @@
+package titan
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/data/inmem"
+	"github.com/titan-x/titan/models"
+)
+
+// apnsStub is a local HTTP/2 server that mimics APNS.
+// Requests to the "dead" device token are rejected as unregistered, and the ones to the "0bad" device token as bad device token.
+type apnsStub struct {
+	srv  *httptest.Server
+	reqs chan apnsStubReq
+}
+
+type apnsStubReq struct {
+	header  http.Header
+	token   string
+	payload map[string]interface{}
+}
+
+func newAPNSStub(t *testing.T, auth func(r *http.Request) bool) *apnsStub {
+	s := &apnsStub{reqs: make(chan apnsStubReq, 10)}
+	s.srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2 request, got: %v", r.Proto)
+		}
+		if !auth(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason":"InvalidProviderToken"}`))
+			return
+		}
+
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		if token == "dead" {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered","timestamp":1475000000000}`))
+			return
+		}
+		if token == "0bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+			return
+		}
+
+		var p map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"PayloadEmpty"}`))
+			return
+		}
+		s.reqs <- apnsStubReq{header: r.Header, token: token, payload: p}
+	}))
+	s.srv.EnableHTTP2 = true
+	return s
+}
+
+func (s *apnsStub) client(tlsConf *tls.Config) *apnsClient {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.srv.Certificate())
+	tlsConf.RootCAs = pool
+	return newAPNSClient(s.srv.URL, "com.titan", tlsConf)
+}
+
+func (s *apnsStub) getReqWait(t *testing.T) apnsStubReq {
+	select {
+	case r := <-s.reqs:
+		return r
+	case <-time.After(time.Second * 3):
+		t.Fatal("did not receive APNS request in time")
+	}
+	return apnsStubReq{}
+}
+
+func TestAPNSTokenAuth(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newAPNSStub(t, func(r *http.Request) bool {
+		jt, err := jwt.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "), func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		return err == nil && jt.Valid && jt.Header["kid"] == "KEY123" && jt.Claims["iss"] == "TEAM123"
+	})
+	s.srv.StartTLS()
+	defer s.srv.Close()
+
+	a := s.client(&tls.Config{})
+	if err := a.setAuthKey("KEY123", "TEAM123", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	expires := time.Now().Add(time.Hour)
+	m := models.Message{ID: "1", From: "2", Message: "hello"}
+	if err := a.send(apnsNotificationFor("abc123", m, expires)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := s.getReqWait(t)
+	if r.token != "abc123" || r.header.Get("apns-topic") != "com.titan" || r.header.Get("apns-push-type") != "alert" || r.header.Get("apns-priority") != "10" {
+		t.Fatalf("unexpected request: %+v", r)
+	}
+	if r.header.Get("apns-expiration") == "" || r.payload["n.message"] != "hello" || r.payload["n.from"] != "2" {
+		t.Fatalf("unexpected request: %+v", r)
+	}
+
+	// messages that do not fit in the payload limit are sent as background notifications
+	m.Message = strings.Repeat("a", apnsMaxPayload)
+	if err := a.send(apnsNotificationFor("abc123", m, expires)); err != nil {
+		t.Fatal(err)
+	}
+	r = s.getReqWait(t)
+	if r.header.Get("apns-push-type") != "background" || r.header.Get("apns-priority") != "5" || r.payload["n.message"] != nil || r.payload["n.id"] != "1" {
+		t.Fatalf("unexpected background notification: %+v", r)
+	}
+
+	err = a.send(apnsNotificationFor("dead", m, expires))
+	if aerr, ok := err.(*apnsError); !ok || !aerr.unregistered() || aerr.Reason != "Unregistered" {
+		t.Fatalf("expected unregistered error, got: %v", err)
+	}
+
+	err = a.send(apnsNotificationFor("0bad", m, expires))
+	if aerr, ok := err.(*apnsError); !ok || aerr.unregistered() || aerr.Reason != "BadDeviceToken" {
+		t.Fatalf("expected bad device token error, got: %v", err)
+	}
+
+	// device tokens that are not hex are not sent to APNS
+	for _, token := range []string{"", "abc/../../x", "abc?x=1", "xyz"} {
+		if err := a.send(apnsNotificationFor(token, m, expires)); err == nil {
+			t.Fatalf("expected device token %q to be rejected", token)
+		}
+	}
+	select {
+	case r := <-s.reqs:
+		t.Fatalf("expected no request for invalid device tokens, got: %+v", r)
+	default:
+	}
+}
+
+func TestAPNSCertAuth(t *testing.T) {
+	cert, err := apnsTestCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newAPNSStub(t, func(r *http.Request) bool {
+		return len(r.TLS.PeerCertificates) == 1 && r.TLS.PeerCertificates[0].Subject.CommonName == "com.titan"
+	})
+	s.srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	s.srv.StartTLS()
+	defer s.srv.Close()
+
+	a := s.client(&tls.Config{Certificates: []tls.Certificate{cert}})
+	defer a.close()
+
+	if err := a.send(apnsNotificationFor("abc123", models.Message{ID: "1", From: "2", Message: "hello"}, time.Time{})); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.getReqWait(t); r.token != "abc123" || r.header.Get("Authorization") != "" || r.header.Get("apns-expiration") != "" {
+		t.Fatalf("unexpected request: %+v", r)
+	}
+}
+
+func TestAPNSStaleToken(t *testing.T) {
+	cert, err := apnsTestCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newAPNSStub(t, func(r *http.Request) bool { return true })
+	s.srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	s.srv.StartTLS()
+	defer s.srv.Close()
+
+	var db data.DB = inmem.NewDB()
+	u := &models.User{Email: "ios@titan.x", APNSDeviceToken: "dead"}
+	if err := db.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPush(&db, nil)
+	p.apns = s.client(&tls.Config{Certificates: []tls.Certificate{cert}})
+	defer p.close()
+
+	// device token in the user record is cleared
+	for _, d := range p.devices(u) {
+		p.sendAPNS(d, models.Message{ID: "1", From: "2", Message: "hello"}, time.Now().Add(time.Hour))
+	}
+	if cu, ok := db.GetByID(u.ID); !ok || cu.APNSDeviceToken != "" {
+		t.Fatalf("expected stale APNS device token to be cleared, got: %+v", cu)
+	}
+
+	// registered device is removed
+	d := models.Device{UserID: u.ID, ID: "phone", Platform: models.PlatformIOS, PushToken: "dead"}
+	if err := db.SaveDevice(&d); err != nil {
+		t.Fatal(err)
+	}
+	p.sendAPNS(d, models.Message{ID: "2", From: "2", Message: "hello"}, time.Now().Add(time.Hour))
+	if ds, err := db.GetDevices(u.ID); err != nil || len(ds) != 0 {
+		t.Fatalf("expected stale APNS device to be removed, got: %+v, %v", ds, err)
+	}
+
+	// device is kept when APNS reports a bad device token
+	d = models.Device{UserID: u.ID, ID: "tablet", Platform: models.PlatformIOS, PushToken: "0bad"}
+	if err := db.SaveDevice(&d); err != nil {
+		t.Fatal(err)
+	}
+	p.sendAPNS(d, models.Message{ID: "3", From: "2", Message: "hello"}, time.Now().Add(time.Hour))
+	if ds, err := db.GetDevices(u.ID); err != nil || len(ds) != 1 {
+		t.Fatalf("expected APNS device with bad device token to be kept, got: %+v, %v", ds, err)
+	}
+}
+
+func apnsTestCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "com.titan"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/neptulon/neptulon"
 	"github.com/neptulon/neptulon/middleware"
 	"github.com/titan-x/titan/data"
@@ -22,7 +21,8 @@ type gProfile struct {
 }
 
 type tokenContainer struct {
-	Token string `json:"token"`
+	Token    string `json:"token"`
+	DeviceID string `json:"deviceid,omitempty"` // Optional device ID to issue a device specific JWT token for.
 }
 
 type gAuthRes struct {
@@ -35,7 +35,8 @@ type gAuthRes struct {
 
 // googleAuth authenticates a user with Google+ using provided OAuth 2.0 access token.
 // If authenticated successfully, user profile is retrieved from Google+ and user is given a JWT token in return.
-func googleAuth(ctx *neptulon.ReqCtx, db data.DB, pass string) error {
+// New users are stored with the lookup keys of their e-mail address, peppered with the given server secret.
+func googleAuth(ctx *neptulon.ReqCtx, db data.DB, pass, pepper string) error {
 	var r tokenContainer
 	if err := ctx.Params(&r); err != nil || r.Token == "" {
 		ctx.Err = &neptulon.ResError{Code: 666, Message: "Malformed or null Google oauth access token was provided."}
@@ -53,6 +54,7 @@ func googleAuth(ctx *neptulon.ReqCtx, db data.DB, pass string) error {
 	if !ok {
 		// this is a first-time registration so create user profile via Google+ profile info
 		user = &models.User{Email: p.Email, Name: p.Name, Picture: p.Picture, Registered: time.Now()}
+		user.SetLookupHashes(pepper)
 
 		// save the user information for user ID to be generated by the database
 		if ierr := db.SaveUser(user); ierr != nil {
@@ -60,10 +62,7 @@ func googleAuth(ctx *neptulon.ReqCtx, db data.DB, pass string) error {
 		}
 
 		// create the JWT token
-		token := jwt.New(jwt.SigningMethodHS256)
-		token.Claims["userid"] = user.ID
-		token.Claims["created"] = user.Registered.Unix()
-		user.JWTToken, err = token.SignedString([]byte(pass))
+		user.JWTToken, err = newJWTToken(pass, user.ID, "", user.Registered)
 		if err != nil {
 			return fmt.Errorf("auth: google: jwt signing error: %v", err)
 		}
@@ -75,10 +74,19 @@ func googleAuth(ctx *neptulon.ReqCtx, db data.DB, pass string) error {
 
 		// store user ID in session so user can make authenticated call after this
 		ctx.Conn.Session.Set("userid", user.ID)
+		ctx.Conn.Session.Set("deviceid", deviceIDOrDefault(r.DeviceID))
 	}
 
-	ctx.Res = gAuthRes{ID: user.ID, Token: user.JWTToken, Name: user.Name, Email: user.Email, Picture: user.Picture}
-	ctx.Session.Set(middleware.CustResLogDataKey, gAuthRes{ID: user.ID, Token: user.JWTToken, Name: user.Name, Email: user.Email})
+	// devices get their own tokens so that their deliveries are tracked separately
+	token := user.JWTToken
+	if r.DeviceID != "" {
+		if token, err = newJWTToken(pass, user.ID, r.DeviceID, time.Now()); err != nil {
+			return fmt.Errorf("auth: google: jwt signing error: %v", err)
+		}
+	}
+
+	ctx.Res = gAuthRes{ID: user.ID, Token: token, Name: user.Name, Email: user.Email, Picture: user.Picture}
+	ctx.Session.Set(middleware.CustResLogDataKey, gAuthRes{ID: user.ID, Token: token, Name: user.Name, Email: user.Email})
 	log.Printf("auth: google: logged in: %v, %v", p.Name, p.Email)
 	return nil
 }
@@ -0,0 +1,68 @@
+package titan
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/neptulon/neptulon"
+)
+
+// newJWTToken creates a signed JWT token for the given user. Device ID is optional and identifies one of the many devices of the user.
+func newJWTToken(pass, userID, deviceID string, created time.Time) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["userid"] = userID
+	if deviceID != "" {
+		token.Claims["deviceid"] = deviceID
+	}
+	token.Claims["created"] = created.Unix()
+	return token.SignedString([]byte(pass))
+}
+
+// jwtAuth is JSON Web Token authentication middleware using HMAC.
+// If successful, user ID and device ID in the token claims are stored in the session with the keys "userid" and "deviceid".
+// Tokens without a device ID claim all denote the same (default) device of the user, which is stored with the default device ID.
+// If unsuccessful, connection is closed right away.
+func jwtAuth(pass string) func(ctx *neptulon.ReqCtx) error {
+	p := []byte(pass)
+
+	return func(ctx *neptulon.ReqCtx) error {
+		// if user is already authenticated
+		if _, ok := ctx.Conn.Session.GetOk("userid"); ok {
+			return ctx.Next()
+		}
+
+		// if user is not authenticated.. check the JWT token
+		var t tokenContainer
+		if err := ctx.Params(&t); err != nil {
+			ctx.Conn.Close()
+			return err
+		}
+
+		jt, err := jwt.Parse(t.Token, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("auth: jwt: unexpected signing method: %v", token.Header["alg"])
+			}
+			return p, nil
+		})
+
+		if err != nil || !jt.Valid {
+			ctx.Conn.Close()
+			return fmt.Errorf("auth: jwt: invalid JWT authentication attempt: %v: %v: %v", err, ctx.Conn.RemoteAddr(), t.Token)
+		}
+
+		userID, ok := jt.Claims["userid"].(string)
+		if !ok || userID == "" {
+			ctx.Conn.Close()
+			return fmt.Errorf("auth: jwt: token is missing user ID claim: %v: %v", ctx.Conn.RemoteAddr(), t.Token)
+		}
+		deviceID, _ := jt.Claims["deviceid"].(string)
+		deviceID = deviceIDOrDefault(deviceID)
+
+		ctx.Conn.Session.Set("userid", userID)
+		ctx.Conn.Session.Set("deviceid", deviceID)
+		log.Printf("auth: jwt: client authenticated, user: %v, device: %v, conn: %v, ip: %v", userID, deviceID, ctx.Conn.ID, ctx.Conn.RemoteAddr())
+		return ctx.Next()
+	}
+}
@@ -0,0 +1,211 @@
+package titan
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/titan-x/titan/models"
+)
+
+// Bot is a bot that users can send messages to, just like they do to other users.
+type Bot interface {
+	// Info returns the metadata of the bot. Messages addressed to the bot ID are dispatched to the bot.
+	Info() models.BotInfo
+
+	// Receive handles a message sent to the bot, and returns the reply messages to be sent back to the sender, if any.
+	// Only the message bodies of the replies are used. If an error is returned, sender is notified of the failure with a msg.failed request.
+	Receive(m models.Message) (replies []models.Message, err error)
+}
+
+// echoBot sends every message it receives back to the sender.
+type echoBot struct{}
+
+func (echoBot) Info() models.BotInfo {
+	return models.BotInfo{ID: "echo", Name: "Echo", Description: "Sends back every message it receives."}
+}
+
+func (echoBot) Receive(m models.Message) ([]models.Message, error) {
+	return []models.Message{models.Message{Message: m.Message}}, nil
+}
+
+// botRegistry holds the bots registered with the server, by their lowercase IDs.
+type botRegistry struct {
+	mutex sync.RWMutex
+	bots  map[string]*botRunner
+}
+
+func newBotRegistry() *botRegistry {
+	return &botRegistry{bots: make(map[string]*botRunner)}
+}
+
+// add registers a bot. Bot IDs should be unique.
+func (r *botRegistry) add(b Bot) error {
+	id := strings.ToLower(b.Info().ID)
+	if id == "" {
+		return errors.New("bot: bot ID cannot be empty")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.bots[id]; ok {
+		return fmt.Errorf("bot: a bot with ID %v is already registered", id)
+	}
+	r.bots[id] = newBotRunner(b)
+	return nil
+}
+
+// get retrieves a bot by its ID.
+func (r *botRegistry) get(id string) (*botRunner, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	b, ok := r.bots[strings.ToLower(id)]
+	return b, ok
+}
+
+// peerID returns the canonical (lowercase) bot ID if the given ID denotes a bot, or the ID as is otherwise,
+// as bot IDs are case-insensitive while user IDs are case-sensitive.
+func (r *botRegistry) peerID(id string) string {
+	if _, ok := r.get(id); ok {
+		return strings.ToLower(id)
+	}
+	return id
+}
+
+// list returns the metadata of all the registered bots, sorted by bot ID.
+func (r *botRegistry) list() []models.BotInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	bs := make([]models.BotInfo, 0, len(r.bots))
+	for _, b := range r.bots {
+		bs = append(bs, b.bot.Info())
+	}
+	sort.Sort(botsByID(bs))
+	return bs
+}
+
+type botsByID []models.BotInfo
+
+func (b botsByID) Len() int           { return len(b) }
+func (b botsByID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b botsByID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+
+const (
+	botMaxConcurrency   = 8    // maximum number of messages that a bot handles at a time, each from a different sender
+	botMaxBacklog       = 1000 // maximum number of messages that are dispatched to a bot but not yet handled
+	botMaxSenderBacklog = 50   // maximum number of messages from a single sender that are dispatched to a bot but not yet handled
+)
+
+// botRunner handles the messages sent to a bot in the background, so msg.send requests do not have to wait for the bot.
+// Messages of each sender are handled one at a time in the order they are dispatched, while the messages of different senders
+// are handled concurrently, so a slow conversation does not hold up the others.
+type botRunner struct {
+	bot     Bot
+	slots   chan bool // limits the number of messages being handled at a time
+	mutex   sync.Mutex
+	pending map[string][]func() // sender ID -> message handlers waiting to run, only present while the sender has a running handler loop
+	backlog int                 // number of messages dispatched but not yet handled, across all senders
+}
+
+func newBotRunner(b Bot) *botRunner {
+	return &botRunner{bot: b, slots: make(chan bool, botMaxConcurrency), pending: make(map[string][]func())}
+}
+
+// dispatch queues a message handler to be run after the previously dispatched handlers of the same sender.
+// Returns false without queueing the handler if the backlog of the bot or the sender is full.
+func (r *botRunner) dispatch(from string, h func()) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	hs, running := r.pending[from]
+	if r.backlog >= botMaxBacklog || len(hs) >= botMaxSenderBacklog {
+		return false
+	}
+	r.pending[from] = append(hs, h)
+	r.backlog++
+	if !running {
+		go r.run(from)
+	}
+	return true
+}
+
+func (r *botRunner) run(from string) {
+	for {
+		r.mutex.Lock()
+		hs := r.pending[from]
+		if len(hs) == 0 {
+			delete(r.pending, from)
+			r.mutex.Unlock()
+			return
+		}
+		h := hs[0]
+		r.pending[from] = hs[1:]
+		r.mutex.Unlock()
+
+		r.slots <- true
+		h()
+		<-r.slots
+
+		r.mutex.Lock()
+		r.backlog--
+		r.mutex.Unlock()
+	}
+}
+
+// sendToBot dispatches a message to a bot, and queues the replies of the bot to the sender.
+// Sender is notified with a msg.failed request if the bot is too busy to take the message, or fails to handle it.
+func (s *msgSender) sendToBot(b *botRunner, m models.Message, expires time.Time) {
+	ok := b.dispatch(m.From, func() {
+		botID := m.To
+		if time.Now().After(expires) {
+			s.botFailed(m, "message expired before the bot could handle it")
+			return
+		}
+
+		replies, err := b.bot.Receive(m)
+		if err != nil {
+			log.Printf("bot: %v failed to handle message %v: %v", botID, m.ID, err)
+			s.botFailed(m, "bot failed to handle the message")
+			return
+		}
+
+		for _, r := range replies {
+			id, err := newMsgID(botID, "")
+			if err != nil {
+				log.Printf("bot: failed to generate message ID: %v", err)
+				s.botFailed(m, "bot failed to send its reply")
+				return
+			}
+
+			rm := models.Message{ID: id, From: botID, To: m.From, Time: time.Now(), Message: r.Message}
+			if err := (*s.db).SaveMessage(&rm); err != nil {
+				log.Printf("bot: failed to save reply of %v: %v", botID, err)
+				s.botFailed(m, "bot failed to send its reply")
+				return
+			}
+
+			rExpires := time.Now().Add(s.msgTTL)
+			if err := s.queueMsg(m.From, rm, rExpires, true); err != nil {
+				log.Printf("bot: %v", err)
+				s.botFailed(m, "bot failed to send its reply")
+				return
+			}
+			s.pu.notify(m.From, rm, rExpires)
+		}
+	})
+	if !ok {
+		s.botFailed(m, "bot is too busy to handle the message")
+	}
+}
+
+// botFailed notifies the sender of a message that the bot could not handle the message.
+func (s *msgSender) botFailed(m models.Message, reason string) {
+	f := []models.Failure{models.Failure{ID: m.ID, To: m.To, Time: m.Time, Reason: reason}}
+	if err := queueNotice(s.q, m.From, "msg.failed", f, s.msgTTL); err != nil {
+		log.Printf("bot: %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+// Package bot is a framework for writing Titan bots, which are Titan users that respond to the messages sent to them.
+//
+// Bots route the incoming messages to handlers by commands (i.e. "/weather London"), and keep a separate state for each conversation.
+// A /help command listing all the commands is built in. Connection to the server is re-established whenever it drops.
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neptulon/cmap"
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/models"
+)
+
+const (
+	authTimeout         = time.Second * 10 // wait duration for the server to respond to authentication
+	reconnectBackoff    = time.Second      // wait duration before the first reconnect attempt, doubling with each failure
+	reconnectBackoffMax = time.Minute      // maximum wait duration between reconnect attempts
+	stateTTLDefault     = time.Hour * 24   // default duration after which the state of an idle conversation is dropped
+	stateSweepInterval  = time.Minute      // maximum interval to look for the states of idle conversations
+)
+
+// Handler handles an incoming message.
+type Handler func(ctx *Ctx) error
+
+// Middleware wraps a handler with additional behavior (i.e. logging), and returns the wrapped handler.
+type Middleware func(next Handler) Handler
+
+type command struct {
+	name        string
+	description string
+	handler     Handler
+}
+
+// Bot is a Titan bot.
+type Bot struct {
+	commands []command
+	fallback Handler
+	mw       []Middleware
+
+	mutex  sync.Mutex
+	addr   string
+	token  string
+	client *client.Client
+	closed bool
+
+	stateMutex sync.Mutex
+	states     map[string]*convState
+	stateTTL   time.Duration
+	lastSweep  time.Time
+}
+
+type convState struct {
+	state    *cmap.CMap
+	lastUsed time.Time
+}
+
+// New creates a new bot.
+func New() *Bot {
+	return &Bot{states: make(map[string]*convState), stateTTL: stateTTLDefault, lastSweep: time.Now()}
+}
+
+// SetStateTTL sets the duration after which the state of a conversation is dropped if there are no new messages in the conversation.
+// Default is 24 hours.
+func (b *Bot) SetStateTTL(d time.Duration) {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+	b.stateTTL = d
+}
+
+// Command registers a handler for a command, which is a message starting with a slash followed by the command name, and optionally the arguments.
+// Description is listed in the response of the /help command. Command names are case-insensitive.
+func (b *Bot) Command(name, description string, handler Handler) {
+	b.commands = append(b.commands, command{name: strings.ToLower(strings.TrimPrefix(name, "/")), description: description, handler: handler})
+}
+
+// Handle registers a handler for the messages that are not commands.
+// If no such handler is registered, bot replies to these messages by pointing the user to the /help command.
+func (b *Bot) Handle(handler Handler) {
+	b.fallback = handler
+}
+
+// Use registers middleware to wrap all the handlers, in the given order (first one being the outermost).
+func (b *Bot) Use(mw ...Middleware) {
+	b.mw = append(b.mw, mw...)
+}
+
+// Connect connects to the server at given address, and authenticates with the JWT token of the bot user.
+// Bot reconnects whenever the connection drops, until it is closed.
+func (b *Bot) Connect(addr, jwtToken string) error {
+	b.mutex.Lock()
+	b.addr, b.token = addr, jwtToken
+	b.mutex.Unlock()
+	return b.connect()
+}
+
+// Close closes the connection to the server. Bot can not be connected again afterwards.
+func (b *Bot) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	c := b.client
+	b.client = nil
+	b.mutex.Unlock()
+
+	if c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+func (b *Bot) connect() error {
+	c, err := client.NewClient()
+	if err != nil {
+		return fmt.Errorf("bot: failed to create client: %v", err)
+	}
+	c.InMsgHandler(b.handleMsgs)
+	c.DeliveredHandler(func(d []models.Delivery) error { return nil })
+	c.ReadHandler(func(m []models.ReadMarker) error { return nil })
+	c.FailedHandler(func(f []models.Failure) error {
+		for _, fm := range f {
+			log.Printf("bot: reply %v to %v failed: %v", fm.ID, fm.To, fm.Reason)
+		}
+		return nil
+	})
+	c.PresenceHandler(func(p []models.Presence) error { return nil })
+	c.SignalHandler(func(s []models.Signal) error { return nil })
+	c.DisconnHandler(b.disconnected)
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return errors.New("bot: bot is closed")
+	}
+	addr, token := b.addr, b.token
+	b.client = c
+	b.mutex.Unlock()
+
+	if err := c.Connect(addr); err != nil {
+		b.dropClient(c, false)
+		return fmt.Errorf("bot: failed to connect: %v", err)
+	}
+
+	ack := make(chan string, 1)
+	if err := c.JWTAuth(token, func(a string) error {
+		ack <- a
+		return nil
+	}); err != nil {
+		b.dropClient(c, true)
+		return fmt.Errorf("bot: failed to authenticate: %v", err)
+	}
+	select {
+	case a := <-ack:
+		if a != client.ACK {
+			b.dropClient(c, true)
+			return fmt.Errorf("bot: server did not ACK authentication: %v", a)
+		}
+	case <-time.After(authTimeout):
+		b.dropClient(c, true)
+		return errors.New("bot: authentication timed out")
+	}
+	return nil
+}
+
+// dropClient discards the given client, closing its connection if connected, without attempting to reconnect.
+func (b *Bot) dropClient(c *client.Client, connected bool) {
+	b.mutex.Lock()
+	if b.client == c {
+		b.client = nil
+	}
+	b.mutex.Unlock()
+	if connected {
+		c.Close()
+	}
+}
+
+func (b *Bot) disconnected(c *client.Client) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed || b.client != c {
+		return
+	}
+	b.client = nil
+	go b.reconnect()
+}
+
+func (b *Bot) reconnect() {
+	backoff := reconnectBackoff
+	for {
+		time.Sleep(backoff)
+
+		err := b.connect()
+		if err == nil {
+			log.Printf("bot: reconnected to %v", b.addr)
+			return
+		}
+
+		b.mutex.Lock()
+		closed := b.closed
+		b.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		log.Printf("bot: failed to reconnect, retrying in %v: %v", backoff, err)
+		if backoff *= 2; backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
+	}
+}
+
+// send sends a message through the current connection.
+func (b *Bot) send(m models.Message) error {
+	b.mutex.Lock()
+	c := b.client
+	b.mutex.Unlock()
+	if c == nil {
+		return errors.New("bot: not connected")
+	}
+
+	return c.SendMessages([]models.Message{m}, func(res []models.SendResult, err error) error {
+		if err != nil {
+			log.Printf("bot: server rejected reply: %v", err)
+		} else if len(res) == 1 && res[0].Status != models.SendAccepted {
+			log.Printf("bot: reply to %v%v was not accepted: %v", m.To, m.Group, res[0].Status)
+		}
+		return nil
+	})
+}
+
+// state returns the state of the conversation with the given key, creating a new one if the conversation was idle for too long.
+func (b *Bot) state(key string) *cmap.CMap {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
+	now := time.Now()
+	interval := stateSweepInterval
+	if b.stateTTL < interval {
+		interval = b.stateTTL
+	}
+	if now.Sub(b.lastSweep) > interval {
+		for k, s := range b.states {
+			if now.Sub(s.lastUsed) > b.stateTTL {
+				delete(b.states, k)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	s, ok := b.states[key]
+	if !ok || now.Sub(s.lastUsed) > b.stateTTL {
+		s = &convState{state: cmap.New()}
+		b.states[key] = s
+	}
+	s.lastUsed = now
+	return s.state
+}
+
+// handleMsgs handles incoming messages. Handler errors are logged and the messages are ACKed regardless,
+// as the server would otherwise redeliver the same messages over and over again.
+func (b *Bot) handleMsgs(msgs []models.Message) error {
+	h := b.route
+	for i := len(b.mw) - 1; i >= 0; i-- {
+		h = b.mw[i](h)
+	}
+
+	for _, m := range msgs {
+		ctx := newCtx(b, m)
+		if err := h(ctx); err != nil {
+			log.Printf("bot: failed to handle message %v from %v: %v", m.ID, m.From, err)
+		}
+	}
+	return nil
+}
+
+// route dispatches a message to the handler of its command, or to the fallback handler if it is not a command.
+func (b *Bot) route(ctx *Ctx) error {
+	if ctx.Command == "" {
+		if b.fallback != nil {
+			return b.fallback(ctx)
+		}
+		return ctx.Reply("Send /help for the list of commands.")
+	}
+
+	for _, c := range b.commands {
+		if c.name == ctx.Command {
+			return c.handler(ctx)
+		}
+	}
+	if ctx.Command == "help" {
+		return ctx.Reply(b.help())
+	}
+	return ctx.Reply("Unknown command /" + ctx.Command + ". Send /help for the list of commands.")
+}
+
+// help returns the list of commands along with their descriptions.
+func (b *Bot) help() string {
+	lines := []string{"/help - Lists the commands."}
+	for _, c := range b.commands {
+		lines = append(lines, "/"+c.name+" - "+c.description)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,126 @@
+package bot_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan/bot"
+	"github.com/titan-x/titan/bot/bottest"
+)
+
+func TestBot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short testing mode")
+	}
+
+	b := bot.New()
+	b.Use(bot.Logger, bot.Recover)
+	b.Command("add", "Adds the given number to the running total.", func(ctx *bot.Ctx) error {
+		if len(ctx.Args) != 1 {
+			return ctx.Reply("Usage: /add <number>")
+		}
+		n, err := strconv.Atoi(ctx.Args[0])
+		if err != nil {
+			return ctx.Reply("Not a number: " + ctx.Args[0])
+		}
+		total, _ := ctx.State.Get("total").(int)
+		total += n
+		ctx.State.Set("total", total)
+		return ctx.Reply(strconv.Itoa(total))
+	})
+	b.Command("panic", "Panics.", func(ctx *bot.Ctx) error {
+		panic("oops")
+	})
+
+	h := bottest.New(t, b)
+	defer h.Close()
+
+	h.Send("/help")
+	if r := h.ReplyWait(); !strings.Contains(r, "/help") || !strings.Contains(r, "/add - Adds the given number") {
+		t.Fatalf("unexpected help: %v", r)
+	}
+
+	// state is kept across the messages of the conversation
+	h.Send("/add 2")
+	if r := h.ReplyWait(); r != "2" {
+		t.Fatalf("expected 2, got: %v", r)
+	}
+	h.Send("/ADD   3")
+	if r := h.ReplyWait(); r != "5" {
+		t.Fatalf("expected 5, got: %v", r)
+	}
+	h.Send("/add three")
+	if r := h.ReplyWait(); r != "Not a number: three" {
+		t.Fatalf("unexpected reply: %v", r)
+	}
+
+	h.Send("/nope")
+	if r := h.ReplyWait(); !strings.HasPrefix(r, "Unknown command /nope.") {
+		t.Fatalf("unexpected reply: %v", r)
+	}
+	h.Send("hello")
+	if r := h.ReplyWait(); !strings.Contains(r, "/help") {
+		t.Fatalf("unexpected reply: %v", r)
+	}
+
+	// bot survives panics
+	h.Send("/panic")
+	h.NoReplies()
+	h.Send("/add 1")
+	if r := h.ReplyWait(); r != "6" {
+		t.Fatalf("expected 6, got: %v", r)
+	}
+}
+
+func TestBotFallback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short testing mode")
+	}
+
+	b := bot.New()
+	b.Handle(func(ctx *bot.Ctx) error {
+		return ctx.Reply(strings.ToUpper(ctx.Message.Message))
+	})
+
+	h := bottest.New(t, b)
+	defer h.Close()
+
+	h.Send("shout")
+	if r := h.ReplyWait(); r != "SHOUT" {
+		t.Fatalf("expected SHOUT, got: %v", r)
+	}
+}
+
+func TestBotStateTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short testing mode")
+	}
+
+	b := bot.New()
+	b.SetStateTTL(time.Millisecond * 100)
+	b.Command("count", "Counts the messages.", func(ctx *bot.Ctx) error {
+		n, _ := ctx.State.Get("n").(int)
+		n++
+		ctx.State.Set("n", n)
+		return ctx.Reply(strconv.Itoa(n))
+	})
+
+	h := bottest.New(t, b)
+	defer h.Close()
+
+	h.Send("/count")
+	h.ReplyWait()
+	h.Send("/count")
+	if r := h.ReplyWait(); r != "2" {
+		t.Fatalf("expected 2, got: %v", r)
+	}
+
+	// state of an idle conversation is dropped
+	time.Sleep(time.Millisecond * 200)
+	h.Send("/count")
+	if r := h.ReplyWait(); r != "1" {
+		t.Fatalf("expected state to be reset, got: %v", r)
+	}
+}
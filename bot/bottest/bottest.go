@@ -0,0 +1,166 @@
+// Package bottest provides utilities for testing bots against an in-process Titan server.
+package bottest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan"
+	"github.com/titan-x/titan/bot"
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// Harness runs a bot against an in-process Titan server with an in-memory database, and talks to the bot as a user.
+// Bot is signed in as data.SeedUser2, and the user talking to the bot is data.SeedUser1.
+type Harness struct {
+	Server  *titan.Server
+	Bot     *bot.Bot
+	BotUser *models.User
+	User    *models.User
+
+	testing      *testing.T
+	client       *client.Client
+	msgs         chan models.Message
+	serverClosed chan bool
+}
+
+// New starts a server on a random local port, and connects the given bot and a user to it.
+func New(t *testing.T, b *bot.Bot) *Harness {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+
+	addr, err := freeAddr()
+	if err != nil {
+		t.Fatal("bottest: failed to find a free port:", err)
+	}
+	s, err := titan.NewServer(addr)
+	if err != nil {
+		t.Fatal("bottest: failed to create server:", err)
+	}
+
+	h := &Harness{
+		Server:       s,
+		Bot:          b,
+		BotUser:      &data.SeedUser2,
+		User:         &data.SeedUser1,
+		testing:      t,
+		msgs:         make(chan models.Message, 1000),
+		serverClosed: make(chan bool),
+	}
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			t.Errorf("bottest: server failed: %v", err)
+		}
+		h.serverClosed <- true
+	}()
+
+	// retry connect till the server starts listening
+	url := "ws://" + addr
+	for i := 0; ; i++ {
+		if err = b.Connect(url, h.BotUser.JWTToken); err == nil {
+			break
+		} else if i == 50 {
+			t.Fatal("bottest: failed to connect bot to the server:", err)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	if h.client, err = client.NewClient(); err != nil {
+		t.Fatal("bottest: failed to create client:", err)
+	}
+	h.client.InMsgHandler(func(m []models.Message) error {
+		for _, msg := range m {
+			h.msgs <- msg
+		}
+		return nil
+	})
+	h.client.DisconnHandler(func(c *client.Client) {})
+	if err := h.client.Connect(url); err != nil {
+		t.Fatal("bottest: failed to connect user to the server:", err)
+	}
+	ack := make(chan string, 1)
+	if err := h.client.JWTAuth(h.User.JWTToken, func(a string) error {
+		ack <- a
+		return nil
+	}); err != nil {
+		t.Fatal("bottest: failed to authenticate user:", err)
+	}
+	select {
+	case <-ack:
+	case <-time.After(time.Second * 3):
+		t.Fatal("bottest: user authentication timed out")
+	}
+
+	return h
+}
+
+// Send sends a message to the bot as the user.
+func (h *Harness) Send(message string) {
+	res := make(chan []models.SendResult, 1)
+	if err := h.client.SendMessages([]models.Message{models.Message{To: h.BotUser.ID, Message: message}}, func(r []models.SendResult, err error) error {
+		if err != nil {
+			h.testing.Errorf("bottest: server rejected message: %v", err)
+		}
+		res <- r
+		return nil
+	}); err != nil {
+		h.testing.Fatal("bottest: failed to send message:", err)
+	}
+
+	select {
+	case r := <-res:
+		if len(r) != 1 || r[0].Status != models.SendAccepted {
+			h.testing.Fatalf("bottest: message was not accepted: %+v", r)
+		}
+	case <-time.After(time.Second * 3):
+		h.testing.Fatal("bottest: did not get a msg.send response in time")
+	}
+}
+
+// ReplyWait waits for the next reply of the bot to the user, and returns its message body.
+func (h *Harness) ReplyWait() string {
+	select {
+	case m := <-h.msgs:
+		return m.Message
+	case <-time.After(time.Second * 3):
+		h.testing.Fatal("bottest: did not get a reply in time")
+	}
+	return ""
+}
+
+// NoReplies verifies that the bot did not reply.
+func (h *Harness) NoReplies() {
+	select {
+	case m := <-h.msgs:
+		h.testing.Fatalf("bottest: expected no replies, got: %v", m.Message)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// Close closes the bot, the user connection and the server.
+func (h *Harness) Close() {
+	h.Bot.Close()
+	h.client.Close()
+	if err := h.Server.Close(); err != nil {
+		h.testing.Fatal("bottest: failed to stop the server:", err)
+	}
+	select {
+	case <-h.serverClosed:
+	case <-time.After(time.Second):
+		h.testing.Fatal("bottest: server didn't close in time")
+	}
+}
+
+// freeAddr finds a free local TCP address to listen on.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"strings"
+
+	"github.com/neptulon/cmap"
+	"github.com/titan-x/titan/models"
+)
+
+// Ctx is the context of an incoming message.
+type Ctx struct {
+	Message models.Message
+	Command string     // Lowercase name of the command without the leading slash, if the message is a command.
+	Args    []string   // Arguments of the command, split by whitespace.
+	State   *cmap.CMap // State of the conversation (with the sender, or in the group for group messages), which persists across messages.
+
+	bot *Bot
+}
+
+func newCtx(b *Bot, m models.Message) *Ctx {
+	ctx := &Ctx{Message: m, bot: b}
+
+	if f := strings.Fields(m.Message); len(f) != 0 && strings.HasPrefix(f[0], "/") && len(f[0]) > 1 {
+		ctx.Command = strings.ToLower(f[0][1:])
+		ctx.Args = f[1:]
+	}
+
+	key := m.From
+	if m.Group != "" {
+		key = "group:" + m.Group
+	}
+	ctx.State = b.state(key)
+	return ctx
+}
+
+// Reply sends a message back to the sender, or to the group if the incoming message is a group message.
+func (ctx *Ctx) Reply(message string) error {
+	if ctx.Message.Group != "" {
+		return ctx.bot.send(models.Message{Group: ctx.Message.Group, Message: message})
+	}
+	return ctx.bot.send(models.Message{To: ctx.Message.From, Message: message})
+}
@@ -0,0 +1,36 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Logger is middleware for logging the incoming messages along with the time it took to handle them.
+// Only the command names are logged, leaving out the message bodies and command arguments as they might be private.
+func Logger(next Handler) Handler {
+	return func(ctx *Ctx) error {
+		start := time.Now()
+		err := next(ctx)
+		cmd := "(not a command)"
+		if ctx.Command != "" {
+			cmd = "/" + ctx.Command
+		}
+		log.Printf("bot: %v: %v from %v handled in %v, error (if any): %v", ctx.Message.ID, cmd, ctx.Message.From, time.Since(start), err)
+		return err
+	}
+}
+
+// Recover is middleware for recovering from the panics in handlers, which are turned into errors.
+// Without it, a panicking handler brings down the whole bot.
+func Recover(next Handler) Handler {
+	return func(ctx *Ctx) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("bot: recovered from panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		return next(ctx)
+	}
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/neptulon/neptulon"
+)
+
+// Error is an error response returned by the server, for a request that the server has rejected.
+type Error struct {
+	Code    int             // Error code.
+	Message string          // Human readable error message.
+	Data    json.RawMessage // Additional information about the error, if any.
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: server returned error code %v: %v", e.Code, e.Message)
+}
+
+// resError returns the error response in the given response context, if the server returned one.
+func resError(ctx *neptulon.ResCtx) *Error {
+	if ctx.Success {
+		return nil
+	}
+	e := &Error{Code: ctx.ErrorCode, Message: ctx.ErrorMessage}
+	ctx.ErrorData(&e.Data)
+	return e
+}
@@ -25,3 +25,89 @@ func (c *Client) InMsgHandler(handler func(m []models.Message) error) {
 		return ctx.Next()
 	})
 }
+
+// DeliveredHandler registers a handler to accept delivery receipts for the messages that we've sent.
+func (c *Client) DeliveredHandler(handler func(d []models.Delivery) error) {
+	c.router.Request("msg.delivered", func(ctx *neptulon.ReqCtx) error {
+		var d []models.Delivery
+		if err := ctx.Params(&d); err != nil {
+			return fmt.Errorf("client: msg.delivered: error reading request params: %v", err)
+		}
+
+		if err := handler(d); err != nil {
+			return err
+		}
+
+		ctx.Res = ACK
+		return ctx.Next()
+	})
+}
+
+// ReadHandler registers a handler to accept read markers. These are either read receipts for the messages that we've sent,
+// or read markers set by our other sessions.
+func (c *Client) ReadHandler(handler func(m []models.ReadMarker) error) {
+	c.router.Request("msg.read", func(ctx *neptulon.ReqCtx) error {
+		var m []models.ReadMarker
+		if err := ctx.Params(&m); err != nil {
+			return fmt.Errorf("client: msg.read: error reading request params: %v", err)
+		}
+
+		if err := handler(m); err != nil {
+			return err
+		}
+
+		ctx.Res = ACK
+		return ctx.Next()
+	})
+}
+
+// FailedHandler registers a handler to accept failure notices for the messages that we've sent but could not be delivered.
+func (c *Client) FailedHandler(handler func(f []models.Failure) error) {
+	c.router.Request("msg.failed", func(ctx *neptulon.ReqCtx) error {
+		var f []models.Failure
+		if err := ctx.Params(&f); err != nil {
+			return fmt.Errorf("client: msg.failed: error reading request params: %v", err)
+		}
+
+		if err := handler(f); err != nil {
+			return err
+		}
+
+		ctx.Res = ACK
+		return ctx.Next()
+	})
+}
+
+// PresenceHandler registers a handler to accept presence updates of the users that we are subscribed to.
+func (c *Client) PresenceHandler(handler func(p []models.Presence) error) {
+	c.router.Request("presence.update", func(ctx *neptulon.ReqCtx) error {
+		var p []models.Presence
+		if err := ctx.Params(&p); err != nil {
+			return fmt.Errorf("client: presence.update: error reading request params: %v", err)
+		}
+
+		if err := handler(p); err != nil {
+			return err
+		}
+
+		ctx.Res = ACK
+		return ctx.Next()
+	})
+}
+
+// SignalHandler registers a handler to accept ephemeral signals (i.e. typing indicators) from other users.
+func (c *Client) SignalHandler(handler func(s []models.Signal) error) {
+	c.router.Request("signal.recv", func(ctx *neptulon.ReqCtx) error {
+		var s []models.Signal
+		if err := ctx.Params(&s); err != nil {
+			return fmt.Errorf("client: signal.recv: error reading request params: %v", err)
+		}
+
+		if err := handler(s); err != nil {
+			return err
+		}
+
+		ctx.Res = ACK
+		return ctx.Next()
+	})
+}
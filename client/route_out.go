@@ -27,6 +27,24 @@ func (c *Client) GoogleAuth(oauthToken string, handler func(jwtToken string) err
 	return nil
 }
 
+// GoogleAuthDevice is the same as GoogleAuth, except that the retrieved JWT token is bound to the given device ID.
+// Server delivers messages to each device of a user separately, so every device should use its own ID.
+func (c *Client) GoogleAuthDevice(oauthToken, deviceID string, handler func(jwtToken string) error) error {
+	_, err := c.conn.SendRequest("auth.google", map[string]string{"token": oauthToken, "deviceid": deviceID}, func(ctx *neptulon.ResCtx) error {
+		var jwtToken map[string]string
+		if err := ctx.Result(&jwtToken); err != nil {
+			return fmt.Errorf("client: auth.google: error reading response: %v", err)
+		}
+		return handler(jwtToken["token"])
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: auth.google: error sending request: %v", err)
+	}
+
+	return nil
+}
+
 // JWTAuth authenticates using the given JWT token.
 // This also announces availability to the server, so server can start sending us pending messages.
 func (c *Client) JWTAuth(jwtToken string, handler func(ack string) error) error {
@@ -46,17 +64,308 @@ func (c *Client) JWTAuth(jwtToken string, handler func(ack string) error) error
 }
 
 // SendMessages sends a batch of messages to the server.
-func (c *Client) SendMessages(m []models.Message, handler func(ack string) error) error {
+// Handler is called with the result of each message, in the same order as the messages, so the ones that are not accepted can be retried if need be.
+// If the server rejects the batch as a whole (i.e. it exceeds the batch size), handler is called with an *Error and none of the messages are sent.
+func (c *Client) SendMessages(m []models.Message, handler func(res []models.SendResult, err error) error) error {
 	_, err := c.conn.SendRequest("msg.send", m, func(ctx *neptulon.ResCtx) error {
+		if err := resError(ctx); err != nil {
+			return handler(nil, err)
+		}
+
+		var res []models.SendResult
+		if err := ctx.Result(&res); err != nil {
+			return fmt.Errorf("client: msg.send: error reading response: %v", err)
+		}
+		return handler(res, nil)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: msg.send: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// ReadMessages marks the messages in the given conversations as read, up to the time denoted by each read marker.
+// The other party of each conversation is notified, along with our other sessions.
+func (c *Client) ReadMessages(m []models.ReadMarker, handler func(ack string) error) error {
+	_, err := c.conn.SendRequest("msg.read", m, func(ctx *neptulon.ResCtx) error {
 		var ack string
 		if err := ctx.Result(&ack); err != nil {
-			return fmt.Errorf("client: msg.send: error reading response: %v", err)
+			return fmt.Errorf("client: msg.read: error reading response: %v", err)
 		}
 		return handler(ack)
 	})
 
 	if err != nil {
-		return fmt.Errorf("client: msg.send: error sending request: %v", err)
+		return fmt.Errorf("client: msg.read: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// GetHistory retrieves a page of the message history of a conversation, with the newest message first.
+// Cursor of the returned page can be used in the next query to retrieve older messages.
+func (c *Client) GetHistory(q models.HistoryQuery, handler func(h *models.History) error) error {
+	_, err := c.conn.SendRequest("msg.history", q, func(ctx *neptulon.ResCtx) error {
+		var h models.History
+		if err := ctx.Result(&h); err != nil {
+			return fmt.Errorf("client: msg.history: error reading response: %v", err)
+		}
+		return handler(&h)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: msg.history: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// SendSignals sends ephemeral signals (i.e. typing indicators) to users or groups.
+// Signals are delivered only to the recipients that are online at the time, and are dropped otherwise.
+func (c *Client) SendSignals(s []models.Signal, handler func(ack string) error) error {
+	_, err := c.conn.SendRequest("signal.send", s, func(ctx *neptulon.ResCtx) error {
+		var ack string
+		if err := ctx.Result(&ack); err != nil {
+			return fmt.Errorf("client: signal.send: error reading response: %v", err)
+		}
+		return handler(ack)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: signal.send: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// SubscribePresence subscribes to the presence of the given users, replacing any previous subscriptions.
+// Handler is called with the current presence state of the users. Subsequent state changes are delivered to PresenceHandler.
+// Users who do not have this user in their contact list always look offline. If the request is rejected (i.e. it has too many users), handler is called with an *Error.
+func (c *Client) SubscribePresence(userIDs []string, handler func(p []models.Presence, err error) error) error {
+	_, err := c.conn.SendRequest("presence.subscribe", userIDs, func(ctx *neptulon.ResCtx) error {
+		if err := resError(ctx); err != nil {
+			return handler(nil, err)
+		}
+
+		var p []models.Presence
+		if err := ctx.Result(&p); err != nil {
+			return fmt.Errorf("client: presence.subscribe: error reading response: %v", err)
+		}
+		return handler(p, nil)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: presence.subscribe: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// CreateGroup creates a group conversation with the given members, with us as the group admin.
+// If the server rejects the request, handler is called with a nil group and an *Error.
+func (c *Client) CreateGroup(name string, members []string, handler func(g *models.Group, err error) error) error {
+	return c.sendGroupRequest("group.create", map[string]interface{}{"name": name, "members": members}, handler)
+}
+
+// AddGroupMembers adds the given users to a group, which requires us to be a group admin.
+// If the server rejects the request, handler is called with a nil group and an *Error.
+func (c *Client) AddGroupMembers(groupID string, members []string, handler func(g *models.Group, err error) error) error {
+	return c.sendGroupRequest("group.add", map[string]interface{}{"id": groupID, "members": members}, handler)
+}
+
+// RemoveGroupMembers removes the given users from a group, which requires us to be a group admin.
+// If the server rejects the request, handler is called with a nil group and an *Error.
+func (c *Client) RemoveGroupMembers(groupID string, members []string, handler func(g *models.Group, err error) error) error {
+	return c.sendGroupRequest("group.remove", map[string]interface{}{"id": groupID, "members": members}, handler)
+}
+
+// GetGroup retrieves the details and the member list of a group that we are a member of.
+// If the server rejects the request, handler is called with a nil group and an *Error.
+func (c *Client) GetGroup(groupID string, handler func(g *models.Group, err error) error) error {
+	return c.sendGroupRequest("group.info", map[string]interface{}{"id": groupID}, handler)
+}
+
+// LeaveGroup removes us from a group.
+// If the server rejects the request, handler is called with an *Error.
+func (c *Client) LeaveGroup(groupID string, handler func(err error) error) error {
+	_, err := c.conn.SendRequest("group.leave", map[string]interface{}{"id": groupID}, func(ctx *neptulon.ResCtx) error {
+		if err := resError(ctx); err != nil {
+			return handler(err)
+		}
+
+		var ack string
+		if err := ctx.Result(&ack); err != nil {
+			return fmt.Errorf("client: group.leave: error reading response: %v", err)
+		}
+		return handler(nil)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: group.leave: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Client) sendGroupRequest(method string, params interface{}, handler func(g *models.Group, err error) error) error {
+	_, err := c.conn.SendRequest(method, params, func(ctx *neptulon.ResCtx) error {
+		if err := resError(ctx); err != nil {
+			return handler(nil, err)
+		}
+
+		var g models.Group
+		if err := ctx.Result(&g); err != nil {
+			return fmt.Errorf("client: %v: error reading response: %v", method, err)
+		}
+		return handler(&g, nil)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: %v: error sending request: %v", method, err)
+	}
+
+	return nil
+}
+
+// ListContacts retrieves our contact list, along with the users we have blocked.
+func (c *Client) ListContacts(handler func(r *models.Roster, err error) error) error {
+	return c.sendContactsRequest("contacts.list", nil, handler)
+}
+
+// AddContact adds a user to our contact list, with an optional display name in the Name field.
+// Handler is called with the updated roster. If the server rejects the request, handler is called with a nil roster and an *Error.
+func (c *Client) AddContact(contact models.Contact, handler func(r *models.Roster, err error) error) error {
+	return c.sendContactsRequest("contacts.add", contact, handler)
+}
+
+// RemoveContact removes a user from our contact list.
+func (c *Client) RemoveContact(userID string, handler func(r *models.Roster, err error) error) error {
+	return c.sendContactsRequest("contacts.remove", models.Contact{ID: userID}, handler)
+}
+
+// BlockContact blocks a user, so the messages and signals of the user are no longer delivered to us.
+func (c *Client) BlockContact(userID string, handler func(r *models.Roster, err error) error) error {
+	return c.sendContactsRequest("contacts.block", models.Contact{ID: userID}, handler)
+}
+
+// UnblockContact unblocks a user.
+func (c *Client) UnblockContact(userID string, handler func(r *models.Roster, err error) error) error {
+	return c.sendContactsRequest("contacts.unblock", models.Contact{ID: userID}, handler)
+}
+
+func (c *Client) sendContactsRequest(method string, params interface{}, handler func(r *models.Roster, err error) error) error {
+	_, err := c.conn.SendRequest(method, params, func(ctx *neptulon.ResCtx) error {
+		if err := resError(ctx); err != nil {
+			return handler(nil, err)
+		}
+
+		var r models.Roster
+		if err := ctx.Result(&r); err != nil {
+			return fmt.Errorf("client: %v: error reading response: %v", method, err)
+		}
+		return handler(&r, nil)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: %v: error sending request: %v", method, err)
+	}
+
+	return nil
+}
+
+// LookupUsers finds the users with the given contact hashes (see models.HashEmail and models.HashPhoneNumber), to discover which of our contacts are Titan users.
+// Handler is called with the matching users only. If the server rejects the request, handler is called with a nil result and an *Error.
+func (c *Client) LookupUsers(hashes []string, handler func(res []models.LookupResult, err error) error) error {
+	_, err := c.conn.SendRequest("users.lookup", hashes, func(ctx *neptulon.ResCtx) error {
+		if err := resError(ctx); err != nil {
+			return handler(nil, err)
+		}
+
+		var res []models.LookupResult
+		if err := ctx.Result(&res); err != nil {
+			return fmt.Errorf("client: users.lookup: error reading response: %v", err)
+		}
+		return handler(res, nil)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: users.lookup: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// RegisterDevice registers the push token of this device, so the server can send push notifications to it while the user is offline.
+// Device is identified by the device ID in the JWT token of the connection. Only Platform, PushToken and AppVersion fields are used.
+// If the server rejects the device (i.e. the push token is registered to another user), handler is called with an *Error.
+func (c *Client) RegisterDevice(d models.Device, handler func(ack string, err error) error) error {
+	_, err := c.conn.SendRequest("device.register", d, func(ctx *neptulon.ResCtx) error {
+		if err := resError(ctx); err != nil {
+			return handler("", err)
+		}
+
+		var ack string
+		if err := ctx.Result(&ack); err != nil {
+			return fmt.Errorf("client: device.register: error reading response: %v", err)
+		}
+		return handler(ack, nil)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: device.register: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// UnregisterDevice unregisters this device, so it is no longer sent push notifications.
+func (c *Client) UnregisterDevice(handler func(ack string) error) error {
+	_, err := c.conn.SendRequest("device.unregister", nil, func(ctx *neptulon.ResCtx) error {
+		var ack string
+		if err := ctx.Result(&ack); err != nil {
+			return fmt.Errorf("client: device.unregister: error reading response: %v", err)
+		}
+		return handler(ack)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: device.unregister: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// SubscribePush registers the Web Push subscription of a browser, so the server can send push messages to it while the user is offline.
+func (c *Client) SubscribePush(sub models.WebPushSubscription, handler func(ack string) error) error {
+	_, err := c.conn.SendRequest("push.subscribe", sub, func(ctx *neptulon.ResCtx) error {
+		var ack string
+		if err := ctx.Result(&ack); err != nil {
+			return fmt.Errorf("client: push.subscribe: error reading response: %v", err)
+		}
+		return handler(ack)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: push.subscribe: error sending request: %v", err)
+	}
+
+	return nil
+}
+
+// ListBots retrieves the metadata of the bots that users can send messages to.
+func (c *Client) ListBots(handler func(b []models.BotInfo) error) error {
+	_, err := c.conn.SendRequest("bots.list", nil, func(ctx *neptulon.ResCtx) error {
+		var b []models.BotInfo
+		if err := ctx.Result(&b); err != nil {
+			return fmt.Errorf("client: bots.list: error reading response: %v", err)
+		}
+		return handler(b)
+	})
+
+	if err != nil {
+		return fmt.Errorf("client: bots.list: error sending request: %v", err)
 	}
 
 	return nil
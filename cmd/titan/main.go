@@ -8,6 +8,7 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/titan-x/titan"
 	"github.com/titan-x/titan/data/aws"
+	"github.com/titan-x/titan/data/diskqueue"
 )
 
 const (
@@ -19,6 +20,7 @@ var (
 	defaultFlag = flag.Bool("default", false, "Start Titan server at default address: "+addr)
 	addrFlag    = flag.String("addr", "", "Start Titan server with specified address parameter.")
 	awsFlag     = flag.Bool("aws", false, "Enable Amazon Web Services support. See AWS SDK docs for configuration options.")
+	queueFlag   = flag.String("queue", "", "Directory to store the durable on-disk message queue in. In-memory queue is used if not specified.")
 	testFlag    = flag.Bool("test", false, "Start Titan server for external client integration test at address: "+testAddr)
 )
 
@@ -47,6 +49,15 @@ func startServer(addr string) {
 		s.SetDB(aws.NewDynamoDB("", ""))
 	}
 
+	if *queueFlag != "" {
+		q, err := diskqueue.NewQueue(s.SendRequest, *queueFlag)
+		if err != nil {
+			log.Fatalf("error creating disk queue: %v", err)
+		}
+		defer q.Close()
+		s.SetQueue(q)
+	}
+
 	defer func() {
 		if s.Close(); err != nil {
 			log.Printf("error closing server: %v", err)
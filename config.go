@@ -1,8 +1,12 @@
 package titan
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 const (
@@ -13,6 +17,19 @@ const (
 	port     = "PORT"
 	jwtPass  = "PASS"
 
+	// queue environment variables
+	queueAckTimeout   = "QUEUE_ACK_TIMEOUT"
+	queueMaxAttempts  = "QUEUE_MAX_ATTEMPTS"
+	queueRetryBackoff = "QUEUE_RETRY_BACKOFF"
+	queueMessageTTL   = "QUEUE_MESSAGE_TTL"
+	queueDeviceTTL    = "QUEUE_DEVICE_TTL"
+
+	// message limit environment variables
+	msgMaxBodySize    = "MSG_MAX_BODY_SIZE"
+	msgMaxBatchSize   = "MSG_MAX_BATCH_SIZE"
+	msgMaxRequestSize = "MSG_MAX_REQUEST_SIZE"
+	msgRateLimit      = "MSG_RATE_LIMIT"
+
 	// possible TITAN_ENV values
 	envDev  = "development"
 	envTest = "test"
@@ -22,12 +39,60 @@ const (
 	gcmSenderID = "GCM_SENDER_ID"
 	gcmCcsHost  = "GCM_CCS_HOST"
 
+	// APNS environment variables
+	apnsHost        = "APNS_HOST"
+	apnsTopic       = "APNS_TOPIC"
+	apnsKeyID       = "APNS_KEY_ID"
+	apnsTeamID      = "APNS_TEAM_ID"
+	apnsAuthKeyFile = "APNS_AUTH_KEY"
+	apnsCertFile    = "APNS_CERT"
+	apnsCertKeyFile = "APNS_CERT_KEY"
+
+	// Web Push environment variables
+	webPushSubject    = "WEBPUSH_SUBJECT"
+	webPushPrivateKey = "WEBPUSH_VAPID_PRIVATE_KEY"
+	webPushInsecure   = "WEBPUSH_INSECURE"
+
+	// user lookup environment variables
+	lookupMaxBatchSize = "LOOKUP_MAX_BATCH_SIZE"
+	lookupRateLimit    = "LOOKUP_RATE_LIMIT"
+	lookupPepper       = "LOOKUP_PEPPER"
+
+	// bot environment variables
+	botWebhooks           = "BOT_WEBHOOKS"
+	botWebhookTimeout     = "BOT_WEBHOOK_TIMEOUT"
+	botWebhookMaxAttempts = "BOT_WEBHOOK_MAX_ATTEMPTS"
+
 	// Google environment variables
 	googleAPIKey = "GOOGLE_API_KEY"
 
 	// Default listener port configuration
 	portDefault = "3000"
 	portTest    = "3001"
+
+	// Default queue configuration
+	queueAckTimeoutDefault   = time.Second * 30
+	queueMaxAttemptsDefault  = 10
+	queueRetryBackoffDefault = time.Second
+	queueMessageTTLDefault   = time.Hour * 24 * 7
+	queueDeviceTTLDefault    = time.Hour * 24 * 30
+
+	// Default message limits
+	msgMaxBodySizeDefault    = 64 * 1024
+	msgMaxBatchSizeDefault   = 100
+	msgMaxRequestSizeDefault = 1024 * 1024
+	msgRateLimitDefault      = 600
+
+	// Default user lookup limits
+	lookupMaxBatchSizeDefault = 1000
+	lookupRateLimitDefault    = 2000
+
+	// Default bot configuration
+	botWebhookTimeoutDefault     = time.Second * 10
+	botWebhookMaxAttemptsDefault = 3
+
+	// placeholder for the secrets in the printed configuration
+	redacted = "[redacted]"
 )
 
 // Conf contains all the global configuration for the titan server.
@@ -35,8 +100,14 @@ var Conf Config
 
 // Config describes the global configuration for the titan server.
 type Config struct {
-	App App
-	GCM GCM
+	App     App
+	GCM     GCM
+	APNS    APNS
+	WebPush WebPush
+	Queue   Queue
+	Msg     Msg
+	Lookup  Lookup
+	Bots    Bots
 }
 
 // App contains the global application variables.
@@ -66,6 +137,87 @@ func (gcm *GCM) APIKey() string {
 	return os.Getenv(googleAPIKey)
 }
 
+// APNS describes the Apple Push Notification service parameters.
+// Either the token-based authentication parameters (KeyID, TeamID, AuthKeyFile) or the certificate-based ones (CertFile, CertKeyFile) should be given.
+type APNS struct {
+	Host        string // APNS endpoint. Defaults to production endpoint.
+	Topic       string // Bundle ID of the iOS app.
+	KeyID       string // ID of the .p8 auth key.
+	TeamID      string // Apple developer team ID.
+	AuthKeyFile string // Path to the .p8 auth key file.
+	CertFile    string // Path to the PEM encoded provider certificate.
+	CertKeyFile string // Path to the PEM encoded private key of the provider certificate.
+}
+
+// WebPush describes the Web Push parameters for sending push messages to browsers.
+type WebPush struct {
+	Subject         string // Contact URI of the application server (mailto: or https:), sent to push services along with VAPID tokens.
+	VAPIDPrivateKey string // Base64url encoded P-256 private key for signing VAPID tokens. Web Push is disabled if empty.
+	Insecure        bool   // Allows plain HTTP and local network endpoints for push services. Only for testing.
+}
+
+// String returns the Web Push parameters with the VAPID private key redacted, so the configuration can be logged.
+func (w WebPush) String() string {
+	type webPush WebPush
+	if w.VAPIDPrivateKey != "" {
+		w.VAPIDPrivateKey = redacted
+	}
+	return fmt.Sprintf("%+v", webPush(w))
+}
+
+// Queue contains the message queue parameters.
+type Queue struct {
+	AckTimeout   time.Duration // Duration to wait for a client ACK before redelivering a request.
+	MaxAttempts  int           // Failed delivery attempts before a request is moved to dead-letters.
+	RetryBackoff time.Duration // Wait duration before retrying a failed delivery attempt, doubling with each failure.
+	MessageTTL   time.Duration // Default time-to-live for queued messages, after which undelivered messages expire.
+	DeviceTTL    time.Duration // Duration after which a device that has not connected is forgotten, so queued messages are no longer held back for it.
+}
+
+// Msg contains the limits for the messages that clients send.
+type Msg struct {
+	MaxBodySize    int // Maximum size of a message body in bytes.
+	MaxBatchSize   int // Maximum number of messages in a single msg.send request.
+	MaxRequestSize int // Maximum size of the parameters of a msg.send request in bytes.
+	RateLimit      int // Maximum number of messages a user can send per minute.
+}
+
+// Lookup contains the limits for the user lookups that clients make for discovering their contacts.
+type Lookup struct {
+	MaxBatchSize int    // Maximum number of hashes in a single users.lookup request.
+	RateLimit    int    // Maximum number of hashes a user can look up per day.
+	Pepper       string // Server secret that the lookup hashes are stored with, so a leaked database does not give away the hashes to reverse.
+}
+
+// String returns the lookup parameters with the pepper redacted, so the configuration can be logged.
+func (l Lookup) String() string {
+	type lookup Lookup
+	if l.Pepper != "" {
+		l.Pepper = redacted
+	}
+	return fmt.Sprintf("%+v", lookup(l))
+}
+
+// Bots contains the parameters of the webhook bots, which are hosted outside of the server.
+type Bots struct {
+	WebhookTimeout     time.Duration // Timeout of the HTTP requests to webhook bots.
+	WebhookMaxAttempts int           // Attempts to forward a message to a webhook bot before giving up. Wait between attempts is same as Queue.RetryBackoff.
+}
+
+// Webhooks gets the webhook bots from environment variable, given as a JSON array of Webhook objects.
+func (b *Bots) Webhooks() ([]Webhook, error) {
+	env := os.Getenv(botWebhooks)
+	if env == "" {
+		return nil, nil
+	}
+
+	var ws []Webhook
+	if err := json.Unmarshal([]byte(env), &ws); err != nil {
+		return nil, fmt.Errorf("conf: failed to parse %v: %v", botWebhooks, err)
+	}
+	return ws, nil
+}
+
 // InitConf initializes application configuration.
 // If given, env parameter overrides environment configuration. This is useful for testing.
 func InitConf(env string) {
@@ -88,8 +240,78 @@ func InitConf(env string) {
 		}
 	}
 
+	ackTimeout, err := time.ParseDuration(os.Getenv(queueAckTimeout))
+	if err != nil || ackTimeout <= 0 {
+		ackTimeout = queueAckTimeoutDefault
+	}
+	maxAttempts, err := strconv.Atoi(os.Getenv(queueMaxAttempts))
+	if err != nil || maxAttempts <= 0 {
+		maxAttempts = queueMaxAttemptsDefault
+	}
+	retryBackoff, err := time.ParseDuration(os.Getenv(queueRetryBackoff))
+	if err != nil || retryBackoff <= 0 {
+		retryBackoff = queueRetryBackoffDefault
+	}
+	messageTTL, err := time.ParseDuration(os.Getenv(queueMessageTTL))
+	if err != nil || messageTTL <= 0 {
+		messageTTL = queueMessageTTLDefault
+	}
+	deviceTTL, err := time.ParseDuration(os.Getenv(queueDeviceTTL))
+	if err != nil || deviceTTL <= 0 {
+		deviceTTL = queueDeviceTTLDefault
+	}
+
+	maxBodySize, err := strconv.Atoi(os.Getenv(msgMaxBodySize))
+	if err != nil || maxBodySize <= 0 {
+		maxBodySize = msgMaxBodySizeDefault
+	}
+	maxBatchSize, err := strconv.Atoi(os.Getenv(msgMaxBatchSize))
+	if err != nil || maxBatchSize <= 0 {
+		maxBatchSize = msgMaxBatchSizeDefault
+	}
+	maxRequestSize, err := strconv.Atoi(os.Getenv(msgMaxRequestSize))
+	if err != nil || maxRequestSize <= 0 {
+		maxRequestSize = msgMaxRequestSizeDefault
+	}
+	rateLimit, err := strconv.Atoi(os.Getenv(msgRateLimit))
+	if err != nil || rateLimit <= 0 {
+		rateLimit = msgRateLimitDefault
+	}
+
+	lookupBatchSize, err := strconv.Atoi(os.Getenv(lookupMaxBatchSize))
+	if err != nil || lookupBatchSize <= 0 {
+		lookupBatchSize = lookupMaxBatchSizeDefault
+	}
+	lookupRate, err := strconv.Atoi(os.Getenv(lookupRateLimit))
+	if err != nil || lookupRate <= 0 {
+		lookupRate = lookupRateLimitDefault
+	}
+
+	webhookTimeout, err := time.ParseDuration(os.Getenv(botWebhookTimeout))
+	if err != nil || webhookTimeout <= 0 {
+		webhookTimeout = botWebhookTimeoutDefault
+	}
+	webhookMaxAttempts, err := strconv.Atoi(os.Getenv(botWebhookMaxAttempts))
+	if err != nil || webhookMaxAttempts <= 0 {
+		webhookMaxAttempts = botWebhookMaxAttemptsDefault
+	}
+
 	app := App{Env: env, Debug: debug, Port: port}
 	gcm := GCM{CCSHost: os.Getenv(gcmCcsHost), SenderID: os.Getenv(gcmSenderID)}
-	Conf = Config{App: app, GCM: gcm}
+	apns := APNS{
+		Host:        os.Getenv(apnsHost),
+		Topic:       os.Getenv(apnsTopic),
+		KeyID:       os.Getenv(apnsKeyID),
+		TeamID:      os.Getenv(apnsTeamID),
+		AuthKeyFile: os.Getenv(apnsAuthKeyFile),
+		CertFile:    os.Getenv(apnsCertFile),
+		CertKeyFile: os.Getenv(apnsCertKeyFile),
+	}
+	webPush := WebPush{Subject: os.Getenv(webPushSubject), VAPIDPrivateKey: os.Getenv(webPushPrivateKey), Insecure: os.Getenv(webPushInsecure) != ""}
+	queue := Queue{AckTimeout: ackTimeout, MaxAttempts: maxAttempts, RetryBackoff: retryBackoff, MessageTTL: messageTTL, DeviceTTL: deviceTTL}
+	msg := Msg{MaxBodySize: maxBodySize, MaxBatchSize: maxBatchSize, MaxRequestSize: maxRequestSize, RateLimit: rateLimit}
+	lookup := Lookup{MaxBatchSize: lookupBatchSize, RateLimit: lookupRate, Pepper: os.Getenv(lookupPepper)}
+	bots := Bots{WebhookTimeout: webhookTimeout, WebhookMaxAttempts: webhookMaxAttempts}
+	Conf = Config{App: app, GCM: gcm, APNS: apns, WebPush: webPush, Queue: queue, Msg: msg, Lookup: lookup, Bots: bots}
 	log.Printf("conf: initialized: %+v\n", Conf)
 }
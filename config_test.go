@@ -1,6 +1,10 @@
 package titan
 
-import "testing"
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
 
 func init() {
 	InitConf("test")
@@ -26,6 +30,23 @@ func TestConfig(t *testing.T) {
 	InitConf("test")
 }
 
+func TestConfigRedaction(t *testing.T) {
+	defer InitConf("test")
+	Conf.WebPush.VAPIDPrivateKey = "vapid-secret"
+	Conf.Lookup.Pepper = "lookup-secret"
+
+	s := fmt.Sprintf("%+v", Conf)
+	if strings.Contains(s, "vapid-secret") || !strings.Contains(s, "VAPIDPrivateKey:"+redacted) {
+		t.Fatalf("expected secrets to be redacted in printed configuration, got: %v", s)
+	}
+	if strings.Contains(s, "lookup-secret") || !strings.Contains(s, "Pepper:"+redacted) {
+		t.Fatalf("expected secrets to be redacted in printed configuration, got: %v", s)
+	}
+	if Conf.WebPush.VAPIDPrivateKey != "vapid-secret" || Conf.Lookup.Pepper != "lookup-secret" {
+		t.Fatal("expected redaction to leave the configuration intact")
+	}
+}
+
 func TestGoEnv(t *testing.T) {
 	// GO_ENV should be used if "TITAN_ENV" is empty
 	// if both are empty, should be env = dev
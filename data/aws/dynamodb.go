@@ -7,10 +7,13 @@
 package aws
 
 import (
+	"encoding/base64"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -19,6 +22,12 @@ import (
 	"github.com/titan-x/titan/models"
 )
 
+const (
+	// wait for newly created indexes to become active, up to 10 minutes
+	indexWaitAttempts = 120
+	indexWaitDelay    = time.Second * 5
+)
+
 // DynamoDB implementation for DB interface.
 type DynamoDB struct {
 	DB      *dynamodb.DynamoDB
@@ -32,7 +41,7 @@ type DynamoDB struct {
 // endpoint = Optional endpoint URL setting. Useful for specifying local/development service URL.
 func NewDynamoDB(region string, endpoint string) *DynamoDB {
 	db := DynamoDB{}
-	db.Tables = []string{"users"}
+	db.Tables = []string{"users", "devices", "readmarkers", "messages", "groups", "contacts", "blocks"}
 
 	// carefully crafting config elements not to mess with the defaults
 	if region != "" || endpoint != "" {
@@ -89,30 +98,11 @@ func (db *DynamoDB) deleteTables() error {
 	return nil
 }
 
-// Seed creates and populates the database, overwriting existing data if specified.
-func (db *DynamoDB) Seed(overwrite bool, jwtPass string) error {
-	cred, err := db.DB.Config.Credentials.Get()
-	if err != nil {
-		return fmt.Errorf("dynamodb: failed to initialize: %v", err)
-	}
-
-	log.Printf("dynamodb: initialized with region: %v, access key ID: %v, endpoint: %v", *(db.DB.Config.Region), cred.AccessKeyID, db.DB.Config.Endpoint)
-
-	if !overwrite {
-		if tbls, err := db.listTables(); err != nil {
-			return err
-		} else if len(tbls) != 0 {
-			return nil
-		}
-	}
-
-	if err := db.deleteTables(); err != nil {
-		return err
-	}
-
-	// create the tables
-	for _, tbl := range db.Tables {
-		tableParams := &dynamodb.CreateTableInput{
+// tableParams returns the table creation parameters (keys, indexes, etc.) for the given table.
+func tableParams(tbl string) *dynamodb.CreateTableInput {
+	switch tbl {
+	case "users":
+		return &dynamodb.CreateTableInput{
 			TableName: aws.String(tbl),
 			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
 				ReadCapacityUnits:  aws.Int64(1),
@@ -127,6 +117,18 @@ func (db *DynamoDB) Seed(overwrite bool, jwtPass string) error {
 					AttributeName: aws.String("Email"),
 					AttributeType: aws.String("S"),
 				},
+				{
+					AttributeName: aws.String("GCMRegID"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("EmailHash"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("PhoneHash"),
+					AttributeType: aws.String("S"),
+				},
 			},
 			KeySchema: []*dynamodb.KeySchemaElement{
 				{
@@ -154,6 +156,54 @@ func (db *DynamoDB) Seed(overwrite bool, jwtPass string) error {
 						WriteCapacityUnits: aws.Int64(1),
 					},
 				},
+				{
+					IndexName: aws.String("GCMRegID"),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{
+							AttributeName: aws.String("GCMRegID"),
+							KeyType:       aws.String("HASH"),
+						},
+					},
+					Projection: &dynamodb.Projection{
+						ProjectionType: aws.String("KEYS_ONLY"),
+					},
+					ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+						ReadCapacityUnits:  aws.Int64(1),
+						WriteCapacityUnits: aws.Int64(1),
+					},
+				},
+				{
+					IndexName: aws.String("EmailHash"),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{
+							AttributeName: aws.String("EmailHash"),
+							KeyType:       aws.String("HASH"),
+						},
+					},
+					Projection: &dynamodb.Projection{
+						ProjectionType: aws.String("KEYS_ONLY"),
+					},
+					ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+						ReadCapacityUnits:  aws.Int64(1),
+						WriteCapacityUnits: aws.Int64(1),
+					},
+				},
+				{
+					IndexName: aws.String("PhoneHash"),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{
+							AttributeName: aws.String("PhoneHash"),
+							KeyType:       aws.String("HASH"),
+						},
+					},
+					Projection: &dynamodb.Projection{
+						ProjectionType: aws.String("KEYS_ONLY"),
+					},
+					ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+						ReadCapacityUnits:  aws.Int64(1),
+						WriteCapacityUnits: aws.Int64(1),
+					},
+				},
 			},
 			// LocalSecondaryIndexes: []*dynamodb.LocalSecondaryIndex{
 			// 	{
@@ -179,10 +229,231 @@ func (db *DynamoDB) Seed(overwrite bool, jwtPass string) error {
 			// 	StreamViewType: aws.String("StreamViewType"),
 			// },
 		}
+	case "devices":
+		return &dynamodb.CreateTableInput{
+			TableName: aws.String(tbl),
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(1),
+				WriteCapacityUnits: aws.Int64(1),
+			},
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{
+					AttributeName: aws.String("userid"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("id"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("token"),
+					AttributeType: aws.String("S"),
+				},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: aws.String("userid"),
+					KeyType:       aws.String("HASH"),
+				},
+				{
+					AttributeName: aws.String("id"),
+					KeyType:       aws.String("RANGE"),
+				},
+			},
+			GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+				{
+					IndexName: aws.String("token"),
+					KeySchema: []*dynamodb.KeySchemaElement{
+						{
+							AttributeName: aws.String("token"),
+							KeyType:       aws.String("HASH"),
+						},
+					},
+					Projection: &dynamodb.Projection{
+						ProjectionType: aws.String("ALL"),
+					},
+					ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+						ReadCapacityUnits:  aws.Int64(1),
+						WriteCapacityUnits: aws.Int64(1),
+					},
+				},
+			},
+		}
+	case "readmarkers":
+		return &dynamodb.CreateTableInput{
+			TableName: aws.String(tbl),
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(1),
+				WriteCapacityUnits: aws.Int64(1),
+			},
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{
+					AttributeName: aws.String("from"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("peer"),
+					AttributeType: aws.String("S"),
+				},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: aws.String("from"),
+					KeyType:       aws.String("HASH"),
+				},
+				{
+					AttributeName: aws.String("peer"),
+					KeyType:       aws.String("RANGE"),
+				},
+			},
+		}
+	case "messages":
+		return &dynamodb.CreateTableInput{
+			TableName: aws.String(tbl),
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(1),
+				WriteCapacityUnits: aws.Int64(1),
+			},
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{
+					AttributeName: aws.String("conv"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("seq"),
+					AttributeType: aws.String("S"),
+				},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: aws.String("conv"),
+					KeyType:       aws.String("HASH"),
+				},
+				{
+					AttributeName: aws.String("seq"),
+					KeyType:       aws.String("RANGE"),
+				},
+			},
+		}
+	case "groups":
+		return &dynamodb.CreateTableInput{
+			TableName: aws.String(tbl),
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(1),
+				WriteCapacityUnits: aws.Int64(1),
+			},
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{
+					AttributeName: aws.String("id"),
+					AttributeType: aws.String("S"),
+				},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: aws.String("id"),
+					KeyType:       aws.String("HASH"),
+				},
+			},
+		}
+	case "contacts":
+		return &dynamodb.CreateTableInput{
+			TableName: aws.String(tbl),
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(1),
+				WriteCapacityUnits: aws.Int64(1),
+			},
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{
+					AttributeName: aws.String("userid"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("id"),
+					AttributeType: aws.String("S"),
+				},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: aws.String("userid"),
+					KeyType:       aws.String("HASH"),
+				},
+				{
+					AttributeName: aws.String("id"),
+					KeyType:       aws.String("RANGE"),
+				},
+			},
+		}
+	case "blocks":
+		return &dynamodb.CreateTableInput{
+			TableName: aws.String(tbl),
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(1),
+				WriteCapacityUnits: aws.Int64(1),
+			},
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{
+					AttributeName: aws.String("userid"),
+					AttributeType: aws.String("S"),
+				},
+				{
+					AttributeName: aws.String("peer"),
+					AttributeType: aws.String("S"),
+				},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: aws.String("userid"),
+					KeyType:       aws.String("HASH"),
+				},
+				{
+					AttributeName: aws.String("peer"),
+					KeyType:       aws.String("RANGE"),
+				},
+			},
+		}
+	}
+
+	return nil
+}
+
+// Seed creates and populates the database, overwriting existing data if specified.
+// Otherwise, only the missing tables and indexes are created (i.e. the ones added with a server upgrade), and existing data is kept.
+// Seed data is inserted only if the users table is created.
+func (db *DynamoDB) Seed(overwrite bool, jwtPass string) error {
+	cred, err := db.DB.Config.Credentials.Get()
+	if err != nil {
+		return fmt.Errorf("dynamodb: failed to initialize: %v", err)
+	}
+
+	log.Printf("dynamodb: initialized with region: %v, access key ID: %v, endpoint: %v", *(db.DB.Config.Region), cred.AccessKeyID, db.DB.Config.Endpoint)
 
-		if _, err := db.DB.CreateTable(tableParams); err != nil {
+	if overwrite {
+		if err := db.deleteTables(); err != nil {
 			return err
 		}
+	}
+
+	tbls, err := db.listTables()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, tbl := range tbls {
+		exists[tbl] = true
+	}
+
+	// create the missing tables, and the missing indexes of the existing ones
+	for _, tbl := range db.Tables {
+		if exists[tbl] {
+			if err := db.createIndexes(tbl); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := db.DB.CreateTable(tableParams(tbl)); err != nil {
+			return fmt.Errorf("dynamodb: failed to create table %v: %v", tbl, err)
+		}
 
 		// tables with secondary indexes need to be created sequentially so wait till table is ready
 		if err := db.DB.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(tbl)}); err != nil {
@@ -190,6 +461,10 @@ func (db *DynamoDB) Seed(overwrite bool, jwtPass string) error {
 		}
 	}
 
+	if exists["users"] {
+		return nil
+	}
+
 	// insert the seed data
 	if err := data.SeedInit(jwtPass); err != nil {
 		return err
@@ -204,33 +479,94 @@ func (db *DynamoDB) Seed(overwrite bool, jwtPass string) error {
 	return nil
 }
 
-// GetByID retrieves a user by ID with OK indicator.
-func (db *DynamoDB) GetByID(id string) (u *models.User, ok bool) {
-	res, err := db.DB.GetItem(&dynamodb.GetItemInput{
-		ConsistentRead: aws.Bool(true),
-		TableName:      aws.String("users"),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ID": {
-				S: aws.String(id),
-			},
-		},
-	})
+// createIndexes creates the global secondary indexes of an existing table which are missing from it, one at a time.
+func (db *DynamoDB) createIndexes(tbl string) error {
+	res, err := db.DB.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tbl)})
 	if err != nil {
-		log.Printf("dynamodb: error: %v", err)
-		return nil, false
-	}
-	if len(res.Item) == 0 {
-		return nil, false
+		return fmt.Errorf("dynamodb: failed to describe table %v: %v", tbl, err)
 	}
-
-	var user models.User
-	if err := dynamodbattribute.UnmarshalMap(res.Item, &user); err != nil {
-		log.Printf("dynamodb: getbyid error: %v", err)
-		return nil, false
+	exists := make(map[string]bool)
+	for _, idx := range res.Table.GlobalSecondaryIndexes {
+		exists[*idx.IndexName] = true
 	}
 
-	return &user, true
-}
+	params := tableParams(tbl)
+	for _, idx := range params.GlobalSecondaryIndexes {
+		if exists[*idx.IndexName] {
+			continue
+		}
+
+		_, err := db.DB.UpdateTable(&dynamodb.UpdateTableInput{
+			TableName:            aws.String(tbl),
+			AttributeDefinitions: params.AttributeDefinitions,
+			GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+				{
+					Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+						IndexName:             idx.IndexName,
+						KeySchema:             idx.KeySchema,
+						Projection:            idx.Projection,
+						ProvisionedThroughput: idx.ProvisionedThroughput,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("dynamodb: failed to create index %v of table %v: %v", *idx.IndexName, tbl, err)
+		}
+
+		// only one index can be created at a time, so wait till it is backfilled
+		if err := db.waitUntilIndexActive(tbl, *idx.IndexName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitUntilIndexActive waits until a newly created global secondary index is backfilled and becomes usable.
+func (db *DynamoDB) waitUntilIndexActive(tbl, idx string) error {
+	for i := 0; i < indexWaitAttempts; i++ {
+		res, err := db.DB.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tbl)})
+		if err != nil {
+			return fmt.Errorf("dynamodb: failed to describe table %v: %v", tbl, err)
+		}
+		for _, gsi := range res.Table.GlobalSecondaryIndexes {
+			if *gsi.IndexName == idx && gsi.IndexStatus != nil && *gsi.IndexStatus == dynamodb.IndexStatusActive {
+				return nil
+			}
+		}
+		time.Sleep(indexWaitDelay)
+	}
+	return fmt.Errorf("dynamodb: timed out waiting for index %v of table %v to become active", idx, tbl)
+}
+
+// GetByID retrieves a user by ID with OK indicator.
+func (db *DynamoDB) GetByID(id string) (u *models.User, ok bool) {
+	res, err := db.DB.GetItem(&dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      aws.String("users"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {
+				S: aws.String(id),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("dynamodb: error: %v", err)
+		return nil, false
+	}
+	if len(res.Item) == 0 {
+		return nil, false
+	}
+
+	var user models.User
+	if err := dynamodbattribute.UnmarshalMap(res.Item, &user); err != nil {
+		log.Printf("dynamodb: getbyid error: %v", err)
+		return nil, false
+	}
+
+	return &user, true
+}
 
 // GetByEmail retrieves a user by e-mail with OK indicator.
 func (db *DynamoDB) GetByEmail(email string) (u *models.User, ok bool) {
@@ -250,6 +586,9 @@ func (db *DynamoDB) GetByEmail(email string) (u *models.User, ok bool) {
 		log.Printf("dynamodb: getbymail error: %v", err)
 		return nil, false
 	}
+	if len(res.Items) == 0 {
+		return nil, false
+	}
 
 	var user models.User
 	if err := dynamodbattribute.UnmarshalMap(res.Items[0], &user); err != nil {
@@ -260,6 +599,73 @@ func (db *DynamoDB) GetByEmail(email string) (u *models.User, ok bool) {
 	return &user, true
 }
 
+// GetByGCMRegID retrieves a user by GCM registration ID with OK indicator.
+func (db *DynamoDB) GetByGCMRegID(regID string) (u *models.User, ok bool) {
+	res, err := db.DB.Query(&dynamodb.QueryInput{
+		TableName:              aws.String("users"),
+		IndexName:              aws.String("GCMRegID"),
+		KeyConditionExpression: aws.String("GCMRegID = :GCMRegID"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":GCMRegID": {
+				S: aws.String(regID),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("dynamodb: getbygcmregid error: %v", err)
+		return nil, false
+	}
+	if len(res.Items) == 0 {
+		// registration ID might belong to a registered device instead
+		if d, ok := db.GetDeviceByToken(regID); ok && d.Platform == models.PlatformAndroid {
+			return db.GetByID(d.UserID)
+		}
+		return nil, false
+	}
+
+	// index only projects the keys so retrieve the full user item
+	id := res.Items[0]["ID"]
+	if id == nil || id.S == nil {
+		return nil, false
+	}
+	return db.GetByID(*id.S)
+}
+
+// GetByContactHash retrieves a user by the lookup key of their e-mail address or phone number with OK indicator.
+func (db *DynamoDB) GetByContactHash(hash string) (u *models.User, ok bool) {
+	for _, idx := range []string{"PhoneHash", "EmailHash"} {
+		res, err := db.DB.Query(&dynamodb.QueryInput{
+			TableName:              aws.String("users"),
+			IndexName:              aws.String(idx),
+			KeyConditionExpression: aws.String(idx + " = :hash"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":hash": {
+					S: aws.String(hash),
+				},
+			},
+		})
+		if err != nil {
+			log.Printf("dynamodb: getbycontacthash error: %v", err)
+			return nil, false
+		}
+		if len(res.Items) == 0 {
+			continue
+		}
+
+		// index only projects the keys so retrieve the full user item, which also tells if the index is lagging behind a change of the keys
+		id := res.Items[0]["ID"]
+		if id == nil || id.S == nil {
+			return nil, false
+		}
+		u, ok := db.GetByID(*id.S)
+		if !ok || (u.EmailHash != hash && u.PhoneHash != hash) {
+			return nil, false
+		}
+		return u, true
+	}
+	return nil, false
+}
+
 // SaveUser creates or updates a user. Upon creation, users are assigned a unique ID.
 func (db *DynamoDB) SaveUser(u *models.User) error {
 	if u.ID == "" {
@@ -271,6 +677,7 @@ func (db *DynamoDB) SaveUser(u *models.User) error {
 		u.ID = id
 	}
 
+	// empty lookup keys are left out as index keys cannot be empty strings
 	item, err := dynamodbattribute.MarshalMap(u)
 	if err != nil {
 		return err
@@ -286,3 +693,586 @@ func (db *DynamoDB) SaveUser(u *models.User) error {
 
 	return nil
 }
+
+// ClearPushToken clears the GCM registration ID or the APNS device token of a user, if it is still the given token.
+func (db *DynamoDB) ClearPushToken(userID, platform, token string) error {
+	var attr string
+	switch platform {
+	case models.PlatformAndroid:
+		attr = "GCMRegID"
+	case models.PlatformIOS:
+		attr = "APNSDeviceToken"
+	default:
+		return fmt.Errorf("dynamodb: unknown push platform: %v", platform)
+	}
+
+	// conditional update leaves the user record alone if the token was changed in the meantime
+	_, err := db.DB.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String("users"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ID": {
+				S: aws.String(userID),
+			},
+		},
+		UpdateExpression:    aws.String("REMOVE #token"),
+		ConditionExpression: aws.String("#token = :token"),
+		ExpressionAttributeNames: map[string]*string{
+			"#token": aws.String(attr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token": {
+				S: aws.String(token),
+			},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+		return nil
+	}
+	return err
+}
+
+// AddWebPushSub adds a Web Push subscription to a user, dropping the oldest subscriptions beyond the given maximum.
+func (db *DynamoDB) AddWebPushSub(userID string, sub models.WebPushSubscription, max int) error {
+	return db.updateWebPushSubs(userID, func(subs []models.WebPushSubscription) []models.WebPushSubscription {
+		return models.AddWebPushSub(subs, sub, max)
+	})
+}
+
+// RemoveWebPushSub removes the Web Push subscription with the given endpoint from a user.
+func (db *DynamoDB) RemoveWebPushSub(userID, endpoint string) error {
+	return db.updateWebPushSubs(userID, func(subs []models.WebPushSubscription) []models.WebPushSubscription {
+		return models.RemoveWebPushSub(subs, endpoint)
+	})
+}
+
+// maximum number of attempts to update an attribute that is being concurrently modified
+const maxUpdateAttempts = 5
+
+// updateWebPushSubs updates the Web Push subscriptions of a user without touching the rest of the user record.
+// Update is conditional on the subscriptions not being modified since they were read, and is retried otherwise.
+func (db *DynamoDB) updateWebPushSubs(userID string, update func(subs []models.WebPushSubscription) []models.WebPushSubscription) error {
+	key := map[string]*dynamodb.AttributeValue{
+		"ID": {
+			S: aws.String(userID),
+		},
+	}
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		res, err := db.DB.GetItem(&dynamodb.GetItemInput{
+			ConsistentRead:       aws.Bool(true),
+			TableName:            aws.String("users"),
+			Key:                  key,
+			ProjectionExpression: aws.String("ID, WebPush"),
+		})
+		if err != nil {
+			return err
+		}
+		if len(res.Item) == 0 {
+			return fmt.Errorf("dynamodb: user not found: %v", userID)
+		}
+
+		var subs []models.WebPushSubscription
+		old, ok := res.Item["WebPush"]
+		if ok {
+			if err := dynamodbattribute.Unmarshal(old, &subs); err != nil {
+				return err
+			}
+		}
+
+		in := &dynamodb.UpdateItemInput{
+			TableName:                 aws.String("users"),
+			Key:                       key,
+			ExpressionAttributeNames:  map[string]*string{"#subs": aws.String("WebPush")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{},
+		}
+		switch {
+		case !ok:
+			in.ConditionExpression = aws.String("attribute_not_exists(#subs)")
+		case old.NULL != nil && *old.NULL:
+			in.ConditionExpression = aws.String("attribute_type(#subs, :null)")
+			in.ExpressionAttributeValues[":null"] = &dynamodb.AttributeValue{S: aws.String("NULL")}
+		default:
+			in.ConditionExpression = aws.String("#subs = :old")
+			in.ExpressionAttributeValues[":old"] = old
+		}
+
+		if subs := update(subs); len(subs) != 0 {
+			av, err := dynamodbattribute.Marshal(subs)
+			if err != nil {
+				return err
+			}
+			in.UpdateExpression = aws.String("SET #subs = :subs")
+			in.ExpressionAttributeValues[":subs"] = av
+		} else {
+			in.UpdateExpression = aws.String("REMOVE #subs")
+		}
+		if len(in.ExpressionAttributeValues) == 0 {
+			in.ExpressionAttributeValues = nil
+		}
+
+		_, err = db.DB.UpdateItem(in)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ConditionalCheckFailedException" {
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("dynamodb: failed to update Web Push subscriptions of user %v due to concurrent modifications", userID)
+}
+
+// GetDevices retrieves all the registered devices of a user.
+func (db *DynamoDB) GetDevices(userID string) ([]models.Device, error) {
+	res, err := db.DB.Query(&dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		TableName:              aws.String("devices"),
+		KeyConditionExpression: aws.String("userid = :userid"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":userid": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ds := []models.Device{}
+	for _, item := range res.Items {
+		var d models.Device
+		if err := dynamodbattribute.UnmarshalMap(item, &d); err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+
+	return ds, nil
+}
+
+// GetDeviceByToken retrieves the device with the given push token with OK indicator.
+func (db *DynamoDB) GetDeviceByToken(token string) (d *models.Device, ok bool) {
+	res, err := db.DB.Query(&dynamodb.QueryInput{
+		TableName:              aws.String("devices"),
+		IndexName:              aws.String("token"),
+		KeyConditionExpression: aws.String("#token = :token"),
+		ExpressionAttributeNames: map[string]*string{
+			"#token": aws.String("token"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token": {
+				S: aws.String(token),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("dynamodb: getdevicebytoken error: %v", err)
+		return nil, false
+	}
+	if len(res.Items) == 0 {
+		return nil, false
+	}
+
+	var device models.Device
+	if err := dynamodbattribute.UnmarshalMap(res.Items[0], &device); err != nil {
+		log.Printf("dynamodb: getdevicebytoken error: %v", err)
+		return nil, false
+	}
+
+	return &device, true
+}
+
+// SaveDevice creates or updates a device of a user.
+func (db *DynamoDB) SaveDevice(d *models.Device) error {
+	if d.UserID == "" || d.ID == "" {
+		return fmt.Errorf("dynamodb: device is missing user ID or device ID: %+v", d)
+	}
+
+	item, err := dynamodbattribute.MarshalMap(d)
+	if err != nil {
+		return err
+	}
+	if d.PushToken == "" {
+		// index keys cannot be empty strings
+		delete(item, "token")
+	}
+
+	_, err = db.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("devices"),
+		Item:      item,
+	})
+	return err
+}
+
+// DeleteDevice deletes a device of a user.
+func (db *DynamoDB) DeleteDevice(userID, deviceID string) error {
+	_, err := db.DB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("devices"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userid": {
+				S: aws.String(userID),
+			},
+			"id": {
+				S: aws.String(deviceID),
+			},
+		},
+	})
+	return err
+}
+
+// GetReadMarkers retrieves all the read markers of a user.
+func (db *DynamoDB) GetReadMarkers(userID string) ([]models.ReadMarker, error) {
+	res, err := db.DB.Query(&dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		TableName:              aws.String("readmarkers"),
+		KeyConditionExpression: aws.String("#from = :from"),
+		ExpressionAttributeNames: map[string]*string{
+			"#from": aws.String("from"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":from": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ms := []models.ReadMarker{}
+	for _, item := range res.Items {
+		var m models.ReadMarker
+		if err := dynamodbattribute.UnmarshalMap(item, &m); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, nil
+}
+
+// SaveReadMarker creates or updates a read marker.
+func (db *DynamoDB) SaveReadMarker(m *models.ReadMarker) error {
+	item, err := dynamodbattribute.MarshalMap(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("readmarkers"),
+		Item:      item,
+	})
+	return err
+}
+
+// SaveMessage stores a message in the history of the conversation between its sender and recipient, or of its group.
+// Messages are keyed by conversation ID and a sequence key made up of the message time and ID, so they sort chronologically.
+func (db *DynamoDB) SaveMessage(m *models.Message) error {
+	return db.saveMessage(m, false)
+}
+
+// SaveDroppedMessage stores a message in the history of the conversation between its sender and recipient, hidden from the recipient.
+func (db *DynamoDB) SaveDroppedMessage(m *models.Message) error {
+	return db.saveMessage(m, true)
+}
+
+func (db *DynamoDB) saveMessage(m *models.Message, dropped bool) error {
+	item, err := dynamodbattribute.MarshalMap(m)
+	if err != nil {
+		return err
+	}
+
+	conv := convID(m.From, m.To)
+	if m.Group != "" {
+		conv = groupConvID(m.Group)
+	}
+
+	item["conv"] = &dynamodb.AttributeValue{S: aws.String(conv)}
+	item["seq"] = &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%020d|%s", m.Time.UnixNano(), m.ID))}
+	if dropped {
+		item["hiddenFrom"] = &dynamodb.AttributeValue{S: aws.String(m.To)}
+	}
+
+	_, err = db.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("messages"),
+		Item:      item,
+	})
+	return err
+}
+
+// GetMessages retrieves a page of messages in a conversation, newest first.
+func (db *DynamoDB) GetMessages(userID, peer, cursor string, limit int) (ms []models.Message, nextCursor string, err error) {
+	return db.getMessages(convID(userID, peer), userID, cursor, limit)
+}
+
+// GetGroupMessages retrieves a page of messages in a group conversation, newest first.
+func (db *DynamoDB) GetGroupMessages(groupID, cursor string, limit int) (ms []models.Message, nextCursor string, err error) {
+	return db.getMessages(groupConvID(groupID), "", cursor, limit)
+}
+
+// getMessages retrieves a page of messages in a conversation, leaving out the dropped messages sent to the given user.
+// Cursor is the encoded sequence key of the oldest message in the previous page.
+// Since the limit applies before the dropped messages are filtered out, pages can be shorter than the limit.
+func (db *DynamoDB) getMessages(conv, userID, cursor string, limit int) (ms []models.Message, nextCursor string, err error) {
+	input := &dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		TableName:              aws.String("messages"),
+		KeyConditionExpression: aws.String("conv = :conv"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":conv": {
+				S: aws.String(conv),
+			},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(int64(limit)),
+	}
+
+	if userID != "" {
+		input.FilterExpression = aws.String("attribute_not_exists(hiddenFrom) OR hiddenFrom <> :user")
+		input.ExpressionAttributeValues[":user"] = &dynamodb.AttributeValue{S: aws.String(userID)}
+	}
+
+	if cursor != "" {
+		seq, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("dynamodb: invalid cursor: %v", err)
+		}
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"conv": {S: aws.String(conv)},
+			"seq":  {S: aws.String(string(seq))},
+		}
+	}
+
+	res, err := db.DB.Query(input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ms = []models.Message{}
+	for _, item := range res.Items {
+		var m models.Message
+		if err := dynamodbattribute.UnmarshalMap(item, &m); err != nil {
+			return nil, "", err
+		}
+		ms = append(ms, m)
+	}
+
+	if seq, ok := res.LastEvaluatedKey["seq"]; ok && seq.S != nil {
+		nextCursor = base64.RawURLEncoding.EncodeToString([]byte(*seq.S))
+	}
+
+	return ms, nextCursor, nil
+}
+
+// convID returns a conversation ID that is the same for both parties of a conversation.
+func convID(user1, user2 string) string {
+	if user1 > user2 {
+		user1, user2 = user2, user1
+	}
+	return user1 + "|" + user2
+}
+
+// groupConvID returns the conversation ID of a group.
+func groupConvID(groupID string) string {
+	return "#" + groupID
+}
+
+// GetGroup retrieves a group by ID with OK indicator.
+func (db *DynamoDB) GetGroup(id string) (g *models.Group, ok bool) {
+	res, err := db.DB.GetItem(&dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      aws.String("groups"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("dynamodb: getgroup error: %v", err)
+		return nil, false
+	}
+	if len(res.Item) == 0 {
+		return nil, false
+	}
+
+	var group models.Group
+	if err := dynamodbattribute.UnmarshalMap(res.Item, &group); err != nil {
+		log.Printf("dynamodb: getgroup error: %v", err)
+		return nil, false
+	}
+
+	return &group, true
+}
+
+// SaveGroup creates or updates a group. Upon creation, groups are assigned a unique ID.
+func (db *DynamoDB) SaveGroup(g *models.Group) error {
+	if g.ID == "" {
+		id, err := shortid.ID(64)
+		if err != nil {
+			return err
+		}
+
+		g.ID = id
+	}
+
+	item, err := dynamodbattribute.MarshalMap(g)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("groups"),
+		Item:      item,
+	})
+	return err
+}
+
+// GetContacts retrieves the contacts of a user, sorted by contact ID.
+func (db *DynamoDB) GetContacts(userID string) ([]models.Contact, error) {
+	res, err := db.DB.Query(&dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		TableName:              aws.String("contacts"),
+		KeyConditionExpression: aws.String("userid = :userid"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":userid": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cs := []models.Contact{}
+	for _, item := range res.Items {
+		var c models.Contact
+		if err := dynamodbattribute.UnmarshalMap(item, &c); err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+
+	return cs, nil
+}
+
+// SaveContact creates or updates a contact of a user.
+func (db *DynamoDB) SaveContact(c *models.Contact) error {
+	if c.UserID == "" || c.ID == "" {
+		return fmt.Errorf("dynamodb: contact is missing user ID or contact ID: %+v", c)
+	}
+
+	item, err := dynamodbattribute.MarshalMap(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("contacts"),
+		Item:      item,
+	})
+	return err
+}
+
+// DeleteContact deletes a contact of a user.
+func (db *DynamoDB) DeleteContact(userID, contactID string) error {
+	_, err := db.DB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("contacts"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userid": {
+				S: aws.String(userID),
+			},
+			"id": {
+				S: aws.String(contactID),
+			},
+		},
+	})
+	return err
+}
+
+// IsContact tells whether the user has the given peer in their contact list.
+func (db *DynamoDB) IsContact(userID, peerID string) (bool, error) {
+	res, err := db.DB.GetItem(&dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      aws.String("contacts"),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userid": {
+				S: aws.String(userID),
+			},
+			"id": {
+				S: aws.String(peerID),
+			},
+		},
+		ProjectionExpression: aws.String("id"),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(res.Item) != 0, nil
+}
+
+// GetBlocked retrieves the IDs of the users that the user has blocked, sorted.
+func (db *DynamoDB) GetBlocked(userID string) ([]string, error) {
+	res, err := db.DB.Query(&dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		TableName:              aws.String("blocks"),
+		KeyConditionExpression: aws.String("userid = :userid"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":userid": {
+				S: aws.String(userID),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, item := range res.Items {
+		if p, ok := item["peer"]; ok && p.S != nil {
+			ids = append(ids, *p.S)
+		}
+	}
+
+	return ids, nil
+}
+
+// IsBlocked tells whether the user has blocked the given peer.
+func (db *DynamoDB) IsBlocked(userID, peerID string) (bool, error) {
+	res, err := db.DB.GetItem(&dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      aws.String("blocks"),
+		Key:            blockKey(userID, peerID),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(res.Item) != 0, nil
+}
+
+// Block blocks the given peer for the user.
+func (db *DynamoDB) Block(userID, peerID string) error {
+	_, err := db.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("blocks"),
+		Item:      blockKey(userID, peerID),
+	})
+	return err
+}
+
+// Unblock unblocks the given peer for the user.
+func (db *DynamoDB) Unblock(userID, peerID string) error {
+	_, err := db.DB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("blocks"),
+		Key:       blockKey(userID, peerID),
+	})
+	return err
+}
+
+func blockKey(userID, peerID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"userid": {
+			S: aws.String(userID),
+		},
+		"peer": {
+			S: aws.String(peerID),
+		},
+	}
+}
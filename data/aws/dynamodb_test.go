@@ -3,7 +3,10 @@ package aws
 import (
 	"bytes"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/titan-x/titan"
 	"github.com/titan-x/titan/data"
 	"github.com/titan-x/titan/models"
@@ -84,6 +87,61 @@ func TestSeed(t *testing.T) {
 	}
 }
 
+func TestSeedExistingSchema(t *testing.T) {
+	db := newTestDynamoDB(t)
+	if err := db.deleteTables(); err != nil {
+		t.Fatal(err)
+	}
+
+	// schema of the earlier server versions, with only the users table and its e-mail index
+	tbl := tableParams("users")
+	tbl.AttributeDefinitions = tbl.AttributeDefinitions[:2]
+	tbl.GlobalSecondaryIndexes = tbl.GlobalSecondaryIndexes[:1]
+	if _, err := db.DB.CreateTable(tbl); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String("users")}); err != nil {
+		t.Fatal(err)
+	}
+	u := models.User{Email: "existing@user", Name: "Existing User"}
+	if err := db.SaveUser(&u); err != nil {
+		t.Fatal(err)
+	}
+
+	// seeding again should create the missing tables and indexes while keeping the existing data
+	if err := db.Seed(false, titan.Conf.App.JWTPass()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Seed(false, titan.Conf.App.JWTPass()); err != nil {
+		t.Fatalf("expected seeding an up-to-date schema to be a no-op, got: %v", err)
+	}
+
+	tbls, err := db.listTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tbls) != len(db.Tables) {
+		t.Fatalf("expected tables %v, got: %v", db.Tables, tbls)
+	}
+	res, err := db.DB.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String("users")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Table.GlobalSecondaryIndexes) != len(tableParams("users").GlobalSecondaryIndexes) {
+		t.Fatalf("expected the missing indexes to be created, got: %+v", res.Table.GlobalSecondaryIndexes)
+	}
+
+	if eu, ok := db.GetByEmail(u.Email); !ok || eu.ID != u.ID {
+		t.Fatalf("expected existing user to be kept, got: %+v", eu)
+	}
+	if _, ok := db.GetByID(data.SeedUser1.ID); ok {
+		t.Fatal("expected seed data not to be inserted into an existing users table")
+	}
+	if _, err := db.GetReadMarkers(u.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGetByID(t *testing.T) {
 	db := newTestDynamoDB(t)
 
@@ -110,6 +168,19 @@ func TestGetByMail(t *testing.T) {
 	}
 }
 
+func TestGetByGCMRegID(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	for _, user := range data.SeedUsers {
+		u, ok := db.GetByGCMRegID(user.GCMRegID)
+		if !ok {
+			t.Fatal("coulnd't get user")
+		}
+
+		compareUsersForEquality(t, u, &user)
+	}
+}
+
 func TestSaveUser(t *testing.T) {
 	db := newTestDynamoDB(t)
 
@@ -139,3 +210,254 @@ func TestSaveUser(t *testing.T) {
 
 	compareUsersForEquality(t, ur, &u)
 }
+
+func TestReadMarkers(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	m := models.ReadMarker{From: "1", Peer: "2", Time: time.Now()}
+	if err := db.SaveReadMarker(&m); err != nil {
+		t.Fatal(err)
+	}
+	m.Time = m.Time.Add(time.Second)
+	if err := db.SaveReadMarker(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := db.GetReadMarkers("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].Peer != "2" || !ms[0].Time.Equal(m.Time) {
+		t.Fatalf("unexpected read markers: %+v", ms)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		m := models.Message{ID: id, From: "1", To: "2", Time: now.Add(time.Duration(i) * time.Second), Message: "Hello!"}
+		if err := db.SaveMessage(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ms, cursor, err := db.GetMessages("2", "1", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].ID != "c" || ms[1].ID != "b" || cursor == "" {
+		t.Fatalf("unexpected first page: %+v, cursor: %v", ms, cursor)
+	}
+
+	ms, _, err = db.GetMessages("1", "2", cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].ID != "a" {
+		t.Fatalf("unexpected second page: %+v", ms)
+	}
+}
+
+func TestDroppedMessages(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	now := time.Now()
+	if err := db.SaveMessage(&models.Message{ID: "a", From: "1", To: "2", Time: now, Message: "Hello!"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveDroppedMessage(&models.Message{ID: "b", From: "1", To: "2", Time: now.Add(time.Second), Message: "Hello?"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, _, err := db.GetMessages("1", "2", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].ID != "b" {
+		t.Fatalf("expected dropped message in sender's history, got: %+v", ms)
+	}
+
+	ms, _, err = db.GetMessages("2", "1", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].ID != "a" {
+		t.Fatalf("expected dropped message to be hidden from the recipient, got: %+v", ms)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	g := models.Group{Name: "friends", Members: []models.GroupMember{{UserID: "1", Role: models.GroupRoleAdmin}, {UserID: "2", Role: models.GroupRoleMember}}, Created: time.Now()}
+	if err := db.SaveGroup(&g); err != nil {
+		t.Fatal(err)
+	}
+	if g.ID == "" {
+		t.Fatal("expected group to be assigned an ID")
+	}
+
+	gr, ok := db.GetGroup(g.ID)
+	if !ok {
+		t.Fatal("failed to retrieve group")
+	}
+	if gr.Name != g.Name || len(gr.Members) != 2 || gr.Members[1].UserID != "2" || gr.Members[1].Role != models.GroupRoleMember {
+		t.Fatalf("unexpected group: %+v", gr)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	d := models.Device{UserID: "1", ID: "phone", Platform: models.PlatformAndroid, PushToken: "gcm-reg-id-phone", AppVersion: "1.0", LastSeen: time.Now()}
+	if err := db.SaveDevice(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := db.GetDevices("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].ID != "phone" || ds[0].PushToken != d.PushToken || ds[0].AppVersion != "1.0" {
+		t.Fatalf("unexpected devices: %+v", ds)
+	}
+
+	if dt, ok := db.GetDeviceByToken(d.PushToken); !ok || dt.UserID != "1" || dt.ID != "phone" {
+		t.Fatalf("failed to retrieve device by token: %+v", dt)
+	}
+	if u, ok := db.GetByGCMRegID(d.PushToken); !ok || u.ID != "1" {
+		t.Fatalf("failed to retrieve user by device GCM registration ID: %+v", u)
+	}
+
+	if err := db.DeleteDevice("1", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err := db.GetDevices("1"); err != nil || len(ds) != 0 {
+		t.Fatalf("expected device to be deleted: %+v, %v", ds, err)
+	}
+}
+
+func TestClearPushToken(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	u, _ := db.GetByID("1")
+	u.APNSDeviceToken = "apns-token-new"
+	if err := db.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	// stale token should not clear the new one
+	if err := db.ClearPushToken("1", models.PlatformIOS, "apns-token-old"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := db.GetByID("1"); u.APNSDeviceToken != "apns-token-new" {
+		t.Fatalf("expected push token to be kept, got: %v", u.APNSDeviceToken)
+	}
+
+	if err := db.ClearPushToken("1", models.PlatformIOS, "apns-token-new"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := db.GetByID("1"); u.APNSDeviceToken != "" || u.Email == "" {
+		t.Fatalf("expected only the push token to be cleared, got: %+v", u)
+	}
+}
+
+func TestWebPushSubs(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	for _, e := range []string{"https://push.example.com/1", "https://push.example.com/2", "https://push.example.com/3", "https://push.example.com/2"} {
+		if err := db.AddWebPushSub("1", models.WebPushSubscription{Endpoint: e}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u, _ := db.GetByID("1"); len(u.WebPush) != 2 || u.WebPush[0].Endpoint != "https://push.example.com/3" || u.WebPush[1].Endpoint != "https://push.example.com/2" {
+		t.Fatalf("expected the latest 2 subscriptions, got: %+v", u.WebPush)
+	}
+
+	for _, e := range []string{"https://push.example.com/2", "https://push.example.com/3"} {
+		if err := db.RemoveWebPushSub("1", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u, _ := db.GetByID("1"); len(u.WebPush) != 0 || u.Email == "" {
+		t.Fatalf("expected only the subscriptions to be removed, got: %+v", u)
+	}
+}
+
+func TestRoster(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	c := models.Contact{UserID: "1", ID: "2", Name: "Morgan", Added: time.Now()}
+	if err := db.SaveContact(&c); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := db.GetContacts("1"); err != nil || len(cs) != 1 || cs[0].ID != "2" || cs[0].Name != "Morgan" {
+		t.Fatalf("unexpected contacts: %+v, %v", cs, err)
+	}
+	if ok, err := db.IsContact("1", "2"); err != nil || !ok {
+		t.Fatalf("expected user to be a contact: %v", err)
+	}
+	if ok, err := db.IsContact("2", "1"); err != nil || ok {
+		t.Fatalf("expected contacts to be one way: %v", err)
+	}
+	if err := db.DeleteContact("1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if cs, err := db.GetContacts("1"); err != nil || len(cs) != 0 {
+		t.Fatalf("expected contact to be deleted: %+v, %v", cs, err)
+	}
+
+	if err := db.Block("1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.IsBlocked("1", "2"); err != nil || !b {
+		t.Fatalf("expected user to be blocked: %v", err)
+	}
+	if b, err := db.IsBlocked("2", "1"); err != nil || b {
+		t.Fatalf("expected blocking to be one way: %v", err)
+	}
+	if ids, err := db.GetBlocked("1"); err != nil || len(ids) != 1 || ids[0] != "2" {
+		t.Fatalf("unexpected blocked users: %v, %v", ids, err)
+	}
+	if err := db.Unblock("1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.IsBlocked("1", "2"); err != nil || b {
+		t.Fatalf("expected user to be unblocked: %v", err)
+	}
+}
+
+func TestGetByContactHash(t *testing.T) {
+	db := newTestDynamoDB(t)
+
+	// lookup keys are opaque to the database
+	u := &models.User{Email: "lookup@titan.x", PhoneNumber: "+46123456789"}
+	u.SetLookupHashes("pepper")
+	if err := db.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if fu, ok := db.GetByContactHash(u.PhoneHash); !ok || fu.ID != u.ID {
+		t.Fatalf("failed to retrieve user by phone number key: %+v", fu)
+	}
+	if fu, ok := db.GetByContactHash(u.EmailHash); !ok || fu.ID != u.ID {
+		t.Fatalf("failed to retrieve user by e-mail key: %+v", fu)
+	}
+	if fu, ok := db.GetByContactHash(models.HashEmail(u.Email)); ok {
+		t.Fatalf("expected no user for unpeppered hash, got: %+v", fu)
+	}
+
+	// old keys do not match once the keys change
+	old := u.EmailHash
+	u.SetLookupHashes("new pepper")
+	if err := db.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if fu, ok := db.GetByContactHash(old); ok {
+		t.Fatalf("expected no user for old key, got: %+v", fu)
+	}
+	if fu, ok := db.GetByContactHash(u.EmailHash); !ok || fu.ID != u.ID {
+		t.Fatalf("failed to retrieve user by new e-mail key: %+v", fu)
+	}
+}
@@ -5,6 +5,10 @@ import "github.com/titan-x/titan/models"
 // DB wraps all database related functions.
 type DB interface {
 	UserDB
+	ReadMarkerDB
+	MessageDB
+	GroupDB
+	RosterDB
 }
 
 // UserDB presists user information in database.
@@ -12,5 +16,66 @@ type UserDB interface {
 	Seed(overwrite bool, jwtPass string) error
 	GetByID(id string) (u *models.User, ok bool)
 	GetByEmail(email string) (u *models.User, ok bool)
+	GetByGCMRegID(regID string) (u *models.User, ok bool)
+	// GetByContactHash retrieves a user by one of the lookup keys in the user record (see models.User.SetLookupHashes).
+	// Keys are opaque to the database, and the users whose keys have changed since are not returned for their old keys.
+	GetByContactHash(hash string) (u *models.User, ok bool)
 	SaveUser(u *models.User) error
+	// ClearPushToken clears the GCM registration ID or the APNS device token (per platform) in the user record,
+	// only if it is still the given token, so that a token registered in the meantime is kept.
+	ClearPushToken(userID, platform, token string) error
+	// AddWebPushSub adds a Web Push subscription to the user record, replacing the one with the same endpoint if any,
+	// and dropping the oldest subscriptions beyond the given maximum.
+	AddWebPushSub(userID string, sub models.WebPushSubscription, max int) error
+	// RemoveWebPushSub removes the Web Push subscription with the given endpoint from the user record, if the user has it.
+	RemoveWebPushSub(userID, endpoint string) error
+
+	// GetDevices retrieves all the registered devices of a user.
+	GetDevices(userID string) ([]models.Device, error)
+	// GetDeviceByToken retrieves the device with the given push token, which belongs to a single device at a time.
+	GetDeviceByToken(token string) (d *models.Device, ok bool)
+	// SaveDevice creates or updates a device of a user, identified by UserID and ID fields.
+	SaveDevice(d *models.Device) error
+	DeleteDevice(userID, deviceID string) error
+}
+
+// ReadMarkerDB persists per-conversation read markers of users.
+type ReadMarkerDB interface {
+	GetReadMarkers(userID string) ([]models.ReadMarker, error)
+	SaveReadMarker(m *models.ReadMarker) error
+}
+
+// MessageDB persists the history of the messages sent between users.
+type MessageDB interface {
+	SaveMessage(m *models.Message) error
+	// SaveDroppedMessage stores a message that was dropped because its recipient blocked the sender.
+	// Dropped messages are only visible in the history of the sender.
+	SaveDroppedMessage(m *models.Message) error
+	// GetMessages retrieves a page of messages in a conversation, newest first, starting after the given cursor.
+	// Returned cursor is to be used for retrieving the next page of older messages, and is empty if there are no more.
+	GetMessages(userID, peer, cursor string, limit int) (ms []models.Message, nextCursor string, err error)
+	GetGroupMessages(groupID, cursor string, limit int) (ms []models.Message, nextCursor string, err error)
+}
+
+// GroupDB persists group conversations along with their members.
+type GroupDB interface {
+	GetGroup(id string) (g *models.Group, ok bool)
+	SaveGroup(g *models.Group) error
+}
+
+// RosterDB persists the contact lists of users, along with the users they have blocked.
+type RosterDB interface {
+	GetContacts(userID string) ([]models.Contact, error)
+	// SaveContact creates or updates a contact of a user, identified by UserID and ID fields.
+	SaveContact(c *models.Contact) error
+	DeleteContact(userID, contactID string) error
+	// IsContact tells whether the user has the given peer in their contact list.
+	IsContact(userID, peerID string) (bool, error)
+
+	// GetBlocked retrieves the IDs of the users that the user has blocked.
+	GetBlocked(userID string) ([]string, error)
+	// IsBlocked tells whether the user has blocked the given peer.
+	IsBlocked(userID, peerID string) (bool, error)
+	Block(userID, peerID string) error
+	Unblock(userID, peerID string) error
 }
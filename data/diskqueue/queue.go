@@ -0,0 +1,368 @@
+// Package diskqueue provides a durable, on-disk implementation of data.Queue.
+//
+// Every request is appended to a log file before it is handed over to the in-memory delivery queue,
+// so requests that are not yet acknowledged by the recipient survive process restarts and crashes.
+// Entries are marked acknowledged once all the known devices of the recipient ACK them, and compacted out of the log file periodically.
+// Per-device delivery state is not persisted, so a request that was delivered to some of the devices before a restart
+// is redelivered to all of them afterwards.
+// Requests moved to dead-letters are marked as such in the log file, so they are restored to dead-letters after a restart,
+// until they are replayed or purged. Expiry times of requests are persisted too, so expired requests are never replayed.
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/data/inmem"
+)
+
+const (
+	logFile = "queue.log"
+
+	// minimum number of acknowledged entries in the log file before compaction kicks in
+	compactThreshold = 1000
+)
+
+// Queue is a durable message queue for queueing and sending messages to users.
+// Delivery is done by an embedded in-memory queue while all pending requests are persisted to disk.
+type Queue struct {
+	*inmem.Queue
+
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	seq     uint64             // last assigned log entry ID
+	pending map[uint64]*record // entry ID -> pending request
+	acked   int                // number of acknowledged entries still residing in the log file
+}
+
+// record is a single log file entry.
+type record struct {
+	Op      string          `json:"op"` // "add", "ack", "dead" (moved to dead-letters), or "live" (replayed from dead-letters)
+	ID      uint64          `json:"id"`
+	UserID  string          `json:"user,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Expires *time.Time      `json:"expires,omitempty"`
+
+	// dead-letter details, for "dead" entries
+	Attempts int        `json:"attempts,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Time     *time.Time `json:"time,omitempty"`
+
+	dead *record // "dead" entry of a pending request that is in dead-letters
+}
+
+// NewQueue creates a new durable queue object, storing its log file in the given directory.
+// Any pending requests from a previous run are replayed into the queue, to be delivered once their recipients connect.
+func NewQueue(senderFunc inmem.SenderFunc, dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("diskqueue: failed to create queue directory: %v", err)
+	}
+
+	q := Queue{
+		Queue:   inmem.NewQueue(senderFunc),
+		path:    filepath.Join(dir, logFile),
+		pending: make(map[uint64]*record),
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	// start with a clean log file that contains only the pending requests
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range q.sortedPending() {
+		if r.dead != nil {
+			dl := data.DeadLetter{UserID: r.UserID, Method: r.Method, Params: r.Params, Attempts: r.dead.Attempts, Reason: r.dead.Reason, Time: *r.dead.Time}
+			q.Queue.RestoreDeadLetter(dl, r.expires(), q.tracking(r.ID))
+			continue
+		}
+		if err := q.Queue.AddTrackedRequest(r.UserID, r.Method, r.Params, r.expires(), nil, nil, q.tracking(r.ID)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &q, nil
+}
+
+// AddRequest persists and queues a request message to be sent to the given user.
+// Note that response handlers are not persisted so they will not be called for requests replayed after a restart.
+func (q *Queue) AddRequest(userID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) error {
+	return q.AddExpiringRequest(userID, method, params, time.Time{}, resHandler, nil)
+}
+
+// AddExpiringRequest persists and queues a request message to be sent to the given user, which is dropped if not delivered before the expiry time.
+// Zero expiry time means that the request never expires. Just like response handlers, fail handlers are not persisted.
+func (q *Queue) AddExpiringRequest(userID string, method string, params interface{}, expires time.Time, resHandler func(ctx *neptulon.ResCtx) error, failHandler func(reason string) error) error {
+	p, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("diskqueue: failed to serialize request params: %v", err)
+	}
+
+	q.mu.Lock()
+	q.seq++
+	r := &record{Op: "add", ID: q.seq, UserID: userID, Method: method, Params: p}
+	if !expires.IsZero() {
+		r.Expires = &expires
+	}
+	err = q.write(r, true)
+	if err == nil {
+		q.pending[r.ID] = r
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := q.Queue.AddTrackedRequest(userID, method, params, expires, resHandler, failHandler, q.tracking(r.ID)); err != nil {
+		// roll back the log entry so the request is not replayed after a restart
+		if aerr := q.ack(r.ID); aerr != nil {
+			log.Printf("diskqueue: failed to roll back log entry %v: %v", r.ID, aerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Close closes the underlying log file.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+// tracking returns the callbacks that keep the log entry up to date as the request moves through the in-memory queue.
+// Entry is marked acknowledged once the request is delivered to all devices, expires, or is purged from dead-letters.
+func (q *Queue) tracking(id uint64) inmem.Tracking {
+	return inmem.Tracking{
+		Done: func() {
+			if err := q.ack(id); err != nil {
+				log.Printf("diskqueue: failed to acknowledge log entry %v: %v", id, err)
+			}
+		},
+		Dead: func(dl data.DeadLetter) {
+			if err := q.markDead(id, dl); err != nil {
+				log.Printf("diskqueue: failed to mark log entry %v as dead-letter: %v", id, err)
+			}
+		},
+		Replayed: func() {
+			if err := q.markLive(id); err != nil {
+				log.Printf("diskqueue: failed to mark log entry %v as replayed: %v", id, err)
+			}
+		},
+	}
+}
+
+// markDead records that the request is moved to dead-letters, so it is restored to dead-letters rather than retried after a restart.
+func (q *Queue) markDead(id uint64, dl data.DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.pending[id]
+	if !ok {
+		return nil
+	}
+
+	r.dead = &record{Op: "dead", ID: id, Attempts: dl.Attempts, Reason: dl.Reason, Time: &dl.Time}
+	return q.write(r.dead, true)
+}
+
+// markLive records that the request is replayed from dead-letters back to the queue.
+func (q *Queue) markLive(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.pending[id]
+	if !ok || r.dead == nil {
+		return nil
+	}
+
+	r.dead = nil
+	return q.write(&record{Op: "live", ID: id}, true)
+}
+
+func (q *Queue) ack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.pending[id]; !ok {
+		return nil
+	}
+
+	delete(q.pending, id)
+	if err := q.write(&record{Op: "ack", ID: id}, false); err != nil {
+		return err
+	}
+
+	q.acked++
+	if q.acked >= compactThreshold && q.acked > len(q.pending) {
+		return q.compact()
+	}
+	return nil
+}
+
+// load reads the log file (if any) and rebuilds the list of pending requests.
+func (q *Queue) load() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("diskqueue: failed to open log file: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		var r record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			// a partially written entry can only be the last one, left over from a crash
+			break
+		}
+
+		if r.ID > q.seq {
+			q.seq = r.ID
+		}
+
+		switch r.Op {
+		case "add":
+			q.pending[r.ID] = &r
+		case "ack":
+			delete(q.pending, r.ID)
+		case "dead":
+			if p, ok := q.pending[r.ID]; ok && r.Time != nil {
+				p.dead = &r
+			}
+		case "live":
+			if p, ok := q.pending[r.ID]; ok {
+				p.dead = nil
+			}
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("diskqueue: failed to read log file: %v", err)
+	}
+
+	// requests that expired while we were down are dropped with the next compaction
+	now := time.Now()
+	for id, r := range q.pending {
+		if e := r.expires(); !e.IsZero() && now.After(e) {
+			delete(q.pending, id)
+		}
+	}
+	return nil
+}
+
+func (r *record) expires() time.Time {
+	if r.Expires == nil {
+		return time.Time{}
+	}
+	return *r.Expires
+}
+
+// compact rewrites the log file with only the pending requests in it.
+// Caller should hold the lock, if the queue is already in use.
+func (q *Queue) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("diskqueue: failed to create compacted log file: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range q.sortedPending() {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return fmt.Errorf("diskqueue: failed to write compacted log file: %v", err)
+		}
+		if r.dead == nil {
+			continue
+		}
+		if err := enc.Encode(r.dead); err != nil {
+			f.Close()
+			return fmt.Errorf("diskqueue: failed to write compacted log file: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("diskqueue: failed to write compacted log file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("diskqueue: failed to sync compacted log file: %v", err)
+	}
+	f.Close()
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		// keep appending to the original log file, which is left intact
+		if q.file != nil {
+			var oerr error
+			if q.file, oerr = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0600); oerr != nil {
+				return fmt.Errorf("diskqueue: failed to replace log file: %v, and failed to reopen it: %v", err, oerr)
+			}
+		}
+		return fmt.Errorf("diskqueue: failed to replace log file: %v", err)
+	}
+
+	if q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return fmt.Errorf("diskqueue: failed to open log file: %v", err)
+	}
+
+	q.acked = 0
+	return nil
+}
+
+// write appends a record to the log file. Caller should hold the lock.
+// New requests are synced to disk right away while acknowledgements are not, as losing one only results in a duplicate delivery.
+func (q *Queue) write(r *record, sync bool) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("diskqueue: failed to serialize log entry: %v", err)
+	}
+
+	if _, err := q.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("diskqueue: failed to write log entry: %v", err)
+	}
+
+	if sync {
+		if err := q.file.Sync(); err != nil {
+			return fmt.Errorf("diskqueue: failed to sync log file: %v", err)
+		}
+	}
+	return nil
+}
+
+func (q *Queue) sortedPending() []*record {
+	rs := make([]*record, 0, len(q.pending))
+	for _, r := range q.pending {
+		rs = append(rs, r)
+	}
+	sort.Sort(byID(rs))
+	return rs
+}
+
+type byID []*record
+
+func (r byID) Len() int           { return len(r) }
+func (r byID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byID) Less(i, j int) bool { return r[i].ID < r[j].ID }
@@ -0,0 +1,350 @@
+package diskqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/titan-x/titan/data"
+)
+
+type sentReq struct {
+	method     string
+	params     interface{}
+	resHandler func(ctx *neptulon.ResCtx) error
+}
+
+func newSender() (func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (string, error), chan sentReq) {
+	sent := make(chan sentReq, 100)
+	return func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (string, error) {
+		sent <- sentReq{method: method, params: params, resHandler: resHandler}
+		return "", nil
+	}, sent
+}
+
+func connect(t *testing.T, q *Queue, userID string) {
+	connectDevice(t, q, userID, "")
+}
+
+func connectDevice(t *testing.T, q *Queue, userID, deviceID string) *neptulon.Conn {
+	c, err := neptulon.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Session.Set("userid", userID)
+	if deviceID != "" {
+		c.Session.Set("deviceid", deviceID)
+	}
+	if err := q.Middleware(&neptulon.ReqCtx{Conn: c}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func receive(t *testing.T, sent chan sentReq) sentReq {
+	select {
+	case r := <-sent:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("did not receive queued request in time")
+	}
+	return sentReq{}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// queue requests for an offline user and "crash"
+	sender, _ := newSender()
+	q, err := NewQueue(sender, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"msg-1", "msg-2"} {
+		if err := q.AddRequest("2", "msg.recv", map[string]string{"message": m}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	// pending requests should be delivered after restart
+	sender, sent := newSender()
+	if q, err = NewQueue(sender, dir); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, q, "2")
+
+	r := receive(t, sent)
+	var p map[string]string
+	if err := json.Unmarshal(r.params.(json.RawMessage), &p); err != nil {
+		t.Fatal(err)
+	}
+	if r.method != "msg.recv" || p["message"] != "msg-1" {
+		t.Fatalf("expected first queued request, got: %v, %v", r.method, p)
+	}
+	receive(t, sent)
+	if err := q.ack(1); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// only the unacknowledged request should remain in the log
+	sender, _ = newSender()
+	if q, err = NewQueue(sender, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if len(q.pending) != 1 {
+		t.Fatalf("expected 1 pending request, got: %v", len(q.pending))
+	}
+}
+
+func TestExpiredReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sender, _ := newSender()
+	q, err := NewQueue(sender, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.AddExpiringRequest("2", "msg.recv", "expiring", time.Now().Add(time.Millisecond*50), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.AddExpiringRequest("2", "msg.recv", "lasting", time.Now().Add(time.Hour), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	// expired request should be dropped upon restart
+	sender, sent := newSender()
+	if q, err = NewQueue(sender, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if len(q.pending) != 1 {
+		t.Fatalf("expected 1 pending request, got: %v", len(q.pending))
+	}
+
+	connect(t, q, "2")
+	var p string
+	if err := json.Unmarshal(receive(t, sent).params.(json.RawMessage), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p != "lasting" {
+		t.Fatalf("expected only the unexpired request to be delivered, got: %v", p)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// requests that cannot be sent are moved to dead-letters
+	q, err := NewQueue(func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (string, error) {
+		return "", errors.New("connection closed")
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.SetRetryPolicy(1, time.Millisecond)
+	for _, m := range []string{"purged", "replayed", "kept"} {
+		if err := q.AddRequest("2", "msg.recv", m, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connect(t, q, "2")
+	waitDeadLetters(t, q, 3)
+	q.Close()
+
+	// dead-letters should be restored after restart, rather than retried
+	sender, sent := newSender()
+	if q, err = NewQueue(sender, dir); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, q, "2")
+	select {
+	case r := <-sent:
+		t.Fatalf("dead-letter was delivered without replay: %v", r.params)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	for _, dl := range waitDeadLetters(t, q, 3) {
+		switch deadLetterParam(t, dl) {
+		case "purged":
+			q.PurgeDeadLetters(dl.ID)
+		case "replayed":
+			q.ReplayDeadLetters(dl.ID)
+		}
+	}
+	var p string
+	if err := json.Unmarshal(receive(t, sent).params.(json.RawMessage), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p != "replayed" {
+		t.Fatalf("expected the replayed request to be delivered, got: %v", p)
+	}
+	q.Close()
+
+	// purged request should be gone for good, and the replayed one should be pending again as it was never ACKed
+	sender, _ = newSender()
+	if q, err = NewQueue(sender, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if dls := q.DeadLetters(); len(dls) != 1 || deadLetterParam(t, dls[0]) != "kept" {
+		t.Fatalf("expected only the untouched dead-letter to remain, got: %+v", dls)
+	}
+	if len(q.pending) != 2 {
+		t.Fatalf("expected 2 pending requests, got: %v", len(q.pending))
+	}
+}
+
+func TestReplayedDeadLetterExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (string, error) {
+		return "", errors.New("connection closed")
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.SetRetryPolicy(1, time.Millisecond)
+
+	fails := make(chan string, 10)
+	failHandler := func(reason string) error {
+		fails <- reason
+		return nil
+	}
+	if err := q.AddExpiringRequest("2", "msg.recv", "expiring", time.Now().Add(time.Millisecond*500), nil, failHandler); err != nil {
+		t.Fatal(err)
+	}
+	c := connectDevice(t, q, "2", "")
+	waitFailure(t, fails)
+	q.RemoveConn("2", c.ID)
+
+	// replayed request should notify the sender again when it expires while the recipient is offline
+	q.ReplayDeadLetters()
+	if r := waitFailure(t, fails); r != "request expired before delivery" {
+		t.Fatalf("expected replayed request to expire, got: %v", r)
+	}
+}
+
+func waitFailure(t *testing.T, fails chan string) string {
+	select {
+	case r := <-fails:
+		return r
+	case <-time.After(time.Second * 3):
+		t.Fatal("fail handler was not called in time")
+	}
+	return ""
+}
+
+func TestStaleDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (string, error) {
+		return "", errors.New("connection closed")
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.SetRetryPolicy(1, time.Millisecond)
+	q.SetDeviceTTL(time.Millisecond * 100)
+
+	// second device connects once and never comes back
+	c := connectDevice(t, q, "2", "phone")
+	q.RemoveConn("2", c.ID)
+	time.Sleep(time.Millisecond * 50)
+
+	if err := q.AddRequest("2", "msg.recv", "stale", nil); err != nil {
+		t.Fatal(err)
+	}
+	connectDevice(t, q, "2", "laptop")
+
+	// request should not be held back for the stale device forever
+	for i := 0; i < 300 && len(q.DeadLetters()) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if dls := q.DeadLetters(); len(dls) != 1 || dls[0].Params != "stale" {
+		t.Fatalf("expected the request to be moved to dead-letters once the stale device is forgotten, got: %+v", dls)
+	}
+}
+
+func waitDeadLetters(t *testing.T, q *Queue, n int) []data.DeadLetter {
+	for i := 0; i < 100; i++ {
+		if dls := q.DeadLetters(); len(dls) == n {
+			return dls
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("expected %v dead-letters, got: %v", n, len(q.DeadLetters()))
+	return nil
+}
+
+func deadLetterParam(t *testing.T, dl data.DeadLetter) string {
+	var p string
+	if err := json.Unmarshal(dl.Params.(json.RawMessage), &p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sender, sent := newSender()
+	q, err := NewQueue(sender, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	connect(t, q, "1")
+
+	for i := 1; i <= compactThreshold; i++ {
+		if err := q.AddRequest("1", "msg.recv", i, nil); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, sent)
+		if err := q.ack(uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fi, err := os.Stat(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 || q.acked != 0 {
+		t.Fatalf("expected log file to be compacted, size: %v, acked entries: %v", fi.Size(), q.acked)
+	}
+}
@@ -1,7 +1,11 @@
 package inmem
 
 import (
+	"encoding/base64"
+	"fmt"
+	"sort"
 	"strconv"
+	"sync"
 
 	"github.com/titan-x/titan/data"
 	"github.com/titan-x/titan/models"
@@ -10,20 +14,52 @@ import (
 // DB is an in-memory database.
 type DB struct {
 	UserDB
+	ReadMarkerDB
+	MessageDB
+	GroupDB
+	RosterDB
 }
 
 // UserDB is in-memory user database.
 type UserDB struct {
-	ids    map[string]*models.User
-	emails map[string]*models.User
+	mu        *sync.Mutex
+	ids       map[string]*models.User
+	emails    map[string]*models.User
+	gcmRegIDs map[string]*models.User
+	hashes    map[string]*models.User             // lookup key of e-mail or phone number -> user
+	devices   map[string]map[string]models.Device // user ID -> device ID -> device
+	tokens    map[string]models.Device            // push token -> device
 }
 
 // NewDB creates a new in-memory database.
 func NewDB() *DB {
 	return &DB{
 		UserDB: UserDB{
-			ids:    make(map[string]*models.User),
-			emails: make(map[string]*models.User),
+			mu:        &sync.Mutex{},
+			ids:       make(map[string]*models.User),
+			emails:    make(map[string]*models.User),
+			gcmRegIDs: make(map[string]*models.User),
+			hashes:    make(map[string]*models.User),
+			devices:   make(map[string]map[string]models.Device),
+			tokens:    make(map[string]models.Device),
+		},
+		ReadMarkerDB: ReadMarkerDB{
+			mu:      &sync.Mutex{},
+			markers: make(map[string]map[string]models.ReadMarker),
+		},
+		MessageDB: MessageDB{
+			mu:      &sync.Mutex{},
+			convs:   make(map[string][]models.Message),
+			dropped: make(map[string]bool),
+		},
+		GroupDB: GroupDB{
+			mu:     &sync.Mutex{},
+			groups: make(map[string]models.Group),
+		},
+		RosterDB: RosterDB{
+			mu:       &sync.Mutex{},
+			contacts: make(map[string]map[string]models.Contact),
+			blocked:  make(map[string]map[string]bool),
 		},
 	}
 }
@@ -45,23 +81,446 @@ func (db UserDB) Seed(overwrite bool, jwtPass string) error {
 
 // GetByID retrieves a user by ID.
 func (db UserDB) GetByID(id string) (u *models.User, ok bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	u, ok = db.ids[id]
 	return
 }
 
 // GetByEmail retrieves a user by e-mail address.
 func (db UserDB) GetByEmail(email string) (u *models.User, ok bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	u, ok = db.emails[email]
 	return
 }
 
+// GetByContactHash retrieves a user by the lookup key of their e-mail address or phone number.
+func (db UserDB) GetByContactHash(hash string) (u *models.User, ok bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if u, ok = db.hashes[hash]; !ok {
+		return nil, false
+	}
+
+	// index can point to an old version of the user, whose lookup keys were changed since
+	u, ok = db.ids[u.ID]
+	if !ok || (u.EmailHash != hash && u.PhoneHash != hash) {
+		return nil, false
+	}
+	return
+}
+
+// GetByGCMRegID retrieves a user by GCM registration ID.
+func (db UserDB) GetByGCMRegID(regID string) (u *models.User, ok bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok = db.gcmRegIDs[regID]
+	if ok && u.GCMRegID == regID {
+		return
+	}
+
+	// registration ID was changed since, or it belongs to a registered device
+	if d, ok := db.tokens[regID]; ok && d.Platform == models.PlatformAndroid {
+		u, ok = db.ids[d.UserID]
+		return u, ok
+	}
+	return nil, false
+}
+
 // SaveUser save or updates a user object in the database.
 func (db UserDB) SaveUser(u *models.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if u.ID == "" {
 		u.ID = strconv.Itoa(len(db.ids) + 1)
 	}
+	db.save(u)
+	return nil
+}
 
+// ClearPushToken clears the GCM registration ID or the APNS device token of a user, if it is still the given token.
+func (db UserDB) ClearPushToken(userID, platform, token string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.ids[userID]
+	if !ok {
+		return nil
+	}
+	// retrieved user objects are shared so modify a copy
+	uc := *u
+	switch {
+	case platform == models.PlatformAndroid && u.GCMRegID == token:
+		uc.GCMRegID = ""
+		delete(db.gcmRegIDs, token)
+	case platform == models.PlatformIOS && u.APNSDeviceToken == token:
+		uc.APNSDeviceToken = ""
+	default:
+		return nil
+	}
+	db.save(&uc)
+	return nil
+}
+
+// AddWebPushSub adds a Web Push subscription to a user, dropping the oldest subscriptions beyond the given maximum.
+func (db UserDB) AddWebPushSub(userID string, sub models.WebPushSubscription, max int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.ids[userID]
+	if !ok {
+		return fmt.Errorf("inmem: user not found: %v", userID)
+	}
+	uc := *u
+	uc.WebPush = models.AddWebPushSub(u.WebPush, sub, max)
+	db.save(&uc)
+	return nil
+}
+
+// RemoveWebPushSub removes the Web Push subscription with the given endpoint from a user.
+func (db UserDB) RemoveWebPushSub(userID, endpoint string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.ids[userID]
+	if !ok {
+		return fmt.Errorf("inmem: user not found: %v", userID)
+	}
+	uc := *u
+	uc.WebPush = models.RemoveWebPushSub(u.WebPush, endpoint)
+	if len(uc.WebPush) != len(u.WebPush) {
+		db.save(&uc)
+	}
+	return nil
+}
+
+// save indexes a user object. Caller should hold the lock.
+func (db UserDB) save(u *models.User) {
 	db.ids[u.ID] = u
 	db.emails[u.Email] = u
+	if u.GCMRegID != "" {
+		db.gcmRegIDs[u.GCMRegID] = u
+	}
+	if u.EmailHash != "" {
+		db.hashes[u.EmailHash] = u
+	}
+	if u.PhoneHash != "" {
+		db.hashes[u.PhoneHash] = u
+	}
+}
+
+// GetDevices retrieves all the registered devices of a user.
+func (db UserDB) GetDevices(userID string) ([]models.Device, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ds := []models.Device{}
+	for _, d := range db.devices[userID] {
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// GetDeviceByToken retrieves the device with the given push token.
+func (db UserDB) GetDeviceByToken(token string) (d *models.Device, ok bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dv, ok := db.tokens[token]
+	if !ok {
+		return nil, false
+	}
+	return &dv, true
+}
+
+// SaveDevice creates or updates a device of a user.
+func (db UserDB) SaveDevice(d *models.Device) error {
+	if d.UserID == "" || d.ID == "" {
+		return fmt.Errorf("inmem: device is missing user ID or device ID: %+v", d)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ds, ok := db.devices[d.UserID]
+	if !ok {
+		ds = make(map[string]models.Device)
+		db.devices[d.UserID] = ds
+	}
+	if old, ok := ds[d.ID]; ok && old.PushToken != d.PushToken {
+		delete(db.tokens, old.PushToken)
+	}
+	ds[d.ID] = *d
+	if d.PushToken != "" {
+		db.tokens[d.PushToken] = *d
+	}
+	return nil
+}
+
+// DeleteDevice deletes a device of a user, if the user has it.
+func (db UserDB) DeleteDevice(userID, deviceID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if d, ok := db.devices[userID][deviceID]; ok {
+		delete(db.devices[userID], deviceID)
+		if t, ok := db.tokens[d.PushToken]; ok && t.UserID == userID && t.ID == deviceID {
+			delete(db.tokens, d.PushToken)
+		}
+	}
+	return nil
+}
+
+// ReadMarkerDB is in-memory read marker database.
+type ReadMarkerDB struct {
+	mu      *sync.Mutex
+	markers map[string]map[string]models.ReadMarker // user ID -> peer ID -> read marker
+}
+
+// GetReadMarkers retrieves all the read markers of a user.
+func (db ReadMarkerDB) GetReadMarkers(userID string) ([]models.ReadMarker, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ms := []models.ReadMarker{}
+	for _, m := range db.markers[userID] {
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// SaveReadMarker saves or updates a read marker.
+func (db ReadMarkerDB) SaveReadMarker(m *models.ReadMarker) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ms, ok := db.markers[m.From]
+	if !ok {
+		ms = make(map[string]models.ReadMarker)
+		db.markers[m.From] = ms
+	}
+	ms[m.Peer] = *m
+	return nil
+}
+
+// MessageDB is in-memory message history database.
+type MessageDB struct {
+	mu      *sync.Mutex
+	convs   map[string][]models.Message // conversation ID -> messages in the order they were saved
+	dropped map[string]bool             // IDs of the messages that are hidden from their recipients
+}
+
+// SaveMessage appends a message to the history of the conversation between its sender and recipient, or of its group.
+func (db MessageDB) SaveMessage(m *models.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := convID(m.From, m.To)
+	if m.Group != "" {
+		c = groupConvID(m.Group)
+	}
+	db.convs[c] = append(db.convs[c], *m)
+	return nil
+}
+
+// SaveDroppedMessage appends a message to the history of the conversation between its sender and recipient, hidden from the recipient.
+func (db MessageDB) SaveDroppedMessage(m *models.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := convID(m.From, m.To)
+	db.convs[c] = append(db.convs[c], *m)
+	db.dropped[m.ID] = true
+	return nil
+}
+
+// GetMessages retrieves a page of messages in a conversation, newest first.
+func (db MessageDB) GetMessages(userID, peer, cursor string, limit int) (ms []models.Message, nextCursor string, err error) {
+	return db.getMessages(convID(userID, peer), userID, cursor, limit)
+}
+
+// GetGroupMessages retrieves a page of messages in a group conversation, newest first.
+func (db MessageDB) GetGroupMessages(groupID, cursor string, limit int) (ms []models.Message, nextCursor string, err error) {
+	return db.getMessages(groupConvID(groupID), "", cursor, limit)
+}
+
+// getMessages retrieves a page of messages in a conversation, leaving out the dropped messages sent to the given user.
+// Cursor is the encoded index of the oldest message in the previous page.
+func (db MessageDB) getMessages(conv, userID, cursor string, limit int) (ms []models.Message, nextCursor string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := db.convs[conv]
+	end := len(c)
+	if cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("inmem: invalid cursor: %v", err)
+		}
+		if end, err = strconv.Atoi(string(b)); err != nil || end < 0 || end > len(c) {
+			return nil, "", fmt.Errorf("inmem: invalid cursor: %v", cursor)
+		}
+	}
+
+	ms = []models.Message{}
+	i := end - 1
+	for ; i >= 0 && len(ms) < limit; i-- {
+		if db.dropped[c[i].ID] && c[i].To == userID {
+			continue
+		}
+		ms = append(ms, c[i])
+	}
+	if i >= 0 {
+		nextCursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(i + 1)))
+	}
+	return ms, nextCursor, nil
+}
+
+// convID returns a conversation ID that is the same for both parties of a conversation.
+func convID(user1, user2 string) string {
+	if user1 > user2 {
+		user1, user2 = user2, user1
+	}
+	return user1 + "|" + user2
+}
+
+// groupConvID returns the conversation ID of a group.
+func groupConvID(groupID string) string {
+	return "#" + groupID
+}
+
+// GroupDB is in-memory group database.
+type GroupDB struct {
+	mu     *sync.Mutex
+	groups map[string]models.Group
+}
+
+// GetGroup retrieves a group by ID.
+func (db GroupDB) GetGroup(id string) (g *models.Group, ok bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	gr, ok := db.groups[id]
+	if !ok {
+		return nil, false
+	}
+	gr.Members = append([]models.GroupMember(nil), gr.Members...)
+	return &gr, true
+}
+
+// SaveGroup saves or updates a group. Upon creation, groups are assigned a unique ID.
+func (db GroupDB) SaveGroup(g *models.Group) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if g.ID == "" {
+		g.ID = strconv.Itoa(len(db.groups) + 1)
+	}
+
+	gr := *g
+	gr.Members = append([]models.GroupMember(nil), g.Members...)
+	db.groups[g.ID] = gr
+	return nil
+}
+
+// RosterDB is in-memory contact list database.
+type RosterDB struct {
+	mu       *sync.Mutex
+	contacts map[string]map[string]models.Contact // user ID -> contact ID -> contact
+	blocked  map[string]map[string]bool           // user ID -> blocked user ID -> true
+}
+
+// GetContacts retrieves the contacts of a user, sorted by contact ID.
+func (db RosterDB) GetContacts(userID string) ([]models.Contact, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ids := make([]string, 0, len(db.contacts[userID]))
+	for id := range db.contacts[userID] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	cs := []models.Contact{}
+	for _, id := range ids {
+		cs = append(cs, db.contacts[userID][id])
+	}
+	return cs, nil
+}
+
+// SaveContact creates or updates a contact of a user.
+func (db RosterDB) SaveContact(c *models.Contact) error {
+	if c.UserID == "" || c.ID == "" {
+		return fmt.Errorf("inmem: contact is missing user ID or contact ID: %+v", c)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cs, ok := db.contacts[c.UserID]
+	if !ok {
+		cs = make(map[string]models.Contact)
+		db.contacts[c.UserID] = cs
+	}
+	cs[c.ID] = *c
+	return nil
+}
+
+// DeleteContact deletes a contact of a user.
+func (db RosterDB) DeleteContact(userID, contactID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.contacts[userID], contactID)
+	return nil
+}
+
+// IsContact tells whether the user has the given peer in their contact list.
+func (db RosterDB) IsContact(userID, peerID string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, ok := db.contacts[userID][peerID]
+	return ok, nil
+}
+
+// GetBlocked retrieves the IDs of the users that the user has blocked, sorted.
+func (db RosterDB) GetBlocked(userID string) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ids := []string{}
+	for id := range db.blocked[userID] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// IsBlocked tells whether the user has blocked the given peer.
+func (db RosterDB) IsBlocked(userID, peerID string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.blocked[userID][peerID], nil
+}
+
+// Block blocks the given peer for the user.
+func (db RosterDB) Block(userID, peerID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	bs, ok := db.blocked[userID]
+	if !ok {
+		bs = make(map[string]bool)
+		db.blocked[userID] = bs
+	}
+	bs[peerID] = true
+	return nil
+}
+
+// Unblock unblocks the given peer for the user.
+func (db RosterDB) Unblock(userID, peerID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.blocked[userID], peerID)
 	return nil
 }
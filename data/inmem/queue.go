@@ -1,19 +1,74 @@
 package inmem
 
 import (
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/neptulon/neptulon"
+	"github.com/titan-x/titan/client"
 	"github.com/titan-x/titan/data"
 )
 
+const (
+	// DefaultAckTimeout is the default duration to wait for a client ACK before redelivering a request.
+	DefaultAckTimeout = time.Second * 30
+
+	// DefaultMaxAttempts is the default number of failed delivery attempts before a request is moved to dead-letters.
+	DefaultMaxAttempts = 10
+
+	// DefaultRetryBackoff is the default wait duration before retrying a failed delivery attempt.
+	// It doubles with each successive failed attempt.
+	DefaultRetryBackoff = time.Second
+
+	// maximum wait duration between two delivery attempts
+	maxRetryBackoff = time.Minute * 10
+
+	// DefaultDeviceTTL is the default duration after which a device that has not connected is forgotten,
+	// so the requests in the queue are no longer held back for it.
+	DefaultDeviceTTL = time.Hour * 24 * 30
+
+	// interval to look for expired requests in the queues of offline users
+	expirySweepInterval = time.Second
+
+	// maximum interval to look for stale devices
+	deviceSweepInterval = time.Minute
+)
+
 // Queue is a message queue for queueing and sending messages to users.
+// A user can be connected from many devices at once, each identified by the "deviceid" session key,
+// and every request is delivered to each known device of the user separately.
+// A request stays in the queue until all known devices of the user ACK it, and it is redelivered to a device
+// if ACK does not arrive in time or if the device's connection is dropped in the meantime.
+// Devices are forgotten once they are removed (i.e. upon logout) or if they do not connect for a while,
+// so the devices that never come back do not hold back the requests.
+// Failed delivery attempts are retried with exponential backoff and the requests that
+// exceed the retry budget on all devices are moved to dead-letters. Requests with an expiry time are dropped
+// once they expire, if they are not delivered by then.
 type Queue struct {
-	senderFunc SenderFunc           // sender function to send and receive messages through
-	conns      map[string]string    // user ID -> conn ID
-	reqChans   map[string]queueChan // user ID -> queueProcessor
+	senderFunc SenderFunc                      // sender function to send and receive messages through
+	conns      map[string]map[string]userConn  // user ID -> device ID -> device connection
+	devices    map[string]map[string]time.Time // user ID -> device ID -> last time the device was connected, for all known devices
+	reqQueues  map[string]*userQueue           // user ID -> request queue
+
+	// delivery policy (atomic)
+	ackTimeout   int64 // time.Duration to wait for ACK before redelivery
+	maxAttempts  int64 // failed delivery attempts before giving up
+	retryBackoff int64 // base time.Duration to wait before retrying a failed attempt
+	deviceTTL    int64 // time.Duration after which a device that has not connected is forgotten
+
+	// dead-letters
+	dlMutex     sync.Mutex
+	dlSeq       int
+	deadLetters map[string]*deadLetter // dead-letter ID -> dead-letter
 
 	// worker communication channels
 	middlewareChan chan middlewareChan
-	remUserChan    chan string
+	remConnChan    chan remConnChan
+	remDevChan     chan remDevChan
 	addReqChan     chan addReqChan
 	delQueueChan   chan string
 }
@@ -21,12 +76,19 @@ type Queue struct {
 // NewQueue creates a new queue object.
 func NewQueue(senderFunc SenderFunc) *Queue {
 	q := Queue{
-		senderFunc: senderFunc,
-		conns:      make(map[string]string),
-		reqChans:   make(map[string]queueChan),
+		senderFunc:   senderFunc,
+		conns:        make(map[string]map[string]userConn),
+		devices:      make(map[string]map[string]time.Time),
+		reqQueues:    make(map[string]*userQueue),
+		ackTimeout:   int64(DefaultAckTimeout),
+		maxAttempts:  DefaultMaxAttempts,
+		retryBackoff: int64(DefaultRetryBackoff),
+		deviceTTL:    int64(DefaultDeviceTTL),
+		deadLetters:  make(map[string]*deadLetter),
 
 		middlewareChan: make(chan middlewareChan, 5000),
-		remUserChan:    make(chan string, 5000),
+		remConnChan:    make(chan remConnChan, 5000),
+		remDevChan:     make(chan remDevChan, 5000),
 		addReqChan:     make(chan addReqChan, 5000),
 		delQueueChan:   make(chan string, 5000),
 	}
@@ -40,68 +102,671 @@ func NewQueue(senderFunc SenderFunc) *Queue {
 type SenderFunc func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (reqID string, err error)
 
 type queuedReq struct {
-	Method     string
-	Params     interface{}
-	ResHandler func(ctx *neptulon.ResCtx) error
+	Method      string
+	Params      interface{}
+	ResHandler  func(ctx *neptulon.ResCtx) error
+	FailHandler func(reason string) error // called if the queue gives up on the request, separately from client responses
+
+	expires  time.Time // time after which the request is dropped if not delivered yet (zero for never)
+	tracking Tracking
+
+	// delivery state
+	devs  map[string]*delivery // device ID -> delivery state of the request for the device
+	acked bool                 // whether any device has ACKed the request
 }
 
-type queueChan struct {
-	req  chan queuedReq
-	quit chan bool
+// delivery is the delivery state of a request for a single device.
+type delivery struct {
+	connID   string    // connection that the request is in-flight on, if any
+	deadline time.Time // ACK deadline while in-flight
+	attempts int       // failed delivery attempts
+	retryAt  time.Time // earliest time for the next delivery attempt
+	done     bool      // whether the device has ACKed the request or it was given up on
 }
 
-func (q *Queue) getQueueChan(userID string) queueChan {
-	c, ok := q.reqChans[userID]
+type userConn struct {
+	connID string
+	quit   chan bool
+}
+
+type deadLetter struct {
+	userID   string
+	req      *queuedReq
+	attempts int
+	reason   string
+	time     time.Time
+}
+
+// userQueue is the list of pending and in-flight requests of a user, in the order they were queued.
+type userQueue struct {
+	mutex      sync.Mutex
+	reqs       []*queuedReq
+	devices    map[string]bool      // IDs of all the devices that the user has connected from
+	nextExpiry time.Time            // earliest expiry time among the requests, if any
+	signals    map[string]chan bool // connection ID -> signal for the queue processor of the connection about newly queued or released requests
+}
+
+func (q *Queue) getUserQueue(userID string) *userQueue {
+	uq, ok := q.reqQueues[userID]
 	if !ok {
-		c = queueChan{req: make(chan queuedReq, 5000), quit: make(chan bool, 1)}
-		q.reqChans[userID] = c
+		uq = &userQueue{devices: make(map[string]bool), signals: make(map[string]chan bool)}
+		for id := range q.devices[userID] {
+			uq.devices[id] = true
+		}
+		q.reqQueues[userID] = uq
 	}
-	return c
+	return uq
 }
 
-// Middleware registers a queue middleware to register user/connection IDs
+// Middleware registers a queue middleware to register user/device/connection IDs
 // for connecting users (upon their first incoming-message).
 func (q *Queue) Middleware(ctx *neptulon.ReqCtx) error {
-	q.middlewareChan <- middlewareChan{userID: ctx.Conn.Session.Get("userid").(string), connID: ctx.Conn.ID}
+	deviceID, _ := ctx.Conn.Session.Get("deviceid").(string)
+	q.middlewareChan <- middlewareChan{userID: ctx.Conn.Session.Get("userid").(string), deviceID: deviceID, connID: ctx.Conn.ID}
 	return ctx.Next()
 }
 
 // RemoveConn removes a user's associated connection ID.
-func (q *Queue) RemoveConn(userID string) {
-	q.remUserChan <- userID
+// Any in-flight requests for the connection will be redelivered once the same device connects again.
+func (q *Queue) RemoveConn(userID, connID string) {
+	q.remConnChan <- remConnChan{userID: userID, connID: connID}
+}
+
+// RemoveDevice makes the queue forget a device of the user (i.e. upon logout), so the requests are no longer held back for the device.
+// If the device connects again, it only receives the requests that are queued afterwards, along with the ones that are still pending for other devices.
+func (q *Queue) RemoveDevice(userID, deviceID string) {
+	q.remDevChan <- remDevChan{userID: userID, deviceID: deviceID}
 }
 
 // AddRequest queues a request message to be sent to the given user.
+// If the request cannot be delivered within the retry budget, it is moved to dead-letters.
 func (q *Queue) AddRequest(userID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) error {
-	q.addReqChan <- addReqChan{userID: userID, queuedReq: queuedReq{Method: method, Params: params, ResHandler: resHandler}}
+	return q.AddExpiringRequest(userID, method, params, time.Time{}, resHandler, nil)
+}
+
+// AddExpiringRequest queues a request message to be sent to the given user, which is dropped if not delivered before the expiry time.
+// Zero expiry time means that the request never expires.
+// If the request expires before delivery, or cannot be delivered within the retry budget, failHandler is called with the reason.
+func (q *Queue) AddExpiringRequest(userID string, method string, params interface{}, expires time.Time, resHandler func(ctx *neptulon.ResCtx) error, failHandler func(reason string) error) error {
+	return q.AddTrackedRequest(userID, method, params, expires, resHandler, failHandler, Tracking{})
+}
+
+// Tracking holds the callbacks of a tracked request, which are called as the request moves through the queue. Any of them can be nil.
+type Tracking struct {
+	// Done is called once the request leaves the queue for good, either by getting delivered to all devices of the user,
+	// by expiring, or by getting purged from dead-letters.
+	// Note that the response handler of the request is called only for the first ACK, while Done is called after the last one.
+	Done func()
+
+	// Dead is called when the request is moved to dead-letters.
+	Dead func(dl data.DeadLetter)
+
+	// Replayed is called when the request is moved back from dead-letters to the queue.
+	Replayed func()
+}
+
+// AddTrackedRequest is the same as AddExpiringRequest, except that the given callbacks are notified as the request moves through the queue.
+func (q *Queue) AddTrackedRequest(userID string, method string, params interface{}, expires time.Time, resHandler func(ctx *neptulon.ResCtx) error, failHandler func(reason string) error, t Tracking) error {
+	q.addReqChan <- addReqChan{userID: userID, queuedReq: &queuedReq{Method: method, Params: params, ResHandler: resHandler, FailHandler: failHandler, expires: expires, tracking: t}}
 	return nil
 }
 
-func (q *Queue) processQueue(qc queueChan, userID, connID string) {
-	errc := 0 // protect against infinite retry loop
+// RestoreDeadLetter adds a tracked request directly to dead-letters, without attempting to deliver it.
+// This is meant for persistent queues restoring their dead-letters upon restart.
+func (q *Queue) RestoreDeadLetter(dl data.DeadLetter, expires time.Time, t Tracking) {
+	q.dlMutex.Lock()
+	defer q.dlMutex.Unlock()
+	q.dlSeq++
+	req := &queuedReq{Method: dl.Method, Params: dl.Params, expires: expires, tracking: t}
+	q.deadLetters[strconv.Itoa(q.dlSeq)] = &deadLetter{userID: dl.UserID, req: req, attempts: dl.Attempts, reason: dl.Reason, time: dl.Time}
+	data.QueueDeadLetters.Add(1)
+}
+
+// SetAckTimeout sets the duration to wait for a client ACK before redelivering a request.
+// Default is DefaultAckTimeout.
+func (q *Queue) SetAckTimeout(d time.Duration) {
+	atomic.StoreInt64(&q.ackTimeout, int64(d))
+}
+
+// SetDeviceTTL sets the duration after which a device that has not connected is forgotten, just as if it was removed.
+// Default is DefaultDeviceTTL.
+func (q *Queue) SetDeviceTTL(d time.Duration) {
+	atomic.StoreInt64(&q.deviceTTL, int64(d))
+}
+
+// SetRetryPolicy sets the number of failed delivery attempts before a request is moved to dead-letters,
+// and the base wait duration before retrying a failed attempt, which doubles with each successive failure.
+// Defaults are DefaultMaxAttempts and DefaultRetryBackoff.
+func (q *Queue) SetRetryPolicy(maxAttempts int, backoff time.Duration) {
+	atomic.StoreInt64(&q.maxAttempts, int64(maxAttempts))
+	atomic.StoreInt64(&q.retryBackoff, int64(backoff))
+}
+
+// DeadLetters lists the requests that could not be delivered within the retry budget.
+func (q *Queue) DeadLetters() []data.DeadLetter {
+	q.dlMutex.Lock()
+	defer q.dlMutex.Unlock()
+
+	dls := make([]data.DeadLetter, 0, len(q.deadLetters))
+	for id, dl := range q.deadLetters {
+		dls = append(dls, dl.export(id))
+	}
+	return dls
+}
+
+func (dl *deadLetter) export(id string) data.DeadLetter {
+	return data.DeadLetter{
+		ID:       id,
+		UserID:   dl.userID,
+		Method:   dl.req.Method,
+		Params:   dl.req.Params,
+		Attempts: dl.attempts,
+		Reason:   dl.reason,
+		Time:     dl.time,
+	}
+}
+
+// ReplayDeadLetters moves the dead-letters with the given IDs back to the queue, with a fresh retry budget.
+// If no ID is given, all dead-letters are replayed.
+func (q *Queue) ReplayDeadLetters(ids ...string) {
+	for _, dl := range q.takeDeadLetters(ids) {
+		// a fresh copy leaves the delivery state behind, along with any late responses still referencing it
+		r := dl.req
+		if r.tracking.Replayed != nil {
+			r.tracking.Replayed()
+		}
+		q.addReqChan <- addReqChan{userID: dl.userID, queuedReq: &queuedReq{Method: r.Method, Params: r.Params, ResHandler: r.ResHandler, FailHandler: r.FailHandler, expires: r.expires, tracking: r.tracking}}
+	}
+}
+
+// PurgeDeadLetters deletes the dead-letters with the given IDs.
+// If no ID is given, all dead-letters are deleted.
+func (q *Queue) PurgeDeadLetters(ids ...string) {
+	for _, dl := range q.takeDeadLetters(ids) {
+		if dl.req.tracking.Done != nil {
+			dl.req.tracking.Done()
+		}
+	}
+}
+
+func (q *Queue) takeDeadLetters(ids []string) []*deadLetter {
+	q.dlMutex.Lock()
+	defer q.dlMutex.Unlock()
+
+	if len(ids) == 0 {
+		for id := range q.deadLetters {
+			ids = append(ids, id)
+		}
+	}
+
+	var dls []*deadLetter
+	for _, id := range ids {
+		if dl, ok := q.deadLetters[id]; ok {
+			delete(q.deadLetters, id)
+			data.QueueDeadLetters.Add(-1)
+			dls = append(dls, dl)
+		}
+	}
+	return dls
+}
+
+// addDeadLetter stores a request that could not be delivered and notifies its fail handler.
+func (q *Queue) addDeadLetter(userID string, req *queuedReq, attempts int, reason string) error {
+	q.dlMutex.Lock()
+	q.dlSeq++
+	id := strconv.Itoa(q.dlSeq)
+	dl := &deadLetter{userID: userID, req: req, attempts: attempts, reason: reason, time: time.Now()}
+	q.deadLetters[id] = dl
+	data.QueueDeadLetters.Add(1)
+	q.dlMutex.Unlock()
+
+	if req.tracking.Dead != nil {
+		req.tracking.Dead(dl.export(id))
+	}
+	if req.FailHandler != nil {
+		return req.FailHandler(reason)
+	}
+	return nil
+}
+
+func (q *Queue) getDeviceTTL() time.Duration {
+	if d := time.Duration(atomic.LoadInt64(&q.deviceTTL)); d > 0 {
+		return d
+	}
+	return DefaultDeviceTTL
+}
+
+func (q *Queue) getAckTimeout() time.Duration {
+	if d := time.Duration(atomic.LoadInt64(&q.ackTimeout)); d > 0 {
+		return d
+	}
+	return DefaultAckTimeout
+}
+
+// backoff calculates the wait duration before the next delivery attempt, with exponential growth and jitter.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := time.Duration(atomic.LoadInt64(&q.retryBackoff))
+	if d <= 0 {
+		d = DefaultRetryBackoff
+	}
+	for i := 1; i < attempts && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (uq *userQueue) add(req *queuedReq) {
+	uq.mutex.Lock()
+	uq.reqs = append(uq.reqs, req)
+	if !req.expires.IsZero() && (uq.nextExpiry.IsZero() || req.expires.Before(uq.nextExpiry)) {
+		uq.nextExpiry = req.expires
+	}
+	uq.mutex.Unlock()
+	uq.notify()
+}
+
+// addDevice registers a device of the user so that the queued requests are not considered delivered before the device ACKs them.
+func (uq *userQueue) addDevice(deviceID string) {
+	uq.mutex.Lock()
+	uq.devices[deviceID] = true
+	uq.mutex.Unlock()
+}
+
+// removeDevice forgets a device of the user, and returns the requests that are no longer awaiting delivery as a result,
+// which are removed from the queue. Requests that are in-flight on the device are left to be ACKed.
+func (uq *userQueue) removeDevice(deviceID string) []*queuedReq {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+
+	if !uq.devices[deviceID] {
+		return nil
+	}
+	delete(uq.devices, deviceID)
+
+	var reqs []*queuedReq
+	for _, r := range append([]*queuedReq(nil), uq.reqs...) {
+		if d, ok := r.devs[deviceID]; ok && d.connID == "" {
+			delete(r.devs, deviceID)
+		}
+		if uq.complete(r) {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// subscribe registers the signal channel of the queue processor of a connection.
+func (uq *userQueue) subscribe(connID string) chan bool {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+	signal := make(chan bool, 1)
+	uq.signals[connID] = signal
+	return signal
+}
+
+func (uq *userQueue) unsubscribe(connID string) {
+	uq.mutex.Lock()
+	delete(uq.signals, connID)
+	uq.mutex.Unlock()
+}
+
+// notify signals the queue processors of all the connections of the user.
+func (uq *userQueue) notify() {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+	for _, signal := range uq.signals {
+		select {
+		case signal <- true:
+		default:
+		}
+	}
+}
+
+func (uq *userQueue) len() int {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+	return len(uq.reqs)
+}
+
+// remove removes a request from the queue, returning false if it was already removed. Caller should hold the lock.
+// Request should not be in-flight on any device.
+func (uq *userQueue) remove(req *queuedReq) bool {
+	for i, r := range uq.reqs {
+		if r == req {
+			uq.reqs = append(uq.reqs[:i], uq.reqs[i+1:]...)
+			data.QueueLength.Add(data.QueuePending, -1)
+			return true
+		}
+	}
+	return false
+}
+
+// complete removes the request from the queue if every known device of the user is done with it,
+// returning false if the request still awaits delivery or was already removed. Caller should hold the lock.
+func (uq *userQueue) complete(req *queuedReq) bool {
+	if len(uq.devices) == 0 {
+		return false
+	}
+	for id := range uq.devices {
+		if d, ok := req.devs[id]; !ok || !d.done {
+			return false
+		}
+	}
+	return uq.remove(req)
+}
+
+// ack marks a request as delivered to a device, returning whether it is the first device to ACK the request,
+// and whether the request is now delivered to all devices and removed from the queue.
+func (uq *userQueue) ack(deviceID string, req *queuedReq) (first, completed bool) {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+
+	d, ok := req.devs[deviceID]
+	if !ok || d.done {
+		// this is a late ACK for an already ACKed (redelivered) request
+		return false, false
+	}
+
+	if d.connID != "" {
+		d.connID = ""
+		data.QueueLength.Add(data.QueueInFlight, -1)
+	}
+	d.done = true
+	first = !req.acked
+	req.acked = true
+	return first, uq.complete(req)
+}
+
+// takePending marks all pending requests that are due for the given device as in-flight on the given connection and returns them.
+func (uq *userQueue) takePending(deviceID, connID string, deadline time.Time) []*queuedReq {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+
+	var reqs []*queuedReq
+	now := time.Now()
+	for _, r := range uq.reqs {
+		if r.isExpired(now) {
+			continue
+		}
+		if r.devs == nil {
+			r.devs = make(map[string]*delivery)
+		}
+		d, ok := r.devs[deviceID]
+		if !ok {
+			d = &delivery{}
+			r.devs[deviceID] = d
+		}
+		if !d.done && d.connID == "" && !d.retryAt.After(now) {
+			d.connID = connID
+			d.deadline = deadline
+			reqs = append(reqs, r)
+			data.QueueLength.Add(data.QueueInFlight, 1)
+		}
+	}
+	return reqs
+}
+
+// expire removes the expired requests that are not in-flight on any device and returns them.
+// In-flight requests are left alone as they were sent before their expiry.
+func (uq *userQueue) expire(now time.Time) []*queuedReq {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+
+	if uq.nextExpiry.IsZero() || now.Before(uq.nextExpiry) {
+		return nil
+	}
+
+	var reqs []*queuedReq
+	uq.nextExpiry = time.Time{}
+	for _, r := range append([]*queuedReq(nil), uq.reqs...) {
+		if !r.inFlight() && r.isExpired(now) {
+			uq.remove(r)
+			reqs = append(reqs, r)
+		} else if !r.expires.IsZero() && (uq.nextExpiry.IsZero() || r.expires.Before(uq.nextExpiry)) {
+			uq.nextExpiry = r.expires
+		}
+	}
+	return reqs
+}
+
+func (r *queuedReq) isExpired(now time.Time) bool {
+	return !r.expires.IsZero() && now.After(r.expires)
+}
+
+// inFlight returns true if the request is awaiting ACK from any device. Caller should hold the lock.
+func (r *queuedReq) inFlight() bool {
+	for _, d := range r.devs {
+		if d.connID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// attempts returns the total number of failed delivery attempts for all devices. Caller should hold the lock.
+func (r *queuedReq) attempts() int {
+	n := 0
+	for _, d := range r.devs {
+		n += d.attempts
+	}
+	return n
+}
+
+// unmark marks an in-flight delivery as pending again. Caller should hold the lock.
+func (uq *userQueue) unmark(d *delivery) {
+	d.connID = ""
+	data.QueueLength.Add(data.QueueInFlight, -1)
+}
+
+// release marks all in-flight requests on the given connection as pending again, without counting it as a failed attempt.
+func (uq *userQueue) release(connID string) {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+
+	for _, r := range uq.reqs {
+		for _, d := range r.devs {
+			if d.connID == connID {
+				uq.unmark(d)
+			}
+		}
+	}
+}
+
+// fail records a failed delivery attempt for a request in-flight on the given connection, scheduling it for a retry.
+// If the request has exceeded its retry budget for the device, it is given up on for that device.
+// If that leaves the request done for all devices, it is removed from the queue and returned as completed,
+// along with whether any device has ACKed it and the total number of failed attempts.
+func (q *Queue) fail(uq *userQueue, deviceID, connID string, req *queuedReq) (completed, acked bool, attempts int) {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+
+	d, ok := req.devs[deviceID]
+	if !ok || d.connID != connID {
+		// request was already ACKed, released, or failed
+		return false, false, 0
+	}
+
+	uq.unmark(d)
+	d.attempts++
+	if int64(d.attempts) >= atomic.LoadInt64(&q.maxAttempts) {
+		d.done = true
+		return uq.complete(req), req.acked, req.attempts()
+	}
+
+	d.retryAt = time.Now().Add(q.backoff(d.attempts))
+	data.QueueRetries.Add(1)
+	return false, false, 0
+}
+
+// expired returns the requests in-flight on the given connection of a device for which the ACK deadline has passed.
+func (uq *userQueue) expired(deviceID, connID string) []*queuedReq {
+	uq.mutex.Lock()
+	defer uq.mutex.Unlock()
+
+	var reqs []*queuedReq
+	now := time.Now()
+	for _, r := range uq.reqs {
+		if d, ok := r.devs[deviceID]; ok && d.connID == connID && now.After(d.deadline) {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// expireReqs drops the expired requests in a user queue and notifies the fail handlers of the ones that were never delivered.
+// Returns the number of expired requests.
+func (q *Queue) expireReqs(uq *userQueue) int {
+	reqs := uq.expire(time.Now())
+	for _, req := range reqs {
+		uq.mutex.Lock()
+		acked := req.acked
+		uq.mutex.Unlock()
+
+		if req.tracking.Done != nil {
+			req.tracking.Done()
+		}
+		if acked {
+			// delivered to some of the devices so the sender was already notified
+			continue
+		}
+		data.QueueExpired.Add(1)
+		if req.FailHandler == nil {
+			continue
+		}
+		if err := req.FailHandler("request expired before delivery"); err != nil {
+			log.Printf("queue: error handling expired request: %v", err)
+		}
+	}
+	return len(reqs)
+}
+
+// sweep drops the expired requests in the given user queues, and deletes the queues that are left empty.
+func (q *Queue) sweep(uqs map[string]*userQueue) {
+	for userID, uq := range uqs {
+		if q.expireReqs(uq) != 0 && uq.len() == 0 {
+			q.delQueueChan <- userID
+		}
+	}
+}
+
+func (q *Queue) processQueue(uq *userQueue, userID, deviceID, connID string, quit chan bool) {
+	timeout := q.getAckTimeout()
+	tick := timeout / 4
+	if b := time.Duration(atomic.LoadInt64(&q.retryBackoff)); b > 0 && b < tick {
+		tick = b
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	signal := uq.subscribe(connID)
+	signal <- true
 
 	for {
 		select {
-		case req := <-qc.req:
-			_, err := q.senderFunc(connID, req.Method, req.Params, req.ResHandler)
-
-			if err != nil {
-				errc++
-				qc.req <- req
-				if errc > 10 {
-					return
+		case <-signal:
+			q.expireReqs(uq)
+			reqs := uq.takePending(deviceID, connID, time.Now().Add(timeout))
+			for i, req := range reqs {
+				if _, err := q.senderFunc(connID, req.Method, req.Params, q.ackHandler(uq, userID, deviceID, connID, req)); err != nil {
+					q.failAttempt(uq, userID, deviceID, connID, req, "failed to send request: "+err.Error())
+
+					// connection is probably closing so hold off the rest of the requests
+					uq.mutex.Lock()
+					for _, r := range reqs[i+1:] {
+						if d := r.devs[deviceID]; d.connID == connID {
+							uq.unmark(d)
+						}
+					}
+					uq.mutex.Unlock()
+					break
 				}
-				continue
 			}
 
-			data.QueueLength.Add(-1)
-			errc = 0
-
-		case <-qc.quit:
-			if len(qc.req) == 0 {
-				q.delQueueChan <- userID
+		case <-ticker.C:
+			// retry the requests that were not ACKed in time, along with any requests that are due for a retry
+			for _, req := range uq.expired(deviceID, connID) {
+				q.failAttempt(uq, userID, deviceID, connID, req, "ACK timeout")
+			}
+			select {
+			case signal <- true:
+			default:
 			}
+
+		case <-quit:
+			uq.unsubscribe(connID)
+			uq.release(connID)
+			uq.notify()
+			q.delQueueChan <- userID
 			return
 		}
 	}
 }
+
+// failAttempt records a failed delivery attempt, moving the request to dead-letters if no device has ACKed it
+// and all devices are out of retries.
+func (q *Queue) failAttempt(uq *userQueue, userID, deviceID, connID string, req *queuedReq, reason string) {
+	completed, acked, attempts := q.fail(uq, deviceID, connID, req)
+	if completed {
+		q.finish(userID, req, acked, attempts, reason)
+	}
+}
+
+// finish handles a request that was removed from the queue as all devices are done with it.
+// If no device has ACKed the request, it is moved to dead-letters.
+func (q *Queue) finish(userID string, req *queuedReq, acked bool, attempts int, reason string) {
+	if acked {
+		if req.tracking.Done != nil {
+			req.tracking.Done()
+		}
+		return
+	}
+	if err := q.addDeadLetter(userID, req, attempts, reason); err != nil {
+		log.Printf("queue: error handling dead-letter: %v", err)
+	}
+}
+
+// finishAll handles the requests that were removed from the queue as the devices that they were held back for are forgotten.
+func (q *Queue) finishAll(userID string, uq *userQueue, reqs []*queuedReq) {
+	for _, req := range reqs {
+		uq.mutex.Lock()
+		acked, attempts := req.acked, req.attempts()
+		uq.mutex.Unlock()
+		q.finish(userID, req, acked, attempts, "delivery attempts failed on all remaining devices")
+	}
+}
+
+// ackHandler wraps a request's response handler so that the request is removed from the queue only when all the devices ACK it.
+// The response handler is called only for the first ACK. Any other response is counted as a failed delivery attempt.
+func (q *Queue) ackHandler(uq *userQueue, userID, deviceID, connID string, req *queuedReq) func(ctx *neptulon.ResCtx) error {
+	return func(ctx *neptulon.ResCtx) error {
+		var res string
+		if ctx.Success {
+			ctx.Result(&res)
+		}
+
+		if res == client.ACK {
+			first, completed := uq.ack(deviceID, req)
+			if completed && req.tracking.Done != nil {
+				req.tracking.Done()
+			}
+			if !first {
+				return nil
+			}
+		} else {
+			reason := "client did not ACK the request"
+			if !ctx.Success {
+				reason = "client returned error: " + ctx.ErrorMessage
+			}
+			q.failAttempt(uq, userID, deviceID, connID, req, reason)
+			uq.notify()
+		}
+
+		if req.ResHandler != nil {
+			return req.ResHandler(ctx)
+		}
+		return nil
+	}
+}
@@ -1,40 +1,141 @@
 package inmem
 
-import "github.com/titan-x/titan/data"
+import (
+	"time"
+
+	"github.com/titan-x/titan/data"
+)
 
 type middlewareChan struct {
+	userID, deviceID, connID string
+}
+
+type remConnChan struct {
 	userID, connID string
 }
 
+type remDevChan struct {
+	userID, deviceID string
+}
+
 type addReqChan struct {
 	userID    string
-	queuedReq queuedReq
+	queuedReq *queuedReq
 }
 
 func (q *Queue) worker() {
+	sweep := time.NewTicker(expirySweepInterval)
+	defer sweep.Stop()
+	lastDeviceSweep := time.Now()
+
 	for {
 		select {
 		case mid := <-q.middlewareChan:
-			// start queue gorutine only once per connection
-			if _, ok := q.conns[mid.userID]; !ok {
-				q.conns[mid.userID] = mid.connID
+			// start queue gorutine only once per connection, and only one per device
+			ucs, ok := q.conns[mid.userID]
+			if !ok {
+				ucs = make(map[string]userConn)
+				q.conns[mid.userID] = ucs
 				data.UserCount.Add(1)
-				go q.processQueue(q.getQueueChan(mid.userID), mid.userID, mid.connID)
+			}
+			if uc, ok := ucs[mid.deviceID]; ok {
+				if uc.connID == mid.connID {
+					continue
+				}
+				// device reconnected before the old connection was closed so replace it
+				uc.quit <- true
 			}
 
-		case userID := <-q.remUserChan:
-			if _, ok := q.conns[userID]; ok {
-				q.getQueueChan(userID).quit <- true
-				delete(q.conns, userID)
+			if _, ok := q.devices[mid.userID]; !ok {
+				q.devices[mid.userID] = make(map[string]time.Time)
+			}
+			q.devices[mid.userID][mid.deviceID] = time.Now()
+
+			uc := userConn{connID: mid.connID, quit: make(chan bool, 1)}
+			ucs[mid.deviceID] = uc
+			uq := q.getUserQueue(mid.userID)
+			uq.addDevice(mid.deviceID)
+			go q.processQueue(uq, mid.userID, mid.deviceID, uc.connID, uc.quit)
+
+		case rem := <-q.remConnChan:
+			ucs := q.conns[rem.userID]
+			for deviceID, uc := range ucs {
+				if uc.connID == rem.connID {
+					uc.quit <- true
+					delete(ucs, deviceID)
+					if ds, ok := q.devices[rem.userID]; ok {
+						if _, ok := ds[deviceID]; ok {
+							ds[deviceID] = time.Now()
+						}
+					}
+				}
+			}
+			if ucs != nil && len(ucs) == 0 {
+				delete(q.conns, rem.userID)
 				data.UserCount.Add(-1)
 			}
 
+		case rem := <-q.remDevChan:
+			q.removeDevice(rem.userID, rem.deviceID)
+
 		case req := <-q.addReqChan:
-			data.QueueLength.Add(1)
-			q.getQueueChan(req.userID).req <- req.queuedReq
+			data.QueueLength.Add(data.QueuePending, 1)
+			q.getUserQueue(req.userID).add(req.queuedReq)
+
+		case <-sweep.C:
+			// expired requests are handled in a separate goroutine as response handlers might queue new requests
+			uqs := make(map[string]*userQueue, len(q.reqQueues))
+			for userID, uq := range q.reqQueues {
+				uqs[userID] = uq
+			}
+			go q.sweep(uqs)
+
+			// forget the devices that have not connected for a while
+			ttl := q.getDeviceTTL()
+			interval := deviceSweepInterval
+			if ttl/4 < interval {
+				interval = ttl / 4
+			}
+			if time.Since(lastDeviceSweep) > interval {
+				lastDeviceSweep = time.Now()
+				for userID, ds := range q.devices {
+					for deviceID, seen := range ds {
+						if _, ok := q.conns[userID][deviceID]; !ok && time.Since(seen) > ttl {
+							q.removeDevice(userID, deviceID)
+						}
+					}
+				}
+			}
 
 		case userID := <-q.delQueueChan:
-			delete(q.reqChans, userID)
+			// user might have reconnected or received new requests in the meantime
+			if uq, ok := q.reqQueues[userID]; ok && uq.len() == 0 {
+				if _, ok := q.conns[userID]; !ok {
+					delete(q.reqQueues, userID)
+				}
+			}
+		}
+	}
+}
+
+// removeDevice forgets a device of the user.
+// Requests that were held back only for the device are handled in a separate goroutine, as their callbacks might queue new requests.
+func (q *Queue) removeDevice(userID, deviceID string) {
+	if ds, ok := q.devices[userID]; ok {
+		delete(ds, deviceID)
+		if len(ds) == 0 {
+			delete(q.devices, userID)
 		}
 	}
+
+	uq, ok := q.reqQueues[userID]
+	if !ok {
+		return
+	}
+	if reqs := uq.removeDevice(deviceID); len(reqs) != 0 {
+		go func() {
+			q.finishAll(userID, uq, reqs)
+			q.delQueueChan <- userID
+		}()
+	}
 }
@@ -2,6 +2,7 @@ package data
 
 import (
 	"expvar"
+	"time"
 
 	"github.com/neptulon/neptulon"
 )
@@ -9,13 +10,55 @@ import (
 // Queue is a message queue for queueing and sending messages to users.
 type Queue interface {
 	Middleware(ctx *neptulon.ReqCtx) error
-	RemoveConn(userID string)
+	RemoveConn(userID, connID string)
+	// RemoveDevice makes the queue forget a device of the user (i.e. upon logout), so the queued requests are no longer held back for the device.
+	RemoveDevice(userID, deviceID string)
 	AddRequest(userID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) error
+	// AddExpiringRequest queues a request which is dropped if not delivered before the expiry time (zero for never).
+	// If the queue gives up on the request, either as it could not be delivered within the retry budget or as it expired,
+	// failHandler is called with the reason. Client responses never reach failHandler, so clients cannot fake a failure.
+	AddExpiringRequest(userID string, method string, params interface{}, expires time.Time, resHandler func(ctx *neptulon.ResCtx) error, failHandler func(reason string) error) error
 }
 
-// QueueLength is the total request queue for all users combined.
+// DeadLetterStore keeps the requests that could not be delivered within the retry budget of a queue.
+type DeadLetterStore interface {
+	DeadLetters() []DeadLetter
+	ReplayDeadLetters(ids ...string)
+	PurgeDeadLetters(ids ...string)
+}
+
+// DeadLetter is a request that could not be delivered.
+type DeadLetter struct {
+	ID       string
+	UserID   string
+	Method   string
+	Params   interface{}
+	Attempts int       // Failed delivery attempts.
+	Reason   string    // Reason of the last failed delivery attempt.
+	Time     time.Time // Time that the request was given up on.
+}
+
+// Keys of the QueueLength map.
+const (
+	QueuePending  = "pending"   // requests waiting to be delivered to all devices of their recipients
+	QueueInFlight = "in-flight" // requests sent but not yet acknowledged, counted once per device
+)
+
+// QueueLength is the total request queue for all users combined, broken down to pending and in-flight requests.
+// This should be handled by the implementing struct.
+var QueueLength = expvar.NewMap("queue-length")
+
+// QueueRetries is the total number of failed delivery attempts that are scheduled for a retry.
+// This should be handled by the implementing struct.
+var QueueRetries = expvar.NewInt("queue-retries")
+
+// QueueExpired is the total number of requests that expired before they could be delivered.
+// This should be handled by the implementing struct.
+var QueueExpired = expvar.NewInt("queue-expired")
+
+// QueueDeadLetters is the number of requests that are currently in dead-letters.
 // This should be handled by the implementing struct.
-var QueueLength = expvar.NewInt("queue-length")
+var QueueDeadLetters = expvar.NewInt("queue-dead-letters")
 
 // UserCount is the total authenticated live user count.
 // This should be handled by the implementing struct.
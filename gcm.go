@@ -1,57 +1,392 @@
 package titan
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/soygul/gcm/ccs"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
 )
 
-func listenGCM() {
-	c, err := ccs.Connect(Conf.GCM.CCSHost, Conf.GCM.SenderID, Conf.GCM.APIKey(), Conf.App.Debug)
-	if err != nil {
-		log.Fatalln("gcm: failed to connect to GCM CCS with error:", err)
+const (
+	// maximum size of the data payload of a GCM message
+	gcmMaxPayload = 4096
+
+	// maximum time-to-live of a GCM message (4 weeks)
+	gcmMaxTTL = 2419200
+
+	// maximum number of downstream messages awaiting ACK/NACK on a single CCS connection, as per GCM specs
+	gcmMaxUnacked = 100
+
+	// maximum number of downstream messages waiting for a CCS connection to be sent over
+	gcmMaxBacklog = 10000
+
+	// maximum number of upstream messages waiting to be handled
+	gcmMaxUpstream = 1000
+
+	// wait duration before retrying a failed connection attempt, which doubles with each successive failure
+	gcmMinBackoff = time.Second
+	gcmMaxBackoff = time.Minute * 5
+)
+
+// NACK error codes that denote a temporary failure, after which the message can be sent again.
+var gcmRetryErrs = map[string]bool{
+	"SERVICE_UNAVAILABLE":          true,
+	"INTERNAL_SERVER_ERROR":        true,
+	"CONNECTION_DRAINING":          true,
+	"DEVICE_MESSAGE_RATE_EXCEEDED": true,
+}
+
+// NACK error codes that denote that the registration ID is no longer valid.
+var gcmStaleErrs = map[string]bool{
+	"DEVICE_UNREGISTERED": true,
+	"BAD_REGISTRATION":    true,
+}
+
+// gcmClient is a GCM CCS client that maintains a connection to CCS, for sending downstream messages to Android devices
+// and for receiving upstream messages from them.
+// Dropped connections are re-established with backoff, and a new connection is opened as soon as CCS starts draining the current one.
+// Downstream messages are sent with flow control so that no more than gcmMaxUnacked messages await ACK on a connection,
+// and the rest are held back until ACKs arrive.
+// All the writes to a connection, including the ACKs for upstream messages, are done while holding the lock.
+type gcmClient struct {
+	host, senderID, apiKey string
+	debug                  bool
+	handler                func(m *ccs.InMsg) // upstream message handler
+	stale                  func(regID string) // handler for the registration IDs that GCM reports to be no longer valid
+	upstream               chan *ccs.InMsg    // upstream messages waiting to be handled
+
+	mutex   sync.Mutex
+	active  *gcmConn          // connection to send new messages through, if any
+	conns   map[*gcmConn]bool // all open connections, including the draining ones
+	backlog []*ccs.OutMsg     // messages waiting to be sent
+	running bool
+
+	connect chan bool
+	quit    chan bool
+	wg      sync.WaitGroup
+}
+
+// gcmConn is a single CCS connection along with the downstream messages sent through it that are not yet ACKed.
+type gcmConn struct {
+	conn    *ccs.Conn
+	unacked map[string]*ccs.OutMsg // message ID -> message
+}
+
+func newGCMClient(host, senderID, apiKey string, debug bool, handler func(m *ccs.InMsg), stale func(regID string)) *gcmClient {
+	return &gcmClient{
+		host:     host,
+		senderID: senderID,
+		apiKey:   apiKey,
+		debug:    debug,
+		handler:  handler,
+		stale:    stale,
+		upstream: make(chan *ccs.InMsg, gcmMaxUpstream),
+		conns:    make(map[*gcmConn]bool),
+		connect:  make(chan bool, 1),
+		quit:     make(chan bool),
 	}
+}
 
-	log.Println("gcm: started")
+// start connects to CCS and keeps the connection alive until stop is called.
+func (g *gcmClient) start() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.running {
+		return
+	}
+	g.running = true
+
+	g.wg.Add(2)
+	go g.run()
+	go g.dispatch()
+	g.reconnect()
+}
 
+// stop closes all the CCS connections and waits for the connection goroutines to exit.
+// Downstream messages that are not yet ACKed are dropped.
+func (g *gcmClient) stop() error {
+	g.mutex.Lock()
+	if !g.running {
+		g.mutex.Unlock()
+		return nil
+	}
+	g.running = false
+	close(g.quit)
+
+	var err error
+	for gc := range g.conns {
+		if cerr := gc.conn.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	g.mutex.Unlock()
+
+	g.wg.Wait()
+	return err
+}
+
+// send queues a downstream message to be sent over CCS.
+func (g *gcmClient) send(m *ccs.OutMsg) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if len(g.backlog) >= gcmMaxBacklog {
+		return errors.New("gcm: too many messages are waiting to be sent")
+	}
+	g.backlog = append(g.backlog, m)
+	g.flush()
+	return nil
+}
+
+// reconnect signals the connection loop to open a new connection. Caller should hold the lock.
+func (g *gcmClient) reconnect() {
+	g.active = nil
+	select {
+	case g.connect <- true:
+	default:
+	}
+}
+
+// run is the connection loop, which opens a new connection whenever signaled to.
+func (g *gcmClient) run() {
+	defer g.wg.Done()
+
+	failures := 0
 	for {
-		m, err := c.Receive()
+		select {
+		case <-g.connect:
+		case <-g.quit:
+			return
+		}
+
+		c, err := ccs.Connect(g.host, g.senderID, g.apiKey, g.debug)
 		if err != nil {
-			log.Println("gcm: error receiving message:", err)
+			failures++
+			d := gcmBackoff(failures)
+			log.Printf("gcm: failed to connect to GCM CCS, retrying in %v: %v", d, err)
+			select {
+			case <-time.After(d):
+				g.mutex.Lock()
+				g.reconnect()
+				g.mutex.Unlock()
+				continue
+			case <-g.quit:
+				return
+			}
 		}
+		failures = 0
 
-		go readHandler(m)
+		g.mutex.Lock()
+		if !g.running {
+			g.mutex.Unlock()
+			c.Close()
+			return
+		}
+		gc := &gcmConn{conn: c, unacked: make(map[string]*ccs.OutMsg)}
+		g.conns[gc] = true
+		g.active = gc
+		g.flush()
+		g.mutex.Unlock()
+
+		log.Printf("gcm: connected to GCM CCS: %v", g.host)
+		g.wg.Add(1)
+		go g.receive(gc)
 	}
 }
 
-func readHandler(m *ccs.InMsg) {
-	t := m.Data["n.message_type"]
-	if t == "" {
-		log.Printf("gcm: malformed message from device: %+v\n", m)
-		return
+// receive reads the incoming messages from a connection until the connection is closed.
+func (g *gcmClient) receive(gc *gcmConn) {
+	defer g.wg.Done()
+
+	for {
+		m, err := gc.conn.Receive()
+		if err != nil {
+			g.drop(gc, err)
+			return
+		}
+		if m == nil {
+			continue
+		}
+
+		switch m.MessageType {
+		case "ack":
+			g.mutex.Lock()
+			delete(gc.unacked, m.ID)
+			g.flush()
+			g.mutex.Unlock()
+
+		case "nack":
+			g.mutex.Lock()
+			om, ok := gc.unacked[m.ID]
+			delete(gc.unacked, m.ID)
+			if ok && gcmRetryErrs[m.Err] {
+				g.backlog = append(g.backlog, om)
+			} else {
+				log.Printf("gcm: message %v to %v was rejected: %v: %v", m.ID, m.From, m.Err, m.ErrDesc)
+			}
+			g.flush()
+			g.mutex.Unlock()
+			if ok && gcmStaleErrs[m.Err] {
+				go g.stale(om.To)
+			}
+
+		case "control":
+			if m.ControlType == "CONNECTION_DRAINING" {
+				// keep reading the ACKs from the draining connection while new messages go through a new one
+				g.mutex.Lock()
+				if g.active == gc && g.running {
+					g.reconnect()
+				}
+				g.mutex.Unlock()
+			}
+
+		case "":
+			// upstream message from a device, which is only ACKed once it is queued to be handled, so CCS sends it again otherwise
+			g.mutex.Lock()
+			select {
+			case g.upstream <- m:
+				if err := gc.conn.Ack(m); err != nil {
+					log.Printf("gcm: failed to ACK upstream message: %v", err)
+					gc.conn.Close()
+				}
+			default:
+				log.Printf("gcm: too many upstream messages are waiting to be handled, dropping message %v from %v", m.ID, m.From)
+			}
+			g.mutex.Unlock()
+		}
 	}
+}
 
-	switch t {
-	case "message":
-		ids := m.Data["n.to"]
-		if ids == "" {
-			log.Printf("gcm: malformed message from device: %+v\n", m)
+// dispatch hands the upstream messages to the handler one at a time, so the slow handlers do not hold up the receive loops.
+func (g *gcmClient) dispatch() {
+	defer g.wg.Done()
+
+	for {
+		select {
+		case m := <-g.upstream:
+			g.handler(m)
+		case <-g.quit:
 			return
 		}
+	}
+}
+
+// drop discards a closed connection and queues its unacknowledged messages to be sent again.
+func (g *gcmClient) drop(gc *gcmConn, err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
 
-		id64, err := strconv.ParseUint(ids, 10, 32)
-		if err != nil || id64 == 0 {
-			log.Printf("gcm: invalid user ID specific in 'n.to' data field in message from device: %+v\n", m)
+	gc.conn.Close()
+	delete(g.conns, gc)
+	if !g.running {
+		return
+	}
+
+	log.Printf("gcm: CCS connection closed: %v", err)
+	for _, m := range gc.unacked {
+		g.backlog = append(g.backlog, m)
+	}
+	if g.active == gc {
+		g.reconnect()
+	}
+}
+
+// flush sends the messages in the backlog through the active connection, as long as flow control permits. Caller should hold the lock.
+func (g *gcmClient) flush() {
+	gc := g.active
+	for gc != nil && len(g.backlog) != 0 && len(gc.unacked) < gcmMaxUnacked {
+		m := g.backlog[0]
+		if _, err := gc.conn.Send(m); err != nil {
+			// connection is broken so hold on to the message until receive loop notices and replaces the connection
+			log.Printf("gcm: failed to send message: %v", err)
+			gc.conn.Close()
 			return
 		}
+		g.backlog = g.backlog[1:]
+		gc.unacked[m.ID] = m
+	}
+}
+
+// gcmBackoff calculates the wait duration before the next connection attempt, with exponential growth and jitter.
+func gcmBackoff(failures int) time.Duration {
+	d := gcmMinBackoff
+	for i := 1; i < failures && d < gcmMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > gcmMaxBackoff {
+		d = gcmMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// gcmNotification creates a wake-up notification for a message.
+// Message is included as a preview if it fits in the GCM payload limit, otherwise the device is signaled to fetch it over WebSocket.
+func gcmNotification(regID string, m models.Message, ttl int) (*ccs.OutMsg, error) {
+	d := map[string]string{"n.message_type": "message", "n.id": m.ID, "n.from": m.From, "n.message": m.Message}
+	if m.Group != "" {
+		d["n.group"] = m.Group
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("gcm: failed to serialize notification: %v", err)
+	}
+	if len(b) > gcmMaxPayload {
+		d = map[string]string{"n.message_type": "fetch", "n.id": m.ID, "n.from": m.From}
+		if m.Group != "" {
+			d["n.group"] = m.Group
+		}
+	}
+
+	if ttl > gcmMaxTTL {
+		ttl = gcmMaxTTL
+	} else if ttl < 0 {
+		ttl = 0
+	}
+	return &ccs.OutMsg{To: regID, Data: d, Priority: "high", TimeToLive: ttl}, nil
+}
 
-		// id := uint32(id64)
-		// user, ok := users[id]
-		// if !ok {
-		// 	log.Printf("User not found in user list: %+v\n", m)
-		// }
-		//
-		// user.Send(m.Data)
+// gcmUpstreamHandler routes the upstream messages from Android devices as if they were sent with msg.send over WebSocket.
+// Sender is identified by the GCM registration ID of the device, and the message fields are read from the data payload.
+// GCM message ID is used as the idempotency key, so the messages that CCS redelivers are not sent twice.
+func gcmUpstreamHandler(db *data.DB, ms *msgSender) func(m *ccs.InMsg) {
+	return func(m *ccs.InMsg) {
+		switch m.Data["n.message_type"] {
+		case "message":
+			to, group := m.Data["n.to"], m.Data["n.group"]
+			if to == "" && group == "" {
+				log.Printf("gcm: malformed message from device: %+v", m)
+				return
+			}
+
+			u, ok := (*db).GetByGCMRegID(m.From)
+			if !ok {
+				log.Printf("gcm: message from unknown device: %+v", m)
+				return
+			}
+
+			sMsg := models.Message{Key: "gcm:" + m.ID, To: to, Group: group, Message: m.Data["n.message"]}
+			if ttl, err := strconv.Atoi(m.Data["n.ttl"]); err == nil {
+				sMsg.TTL = ttl
+			}
+
+			res, resErr := ms.send(u.ID, []models.Message{sMsg})
+			if resErr != nil {
+				log.Printf("gcm: message from device was rejected: %v: %+v", resErr.Message, m)
+			} else if res[0].Status != models.SendAccepted {
+				log.Printf("gcm: message from device was not accepted: %v: %+v", res[0].Status, m)
+			}
+
+		case "":
+			log.Printf("gcm: malformed message from device: %+v", m)
+		}
 	}
 }
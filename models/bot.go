@@ -0,0 +1,8 @@
+package models
+
+// BotInfo is the metadata of a bot, for clients to discover the bots that users can send messages to.
+type BotInfo struct {
+	ID          string `json:"id"` // ID of the bot, which messages to the bot are addressed to.
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Contact is a user in the contact list (roster) of another user.
+type Contact struct {
+	UserID string    `json:"userid,omitempty"` // Owner of the contact list.
+	ID     string    `json:"id"`               // User ID of the contact.
+	Name   string    `json:"name,omitempty"`   // Display name of the contact, as given by the owner of the contact list.
+	Added  time.Time `json:"added"`
+}
+
+// Roster is the contact list of a user, along with the IDs of the users they have blocked.
+type Roster struct {
+	Contacts []Contact `json:"contacts"`
+	Blocked  []string  `json:"blocked"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Device platforms.
+const (
+	PlatformAndroid = "android" // Android devices, which receive push notifications through GCM.
+	PlatformIOS     = "ios"     // iOS devices, which receive push notifications through APNS.
+)
+
+// Device is a registered device of a user, which is sent push notifications while the user is offline.
+type Device struct {
+	UserID     string    `json:"userid,omitempty"`
+	ID         string    `json:"id"`
+	Platform   string    `json:"platform"`
+	PushToken  string    `json:"token"`                // GCM registration ID or APNS device token, depending on the platform.
+	AppVersion string    `json:"appversion,omitempty"` // Version of the app running on the device.
+	LastSeen   time.Time `json:"lastseen"`             // Last time the device was registered or authenticated.
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Group member roles.
+const (
+	GroupRoleAdmin  = "admin"  // Can add and remove members.
+	GroupRoleMember = "member" // Can send and receive group messages.
+)
+
+// Group is a group conversation.
+type Group struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Members []GroupMember `json:"members"`
+	Created time.Time     `json:"created"`
+}
+
+// GroupMember is a member of a group along with its role in the group.
+type GroupMember struct {
+	UserID string `json:"userid"`
+	Role   string `json:"role"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// LimitRate is the limit of the number of hashes that a user can look up with users.lookup per day (see LimitError).
+const LimitRate = "rate"
+
+// LookupResult is a user found by the hash of their e-mail address or phone number in a users.lookup request.
+type LookupResult struct {
+	Hash    string `json:"hash"` // The hash that matched the user.
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Picture []byte `json:"picture,omitempty"`
+}
+
+// HashEmail returns the lookup hash of an e-mail address, which is the hex encoded SHA-256 hash of the lowercase address.
+// Returns an empty string for an empty address.
+func HashEmail(email string) string {
+	return hashContact(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// HashPhoneNumber returns the lookup hash of a phone number in E.164 format (i.e. +46123456789), which is the hex encoded SHA-256 hash of the number.
+// Returns an empty string for an empty number.
+func HashPhoneNumber(phone string) string {
+	return hashContact(strings.TrimSpace(phone))
+}
+
+func hashContact(s string) string {
+	if s == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// PepperHash returns the key that a lookup hash is stored with, which is the hex encoded HMAC-SHA256 of the hash keyed with the server secret (pepper),
+// so that the stored keys cannot be reversed without the secret. Without a pepper, the hash itself is the key.
+func PepperHash(pepper, hash string) string {
+	if pepper == "" || hash == "" {
+		return hash
+	}
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SetLookupHashes sets the lookup keys of the user for the current e-mail address and phone number, peppered with the given server secret.
+// Returns true if any of the keys changed, in which case the user should be saved for the users.lookup requests to find the user by the new keys.
+func (u *User) SetLookupHashes(pepper string) bool {
+	e, p := PepperHash(pepper, HashEmail(u.Email)), PepperHash(pepper, HashPhoneNumber(u.PhoneNumber))
+	if u.EmailHash == e && u.PhoneHash == p {
+		return false
+	}
+	u.EmailHash, u.PhoneHash = e, p
+	return true
+}
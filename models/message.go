@@ -4,8 +4,79 @@ import "time"
 
 // Message is a chat message.
 type Message struct {
+	ID      string    `json:"id,omitempty"`  // Server assigned unique message ID.
+	Key     string    `json:"key,omitempty"` // Optional client supplied idempotency key, for safely retrying msg.send requests.
 	From    string    `json:"from,omitempty"`
 	To      string    `json:"to"`
-	Time    time.Time `json:"time"`
+	Group   string    `json:"group,omitempty"` // Group ID for group messages, in which case To is ignored.
+	Time    time.Time `json:"time"`            // Time that the server accepted the message at. Client supplied time is ignored.
+	TTL     int       `json:"ttl,omitempty"`   // Optional time-to-live in seconds, after which the message expires if not delivered yet. Capped at the server default.
 	Message string    `json:"message"`
 }
+
+// Delivery is a delivery receipt, sent to the original sender of a message once the recipient acknowledges it.
+type Delivery struct {
+	ID        string    `json:"id"`              // ID of the message.
+	To        string    `json:"to"`              // Recipient of the message.
+	Group     string    `json:"group,omitempty"` // Group of the message, if it is a group message.
+	Time      time.Time `json:"time"`            // Time of the message.
+	Delivered time.Time `json:"delivered"`       // Time of the delivery.
+}
+
+// Failure is a delivery failure notice, sent to the original sender of a message that could not be delivered.
+type Failure struct {
+	ID     string    `json:"id"`              // ID of the message.
+	To     string    `json:"to"`              // Recipient of the message.
+	Group  string    `json:"group,omitempty"` // Group of the message, if it is a group message.
+	Time   time.Time `json:"time"`            // Time of the message.
+	Reason string    `json:"reason"`          // Reason of the failure.
+}
+
+// ReadMarker marks the point up to which a user has read the messages in a conversation.
+type ReadMarker struct {
+	From string    `json:"from,omitempty"` // User who has read the messages.
+	Peer string    `json:"peer"`           // The other party of the conversation.
+	Time time.Time `json:"time"`           // Time of the last message that was read.
+}
+
+// HistoryQuery is a query for a page of the message history of a conversation.
+type HistoryQuery struct {
+	Peer   string `json:"peer,omitempty"`   // The other party of the conversation.
+	Group  string `json:"group,omitempty"`  // Group ID for group conversations, in which case Peer is ignored.
+	Cursor string `json:"cursor,omitempty"` // Cursor returned with the previous page, to retrieve older messages. Empty for the latest page.
+	Limit  int    `json:"limit,omitempty"`  // Maximum number of messages in the page.
+}
+
+// History is a page of the message history of a conversation, with the newest message first.
+type History struct {
+	Messages []Message `json:"messages"`
+	Cursor   string    `json:"cursor,omitempty"` // Cursor for the next page of older messages. Empty if there are no more messages.
+}
+
+// Statuses of the messages in a msg.send request.
+const (
+	SendAccepted         = "accepted"          // Message is accepted for delivery and assigned an ID.
+	SendUnknownRecipient = "unknown_recipient" // Recipient user or group does not exist, or sender is not a member of the group.
+	SendBlocked          = "blocked"           // Sender has blocked the recipient. Messages to the users who blocked the sender look accepted instead.
+	SendTooLarge         = "too_large"         // Message body exceeds the maximum size.
+	SendRateLimited      = "rate_limited"      // Sender is sending too many messages, so the message should be retried later.
+	SendFailed           = "failed"            // Server failed to process the message, so the message should be retried.
+)
+
+// SendResult is the result of sending a single message with msg.send. Results are in the same order as the messages in the request.
+type SendResult struct {
+	ID     string `json:"id,omitempty"` // ID of the message, if it is accepted.
+	Status string `json:"status"`
+}
+
+// Limits that msg.send and users.lookup requests are subject to. See LimitRate for the users.lookup rate limit.
+const (
+	LimitBatchSize   = "batch_size"   // Number of messages (or hashes for users.lookup) in a request.
+	LimitRequestSize = "request_size" // Size of the request parameters in bytes.
+)
+
+// LimitError is the error data of a request that is rejected for exceeding a limit.
+type LimitError struct {
+	Limit string `json:"limit"` // Limit that was exceeded.
+	Max   int    `json:"max"`   // Maximum allowed value.
+}
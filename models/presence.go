@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// Presence is the online/offline state of a user.
+type Presence struct {
+	UserID   string    `json:"userid"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"lastseen"` // Last time the user was online. Zero if the user is online or was never seen online.
+}
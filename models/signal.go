@@ -0,0 +1,15 @@
+package models
+
+// Signal types.
+const (
+	SignalTypingStart = "typing.start" // User started typing a message.
+	SignalTypingStop  = "typing.stop"  // User stopped typing without sending a message.
+)
+
+// Signal is an ephemeral event about a conversation, which is only delivered to the recipients that are online at the time.
+type Signal struct {
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+	Group string `json:"group,omitempty"` // Group ID for group conversations, in which case To is ignored.
+	Type  string `json:"type"`
+}
@@ -10,7 +10,10 @@ type User struct {
 	PhoneNumber     string
 	GCMRegID        string
 	APNSDeviceToken string
+	WebPush         []WebPushSubscription
 	Name            string
 	Picture         []byte
 	JWTToken        string
+	EmailHash       string `dynamodbav:",omitempty"` // Lookup key of the e-mail address, which is set by the server (see SetLookupHashes).
+	PhoneHash       string `dynamodbav:",omitempty"` // Lookup key of the phone number, which is set by the server (see SetLookupHashes).
 }
@@ -0,0 +1,34 @@
+package models
+
+// WebPushSubscription is the Web Push subscription of a browser, in the same format as the JSON serialization of a browser PushSubscription object.
+type WebPushSubscription struct {
+	Endpoint string         `json:"endpoint"`
+	Keys     WebPushSubKeys `json:"keys"`
+}
+
+// WebPushSubKeys are the keys used for encrypting the push messages to a subscription.
+type WebPushSubKeys struct {
+	P256dh string `json:"p256dh"` // Base64url encoded P-256 ECDH public key of the browser.
+	Auth   string `json:"auth"`   // Base64url encoded authentication secret.
+}
+
+// AddWebPushSub returns the subscriptions with the given one appended, replacing the subscription with the same endpoint if any,
+// and dropping the oldest subscriptions beyond the given maximum.
+func AddWebPushSub(subs []WebPushSubscription, sub WebPushSubscription, max int) []WebPushSubscription {
+	subs = append(RemoveWebPushSub(subs, sub.Endpoint), sub)
+	if len(subs) > max {
+		subs = subs[len(subs)-max:]
+	}
+	return subs
+}
+
+// RemoveWebPushSub returns the subscriptions without the one with the given endpoint. Given slice is not modified.
+func RemoveWebPushSub(subs []WebPushSubscription, endpoint string) []WebPushSubscription {
+	var rs []WebPushSubscription
+	for _, s := range subs {
+		if s.Endpoint != endpoint {
+			rs = append(rs, s)
+		}
+	}
+	return rs
+}
@@ -0,0 +1,72 @@
+package titan
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/neptulon/shortid"
+)
+
+// msgKeyTTL is the duration for which client supplied idempotency keys are remembered.
+// Any msg.send retry with the same key within this period is considered a duplicate.
+const msgKeyTTL = time.Hour * 24
+
+// newMsgID generates a unique message ID. If the sender supplied an idempotency key,
+// ID is derived from the key so that all retries of the same message get the same ID.
+func newMsgID(userID, key string) (string, error) {
+	if key == "" {
+		return shortid.UUID()
+	}
+
+	h := sha256.Sum256([]byte(userID + "\x00" + key))
+	return base64.RawURLEncoding.EncodeToString(h[:16]), nil
+}
+
+// msgIDCache keeps track of recently seen message IDs to suppress duplicate messages.
+type msgIDCache struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	ids       map[string]time.Time // message ID -> expiry time
+	lastSweep time.Time
+}
+
+func newMsgIDCache(ttl time.Duration) *msgIDCache {
+	return &msgIDCache{
+		ttl:       ttl,
+		ids:       make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// add records the given message ID, returning false if the ID was already seen.
+func (c *msgIDCache) add(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if exp, ok := c.ids[id]; ok && exp.After(now) {
+		return false
+	}
+
+	// evict expired IDs every once in a while
+	if now.Sub(c.lastSweep) > time.Minute {
+		for id, exp := range c.ids {
+			if !exp.After(now) {
+				delete(c.ids, id)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	c.ids[id] = now.Add(c.ttl)
+	return true
+}
+
+// remove forgets the given message ID, so that a retry of a message that could not be sent is not considered a duplicate.
+func (c *msgIDCache) remove(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.ids, id)
+}
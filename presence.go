@@ -0,0 +1,187 @@
+package titan
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/titan-x/titan/models"
+)
+
+// presence tracks the connected sessions and the online/offline state of users, and notifies the subscribed users about state changes.
+// Presence updates are ephemeral. They are sent directly to the connected sessions of the subscribers, and never queued.
+type presence struct {
+	mutex    sync.Mutex
+	sender   func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (reqID string, err error)
+	conns    map[string]map[string]bool // user ID -> connection IDs
+	lastSeen map[string]time.Time       // user ID -> last time the user went offline
+	subs     map[string]map[string]bool // user ID -> IDs of the users subscribed to the user's presence
+	subList  map[string][]string        // subscriber user ID -> IDs of the users that the subscriber is subscribed to
+}
+
+func newPresence(sender func(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (reqID string, err error)) *presence {
+	return &presence{
+		sender:   sender,
+		conns:    make(map[string]map[string]bool),
+		lastSeen: make(map[string]time.Time),
+		subs:     make(map[string]map[string]bool),
+		subList:  make(map[string][]string),
+	}
+}
+
+// Middleware registers the connections of authenticated users (upon their first incoming-message).
+func (p *presence) Middleware(ctx *neptulon.ReqCtx) error {
+	p.addConn(ctx.Conn.Session.Get("userid").(string), ctx.Conn.ID)
+	return ctx.Next()
+}
+
+func (p *presence) addConn(userID, connID string) {
+	p.mutex.Lock()
+	cs, ok := p.conns[userID]
+	if !ok {
+		cs = make(map[string]bool)
+		p.conns[userID] = cs
+	}
+	if cs[connID] {
+		p.mutex.Unlock()
+		return
+	}
+	cs[connID] = true
+	online := len(cs) == 1
+	p.mutex.Unlock()
+
+	if online {
+		p.notify(models.Presence{UserID: userID, Online: true})
+	}
+}
+
+// removeConn unregisters a connection. If it was the last connection of the user, user goes offline
+// and user's own presence subscriptions are dropped.
+func (p *presence) removeConn(userID, connID string) {
+	p.mutex.Lock()
+	cs := p.conns[userID]
+	if !cs[connID] {
+		p.mutex.Unlock()
+		return
+	}
+	delete(cs, connID)
+	if len(cs) != 0 {
+		p.mutex.Unlock()
+		return
+	}
+
+	delete(p.conns, userID)
+	now := time.Now()
+	p.lastSeen[userID] = now
+	p.unsubscribe(userID)
+	p.mutex.Unlock()
+
+	p.notify(models.Presence{UserID: userID, Online: false, LastSeen: now})
+}
+
+// subscribe replaces the presence subscriptions of a user with the given user IDs, and returns the current state of those users.
+func (p *presence) subscribe(subscriberID string, userIDs []string) []models.Presence {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.unsubscribe(subscriberID)
+	p.subList[subscriberID] = userIDs
+
+	ps := []models.Presence{}
+	for _, id := range userIDs {
+		ss, ok := p.subs[id]
+		if !ok {
+			ss = make(map[string]bool)
+			p.subs[id] = ss
+		}
+		ss[subscriberID] = true
+		ps = append(ps, p.get(id))
+	}
+	return ps
+}
+
+// unsubscribe drops all presence subscriptions of a user. Caller should hold the lock.
+func (p *presence) unsubscribe(subscriberID string) {
+	for _, id := range p.subList[subscriberID] {
+		delete(p.subs[id], subscriberID)
+		if len(p.subs[id]) == 0 {
+			delete(p.subs, id)
+		}
+	}
+	delete(p.subList, subscriberID)
+}
+
+// drop removes the presence subscription of a user to another user's presence, if any.
+func (p *presence) drop(subscriberID, userID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.subs[userID][subscriberID] {
+		return
+	}
+	delete(p.subs[userID], subscriberID)
+	if len(p.subs[userID]) == 0 {
+		delete(p.subs, userID)
+	}
+
+	var ids []string
+	for _, id := range p.subList[subscriberID] {
+		if id != userID {
+			ids = append(ids, id)
+		}
+	}
+	p.subList[subscriberID] = ids
+}
+
+// get returns the current presence state of a user. Caller should hold the lock.
+func (p *presence) get(userID string) models.Presence {
+	if len(p.conns[userID]) != 0 {
+		return models.Presence{UserID: userID, Online: true}
+	}
+	return models.Presence{UserID: userID, Online: false, LastSeen: p.lastSeen[userID]}
+}
+
+// connIDs returns the IDs of the connected sessions of a user.
+func (p *presence) connIDs(userID string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var ids []string
+	for id := range p.conns[userID] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// send sends a request to all the connected sessions of a user, without waiting for a response.
+// Returns the number of sessions that the request was sent to, which is zero if the user is offline.
+func (p *presence) send(userID, method string, params interface{}) int {
+	n := 0
+	for _, cid := range p.connIDs(userID) {
+		if _, err := p.sender(cid, method, params, ignoreRes); err != nil {
+			log.Printf("presence: failed to send %v request to connection %v: %v", method, cid, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// notify sends a presence update to all the connected sessions of the users who are subscribed to the user's presence.
+func (p *presence) notify(ps models.Presence) {
+	p.mutex.Lock()
+	var connIDs []string
+	for sid := range p.subs[ps.UserID] {
+		for cid := range p.conns[sid] {
+			connIDs = append(connIDs, cid)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, cid := range connIDs {
+		if _, err := p.sender(cid, "presence.update", []models.Presence{ps}, ignoreRes); err != nil {
+			log.Printf("presence: failed to send presence update to connection %v: %v", cid, err)
+		}
+	}
+}
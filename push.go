@@ -0,0 +1,167 @@
+package titan
+
+import (
+	"log"
+	"time"
+
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// push sends push notifications to the devices of offline users, so they can wake up and connect to retrieve their messages.
+// Users with a live connection are not notified as the messages are delivered to them over WebSocket right away.
+type push struct {
+	db       *data.DB
+	presence *presence
+	gcm      *gcmClient     // nil if GCM is not configured
+	apns     *apnsClient    // nil if APNS is not configured
+	webPush  *webPushClient // nil if Web Push is not configured
+}
+
+func newPush(db *data.DB, p *presence) *push {
+	return &push{db: db, presence: p}
+}
+
+// notify sends a wake-up notification for a message to every device of the user, if the user is offline.
+// Notifications are sent asynchronously and on a best-effort basis, as the message itself stays in the queue anyway.
+func (p *push) notify(userID string, m models.Message, expires time.Time) {
+	if (p.gcm == nil && p.apns == nil && p.webPush == nil) || len(p.presence.connIDs(userID)) != 0 {
+		return
+	}
+
+	u, ok := (*p.db).GetByID(userID)
+	if !ok {
+		return
+	}
+
+	for _, d := range p.devices(u) {
+		switch {
+		case d.Platform == models.PlatformAndroid && p.gcm != nil:
+			go p.sendGCM(d, m, expires)
+		case d.Platform == models.PlatformIOS && p.apns != nil:
+			go p.sendAPNS(d, m, expires)
+		}
+	}
+
+	if p.webPush != nil {
+		for _, sub := range u.WebPush {
+			go p.sendWebPush(u.ID, sub, m, expires)
+		}
+	}
+}
+
+// devices returns the registered devices of the user, along with the ones denoted by the GCMRegID and APNSDeviceToken fields
+// of the user record, which have no device ID.
+func (p *push) devices(u *models.User) []models.Device {
+	ds, err := (*p.db).GetDevices(u.ID)
+	if err != nil {
+		log.Printf("push: failed to retrieve devices of user %v: %v", u.ID, err)
+	}
+
+	tokens := make(map[string]bool)
+	for _, d := range ds {
+		tokens[d.PushToken] = true
+	}
+	if u.GCMRegID != "" && !tokens[u.GCMRegID] {
+		ds = append(ds, models.Device{UserID: u.ID, Platform: models.PlatformAndroid, PushToken: u.GCMRegID})
+	}
+	if u.APNSDeviceToken != "" && !tokens[u.APNSDeviceToken] {
+		ds = append(ds, models.Device{UserID: u.ID, Platform: models.PlatformIOS, PushToken: u.APNSDeviceToken})
+	}
+	return ds
+}
+
+// sendGCM sends a GCM notification to an Android device.
+// Notifications for the messages that have already expired are dropped, as there is nothing left to fetch.
+func (p *push) sendGCM(d models.Device, m models.Message, expires time.Time) {
+	ttl := expires.Sub(time.Now())
+	if ttl <= 0 {
+		return
+	}
+
+	n, err := gcmNotification(d.PushToken, m, int(ttl/time.Second))
+	if err == nil {
+		err = p.gcm.send(n)
+	}
+	if err != nil {
+		log.Printf("push: failed to send GCM notification to user %v: %v", d.UserID, err)
+	}
+}
+
+// sendAPNS sends an APNS notification to an iOS device.
+// If APNS reports that the device token is no longer valid, the device is removed.
+func (p *push) sendAPNS(d models.Device, m models.Message, expires time.Time) {
+	err := p.apns.send(apnsNotificationFor(d.PushToken, m, expires))
+	if err == nil {
+		return
+	}
+	log.Printf("push: failed to send APNS notification to user %v: %v", d.UserID, err)
+
+	if aerr, ok := err.(*apnsError); ok && aerr.unregistered() {
+		if err := p.removeDevice(d); err != nil {
+			log.Printf("push: failed to remove stale APNS device of user %v: %v", d.UserID, err)
+		}
+	}
+}
+
+// removeGCMRegID removes the Android device with a GCM registration ID that GCM reports to be no longer valid.
+func (p *push) removeGCMRegID(regID string) {
+	u, ok := (*p.db).GetByGCMRegID(regID)
+	if !ok {
+		return
+	}
+
+	for _, d := range p.devices(u) {
+		if d.Platform != models.PlatformAndroid || d.PushToken != regID {
+			continue
+		}
+		if err := p.removeDevice(d); err != nil {
+			log.Printf("push: failed to remove stale GCM device of user %v: %v", d.UserID, err)
+		}
+	}
+}
+
+// removeDevice removes a device whose push token is no longer valid.
+// Devices without an ID are the ones in the user record, in which case the push token is cleared from the user record.
+func (p *push) removeDevice(d models.Device) error {
+	if d.ID != "" {
+		return (*p.db).DeleteDevice(d.UserID, d.ID)
+	}
+	return (*p.db).ClearPushToken(d.UserID, d.Platform, d.PushToken)
+}
+
+// sendWebPush sends a Web Push message to a browser of the user.
+// If the push service reports that the subscription has expired, the subscription is removed from the user record.
+func (p *push) sendWebPush(userID string, sub models.WebPushSubscription, m models.Message, expires time.Time) {
+	b, err := webPushPayload(m)
+	if err == nil {
+		err = p.webPush.send(sub, b, int(expires.Sub(time.Now())/time.Second))
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("push: failed to send Web Push message to user %v: %v", userID, err)
+
+	if werr, ok := err.(*webPushError); ok && werr.expired() {
+		if err := (*p.db).RemoveWebPushSub(userID, sub.Endpoint); err != nil {
+			log.Printf("push: failed to remove expired Web Push subscription of user %v: %v", userID, err)
+		}
+	}
+}
+
+// start connects to the push notification services.
+func (p *push) start() {
+	if p.gcm != nil {
+		p.gcm.start()
+	}
+}
+
+func (p *push) close() error {
+	if p.apns != nil {
+		p.apns.close()
+	}
+	if p.gcm != nil {
+		return p.gcm.stop()
+	}
+	return nil
+}
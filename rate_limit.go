@@ -0,0 +1,72 @@
+package titan
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter with a separate bucket for each key (i.e. user ID).
+// Each bucket holds up to burst tokens, and is refilled at the given rate per second.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rate limiter that allows up to n events per given period for each key, in bursts of up to n events.
+func newRateLimiter(n int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(n) / per.Seconds(),
+		burst:     float64(n),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the given key, returning false if the bucket is empty.
+func (r *rateLimiter) allow(key string) bool {
+	return r.allowN(key, 1)
+}
+
+// allowN takes n tokens at once from the bucket of the given key, returning false (and taking none) if the bucket does not have enough tokens.
+func (r *rateLimiter) allowN(key string, n int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+
+	// evict the buckets that are full again every once in a while, as they are no different than new ones
+	if now.Sub(r.lastSweep) > time.Minute {
+		for k, b := range r.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,18 @@
+package titan
+
+import (
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+)
+
+func initBotRoutes(r *middleware.Router, b *botRegistry) {
+	r.Request("bots.list", initListBotsHandler(b))
+}
+
+// Allows clients to discover the bots that users can send messages to.
+func initListBotsHandler(b *botRegistry) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		ctx.Res = b.list()
+		return ctx.Next()
+	}
+}
@@ -0,0 +1,151 @@
+package titan
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// Error codes returned by the contact routes.
+const (
+	errContactBadRequest = 5001 // Contact ID is missing, or it is not the ID of another user.
+)
+
+func initContactRoutes(r *middleware.Router, db *data.DB, p *presence) {
+	r.Request("contacts.list", initListContactsHandler(db))
+	r.Request("contacts.add", initAddContactHandler(db))
+	r.Request("contacts.remove", initRemoveContactHandler(db, p))
+	r.Request("contacts.block", initBlockContactHandler(db, p))
+	r.Request("contacts.unblock", initUnblockContactHandler(db))
+}
+
+// Allows clients to retrieve the contact list of the user, along with the users they have blocked.
+func initListContactsHandler(db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		return rosterRes(ctx, *db, "contacts.list")
+	}
+}
+
+// Allows clients to add a user to the contact list, with an optional display name. Adding an existing contact again updates its name.
+func initAddContactHandler(db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var c models.Contact
+		if !contactParams(ctx, *db, &c) {
+			return nil
+		}
+
+		c.UserID = ctx.Conn.Session.Get("userid").(string)
+		c.Added = time.Now()
+		cs, err := (*db).GetContacts(c.UserID)
+		if err != nil {
+			return fmt.Errorf("route: contacts.add: failed to retrieve contacts: %v", err)
+		}
+		for _, oc := range cs {
+			if oc.ID == c.ID {
+				c.Added = oc.Added
+			}
+		}
+
+		if err := (*db).SaveContact(&c); err != nil {
+			return fmt.Errorf("route: contacts.add: failed to save contact: %v", err)
+		}
+		return rosterRes(ctx, *db, "contacts.add")
+	}
+}
+
+// Allows clients to remove a user from the contact list. Removing a contact does not unblock them.
+// Removed contacts stop receiving the presence updates of the user.
+func initRemoveContactHandler(db *data.DB, p *presence) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var c models.Contact
+		if err := ctx.Params(&c); err != nil {
+			return err
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+		if err := (*db).DeleteContact(uid, c.ID); err != nil {
+			return fmt.Errorf("route: contacts.remove: failed to delete contact: %v", err)
+		}
+		p.drop(c.ID, uid)
+		return rosterRes(ctx, *db, "contacts.remove")
+	}
+}
+
+// Allows clients to block a user, whether they are in the contact list or not.
+// Messages and signals from blocked users are silently dropped, so blocked users cannot tell that they are blocked.
+// Blocked users also stop receiving the presence updates of the user.
+func initBlockContactHandler(db *data.DB, p *presence) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var c models.Contact
+		if !contactParams(ctx, *db, &c) {
+			return nil
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+		if err := (*db).Block(uid, c.ID); err != nil {
+			return fmt.Errorf("route: contacts.block: failed to block user: %v", err)
+		}
+		p.drop(c.ID, uid)
+		return rosterRes(ctx, *db, "contacts.block")
+	}
+}
+
+// Allows clients to unblock a user.
+func initUnblockContactHandler(db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var c models.Contact
+		if err := ctx.Params(&c); err != nil {
+			return err
+		}
+
+		if err := (*db).Unblock(ctx.Conn.Session.Get("userid").(string), c.ID); err != nil {
+			return fmt.Errorf("route: contacts.unblock: failed to unblock user: %v", err)
+		}
+		return rosterRes(ctx, *db, "contacts.unblock")
+	}
+}
+
+// contactParams reads the contact in the request params, and validates that it is another existing user.
+// If not, error response is set and false is returned.
+func contactParams(ctx *neptulon.ReqCtx, db data.DB, c *models.Contact) bool {
+	if err := ctx.Params(c); err != nil {
+		ctx.Err = &neptulon.ResError{Code: errContactBadRequest, Message: "Malformed contact."}
+		return false
+	}
+
+	if _, ok := db.GetByID(c.ID); !ok || c.ID == ctx.Conn.Session.Get("userid").(string) {
+		ctx.Err = &neptulon.ResError{Code: errContactBadRequest, Message: "Contact should be another user: " + c.ID}
+		return false
+	}
+	return true
+}
+
+// blockedPair tells whether either of the users has blocked the other.
+func blockedPair(db data.DB, userID1, userID2 string) (bool, error) {
+	blocked, err := db.IsBlocked(userID1, userID2)
+	if err != nil || blocked {
+		return blocked, err
+	}
+	return db.IsBlocked(userID2, userID1)
+}
+
+// rosterRes responds to the request with the up-to-date roster of the user.
+func rosterRes(ctx *neptulon.ReqCtx, db data.DB, route string) error {
+	uid := ctx.Conn.Session.Get("userid").(string)
+
+	cs, err := db.GetContacts(uid)
+	if err != nil {
+		return fmt.Errorf("route: %v: failed to retrieve contacts: %v", route, err)
+	}
+	bs, err := db.GetBlocked(uid)
+	if err != nil {
+		return fmt.Errorf("route: %v: failed to retrieve blocked users: %v", route, err)
+	}
+
+	ctx.Res = models.Roster{Contacts: cs, Blocked: bs}
+	return ctx.Next()
+}
@@ -0,0 +1,116 @@
+package titan
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// Error codes returned by the device routes.
+const (
+	errDeviceBadRequest = 4001 // Device platform or push token is missing or invalid.
+)
+
+// ID of the device that the connections without a device ID in their JWT token belong to.
+// It is stored in the session in place of the empty device ID, so both the database and the queue know the device by this ID.
+const defaultDeviceID = "default"
+
+func initDeviceRoutes(r *middleware.Router, q *data.Queue, db *data.DB) {
+	r.Request("device.register", initRegisterDeviceHandler(db))
+	r.Request("device.unregister", initUnregisterDeviceHandler(q, db))
+}
+
+// deviceIDOrDefault returns the given device ID, or the default device ID if it is empty.
+func deviceIDOrDefault(id string) string {
+	if id == "" {
+		return defaultDeviceID
+	}
+	return id
+}
+
+// sessionDeviceID returns the ID of the device that the connection belongs to.
+func sessionDeviceID(ctx *neptulon.ReqCtx) string {
+	id, _ := ctx.Conn.Session.Get("deviceid").(string)
+	return deviceIDOrDefault(id)
+}
+
+// Allows devices to register their push tokens, so they are sent push notifications while the user is offline.
+// Device is identified by the device ID in the JWT token of the connection. Registering again updates the device.
+func initRegisterDeviceHandler(db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var d models.Device
+		if err := ctx.Params(&d); err != nil {
+			return err
+		}
+
+		if (d.Platform != models.PlatformAndroid && d.Platform != models.PlatformIOS) || d.PushToken == "" {
+			ctx.Err = &neptulon.ResError{Code: errDeviceBadRequest, Message: "Device should have a push token and a platform of either android or ios."}
+			return nil
+		}
+
+		d.UserID = ctx.Conn.Session.Get("userid").(string)
+		d.ID = sessionDeviceID(ctx)
+		d.LastSeen = time.Now()
+
+		// push token belongs to the app install that presents it, so it moves to the new device even if it was registered to another user
+		// (i.e. app was reinstalled, or the phone changed hands), and notifications for the old owner are no longer sent to it
+		if od, ok := (*db).GetDeviceByToken(d.PushToken); ok && (od.UserID != d.UserID || od.ID != d.ID) {
+			if err := (*db).DeleteDevice(od.UserID, od.ID); err != nil {
+				return fmt.Errorf("route: device.register: failed to delete old device: %v", err)
+			}
+		}
+		if d.Platform == models.PlatformAndroid {
+			if u, ok := (*db).GetByGCMRegID(d.PushToken); ok && u.ID != d.UserID && u.GCMRegID == d.PushToken {
+				if err := (*db).ClearPushToken(u.ID, d.Platform, d.PushToken); err != nil {
+					return fmt.Errorf("route: device.register: failed to clear push token of old user: %v", err)
+				}
+			}
+		}
+
+		if err := (*db).SaveDevice(&d); err != nil {
+			return fmt.Errorf("route: device.register: failed to save device: %v", err)
+		}
+
+		ctx.Res = client.ACK
+		return ctx.Next()
+	}
+}
+
+// Allows devices to unregister themselves (i.e. upon logout), so they are no longer sent push notifications.
+// Queued messages are no longer held back for the device either.
+func initUnregisterDeviceHandler(q *data.Queue, db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		uid := ctx.Conn.Session.Get("userid").(string)
+		did := sessionDeviceID(ctx)
+		if err := (*db).DeleteDevice(uid, did); err != nil {
+			return fmt.Errorf("route: device.unregister: failed to delete device: %v", err)
+		}
+		(*q).RemoveDevice(uid, did)
+
+		ctx.Res = client.ACK
+		return ctx.Next()
+	}
+}
+
+// touchDevice updates the last-seen time of the device that the connection belongs to, if the device is registered.
+func touchDevice(db data.DB, ctx *neptulon.ReqCtx) error {
+	uid := ctx.Conn.Session.Get("userid").(string)
+	did := sessionDeviceID(ctx)
+
+	ds, err := db.GetDevices(uid)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if d.ID == did {
+			d.LastSeen = time.Now()
+			return db.SaveDevice(&d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package titan
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// Error codes returned by the group routes.
+const (
+	errGroupNotFound   = 2001 // Group does not exist or user is not a member of it. Both cases look the same to the user.
+	errGroupNotAdmin   = 2002 // Only group admins can add or remove members.
+	errGroupBadRequest = 2003 // Request parameters are missing or invalid.
+)
+
+// groupReq is the request parameter of all group routes.
+type groupReq struct {
+	ID      string   `json:"id,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Members []string `json:"members,omitempty"`
+}
+
+func initGroupRoutes(r *middleware.Router, db *data.DB) {
+	// serializes the read-modify-write cycles of group membership updates
+	mu := &sync.Mutex{}
+
+	r.Request("group.create", initCreateGroupHandler(db))
+	r.Request("group.add", initAddGroupMembersHandler(db, mu))
+	r.Request("group.remove", initRemoveGroupMembersHandler(db, mu))
+	r.Request("group.leave", initLeaveGroupHandler(db, mu))
+	r.Request("group.info", initGroupInfoHandler(db))
+}
+
+// Allows clients to create a group conversation with the given members. Creator of the group becomes its admin.
+func initCreateGroupHandler(db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var gr groupReq
+		if err := ctx.Params(&gr); err != nil {
+			return err
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+
+		g := models.Group{Name: gr.Name, Members: []models.GroupMember{models.GroupMember{UserID: uid, Role: models.GroupRoleAdmin}}, Created: time.Now()}
+		if ok, err := addGroupMembers(ctx, *db, uid, &g, gr.Members); err != nil {
+			return fmt.Errorf("route: group.create: %v", err)
+		} else if !ok {
+			return nil
+		}
+
+		if err := (*db).SaveGroup(&g); err != nil {
+			return fmt.Errorf("route: group.create: failed to save group: %v", err)
+		}
+
+		ctx.Res = g
+		return ctx.Next()
+	}
+}
+
+// Allows group admins to add members to a group.
+func initAddGroupMembersHandler(db *data.DB, mu *sync.Mutex) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var gr groupReq
+		if err := ctx.Params(&gr); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		g, ok := getAdminGroup(ctx, db, gr.ID)
+		if !ok {
+			return nil
+		}
+
+		if ok, err := addGroupMembers(ctx, *db, ctx.Conn.Session.Get("userid").(string), g, gr.Members); err != nil {
+			return fmt.Errorf("route: group.add: %v", err)
+		} else if !ok {
+			return nil
+		}
+
+		if err := (*db).SaveGroup(g); err != nil {
+			return fmt.Errorf("route: group.add: failed to save group: %v", err)
+		}
+
+		ctx.Res = g
+		return ctx.Next()
+	}
+}
+
+// Allows group admins to remove members from a group.
+func initRemoveGroupMembersHandler(db *data.DB, mu *sync.Mutex) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var gr groupReq
+		if err := ctx.Params(&gr); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		g, ok := getAdminGroup(ctx, db, gr.ID)
+		if !ok {
+			return nil
+		}
+
+		for _, m := range gr.Members {
+			removeGroupMember(g, m)
+		}
+
+		if err := (*db).SaveGroup(g); err != nil {
+			return fmt.Errorf("route: group.remove: failed to save group: %v", err)
+		}
+
+		ctx.Res = g
+		return ctx.Next()
+	}
+}
+
+// Allows clients to leave a group. If the last admin leaves the group, the longest standing member becomes the new admin.
+func initLeaveGroupHandler(db *data.DB, mu *sync.Mutex) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var gr groupReq
+		if err := ctx.Params(&gr); err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		g, ok := getMemberGroup(ctx, db, gr.ID)
+		if !ok {
+			return nil
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+		removeGroupMember(g, uid)
+
+		if err := (*db).SaveGroup(g); err != nil {
+			return fmt.Errorf("route: group.leave: failed to save group: %v", err)
+		}
+
+		ctx.Res = client.ACK
+		return ctx.Next()
+	}
+}
+
+// Allows group members to retrieve group details and the member list.
+func initGroupInfoHandler(db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var gr groupReq
+		if err := ctx.Params(&gr); err != nil {
+			return err
+		}
+
+		g, ok := getMemberGroup(ctx, db, gr.ID)
+		if !ok {
+			return nil
+		}
+
+		ctx.Res = g
+		return ctx.Next()
+	}
+}
+
+// getMemberGroup retrieves a group, given that the user is a member of it.
+// Otherwise, an error response is set and false is returned.
+func getMemberGroup(ctx *neptulon.ReqCtx, db *data.DB, id string) (*models.Group, bool) {
+	if id == "" {
+		ctx.Err = &neptulon.ResError{Code: errGroupBadRequest, Message: "Group ID is required."}
+		return nil, false
+	}
+
+	uid := ctx.Conn.Session.Get("userid").(string)
+	g, ok := (*db).GetGroup(id)
+	if !ok || groupMember(g, uid) == -1 {
+		ctx.Err = &neptulon.ResError{Code: errGroupNotFound, Message: "Group not found."}
+		return nil, false
+	}
+
+	return g, true
+}
+
+// getAdminGroup retrieves a group, given that the user is an admin of it.
+// Otherwise, an error response is set and false is returned.
+func getAdminGroup(ctx *neptulon.ReqCtx, db *data.DB, id string) (*models.Group, bool) {
+	g, ok := getMemberGroup(ctx, db, id)
+	if !ok {
+		return nil, false
+	}
+
+	uid := ctx.Conn.Session.Get("userid").(string)
+	if g.Members[groupMember(g, uid)].Role != models.GroupRoleAdmin {
+		ctx.Err = &neptulon.ResError{Code: errGroupNotAdmin, Message: "Only group admins can modify group members."}
+		return nil, false
+	}
+
+	return g, true
+}
+
+// groupMember returns the index of the user in the group member list, or -1 if the user is not a member.
+func groupMember(g *models.Group, userID string) int {
+	for i, m := range g.Members {
+		if m.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// addGroupMembers adds the given users to the group as regular members, skipping the existing members.
+// Users who blocked the adding user, or whom the adding user blocked, are skipped too.
+// If any of the users does not exist, an error response is set, false is returned, and the group is left as is.
+func addGroupMembers(ctx *neptulon.ReqCtx, db data.DB, adderID string, g *models.Group, userIDs []string) (bool, error) {
+	for _, id := range userIDs {
+		if _, ok := db.GetByID(id); !ok {
+			ctx.Err = &neptulon.ResError{Code: errGroupBadRequest, Message: "Unknown user: " + id}
+			return false, nil
+		}
+	}
+
+	for _, id := range userIDs {
+		if groupMember(g, id) != -1 {
+			continue
+		}
+		blocked, err := blockedPair(db, adderID, id)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve blocked users: %v", err)
+		}
+		if !blocked {
+			g.Members = append(g.Members, models.GroupMember{UserID: id, Role: models.GroupRoleMember})
+		}
+	}
+	return true, nil
+}
+
+// removeGroupMember removes the user from the group, promoting the longest standing member to admin if there are no admins left.
+func removeGroupMember(g *models.Group, userID string) {
+	i := groupMember(g, userID)
+	if i == -1 {
+		return
+	}
+	g.Members = append(g.Members[:i], g.Members[i+1:]...)
+
+	for _, m := range g.Members {
+		if m.Role == models.GroupRoleAdmin {
+			return
+		}
+	}
+	if len(g.Members) != 0 {
+		g.Members[0].Role = models.GroupRoleAdmin
+	}
+}
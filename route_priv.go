@@ -1,8 +1,11 @@
 package titan
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/neptulon/neptulon"
 	"github.com/neptulon/neptulon/middleware"
@@ -11,60 +14,568 @@ import (
 	"github.com/titan-x/titan/models"
 )
 
-// We need *data.Queue (pointer to interface) so that the closure below won't capture the actual value that pointer points to
-// so we can swap queues whenever we want using Server.SetQueue(...)
-func initPrivRoutes(r *middleware.Router, q *data.Queue) {
-	r.Request("auth.jwt", initJWTAuthHandler())
+// Error codes returned by msg.send for requests that exceed the message limits. Error data is a models.LimitError.
+const (
+	errMsgBatchTooLarge   = 7001 // Request has more messages than the maximum batch size.
+	errMsgRequestTooLarge = 7002 // Request parameters exceed the maximum request size.
+)
+
+// Error codes returned by presence.subscribe. Error data is a models.LimitError.
+const (
+	errPresenceTooManyUsers = 8001 // Request has more user IDs than the maximum number of presence subscriptions.
+)
+
+// maximum number of users that a user can subscribe to the presence of
+const presenceMaxUsers = 1000
+
+const (
+	historyLimitDefault = 50  // default number of messages in a msg.history page
+	historyLimitMax     = 100 // maximum number of messages in a msg.history page
+)
+
+// We need *data.Queue and *data.DB (pointer to interface) so that the closure below won't capture the actual value that pointer points to
+// so we can swap queues and databases whenever we want using Server.SetQueue(...) and Server.SetDB(...)
+func initPrivRoutes(r *middleware.Router, q *data.Queue, db *data.DB, p *presence, ms *msgSender, b *botRegistry) {
+	r.Request("auth.jwt", initJWTAuthHandler(db, Conf.Lookup.Pepper))
 	r.Request("echo", middleware.Echo)
-	r.Request("msg.send", initSendMsgHandler(q))
+	r.Request("msg.send", initSendMsgHandler(ms))
+	r.Request("msg.read", initReadMsgHandler(q, db, b, ms.msgTTL))
+	r.Request("msg.history", initHistoryHandler(db, b))
+	r.Request("presence.subscribe", initPresenceSubscribeHandler(db, p))
+	r.Request("signal.send", initSendSignalHandler(db, p))
+	initGroupRoutes(r, db)
+	initPushRoutes(r, db, Conf.WebPush.Insecure)
+	initDeviceRoutes(r, q, db)
+	initBotRoutes(r, b)
+	initContactRoutes(r, db, p)
+	initUserRoutes(r, db, Conf.Lookup)
+}
+
+// ignoreRes is a response handler for the requests that does not need any action upon response.
+func ignoreRes(ctx *neptulon.ResCtx) error {
+	return nil
 }
 
 // Used for a client to authenticate and announce its presence.
 // If there are any messages meant for this user, they are started to be sent after this call.
-func initJWTAuthHandler() func(ctx *neptulon.ReqCtx) error {
+func initJWTAuthHandler(db *data.DB, pepper string) func(ctx *neptulon.ReqCtx) error {
 	return func(ctx *neptulon.ReqCtx) error {
+		uid := ctx.Conn.Session.Get("userid").(string)
+
+		if u, ok := (*db).GetByID(uid); ok {
+			if err := updateLookupHashes(*db, u, pepper); err != nil {
+				return fmt.Errorf("route: auth.jwt: failed to update lookup hashes: %v", err)
+			}
+		}
+
+		// sync read markers set by the user's other sessions
+		// markers are sent directly on the connection rather than queued, as they are sent again upon each connection anyway
+		ms, err := (*db).GetReadMarkers(uid)
+		if err != nil {
+			return fmt.Errorf("route: auth.jwt: failed to retrieve read markers: %v", err)
+		}
+		if len(ms) != 0 {
+			if _, err := ctx.Conn.SendRequest("msg.read", ms, ignoreRes); err != nil {
+				return fmt.Errorf("route: auth.jwt: failed to send read markers: %v", err)
+			}
+		}
+
+		if err := touchDevice(*db, ctx); err != nil {
+			return fmt.Errorf("route: auth.jwt: failed to update device: %v", err)
+		}
+
 		// todo: this could rather send the remaining queue size for the client so client can disconnect if there is nothing else to do
 		ctx.Res = client.ACK
 		return ctx.Next()
 	}
 }
 
-// Allows clients to send messages to each other, online or offline.
-func initSendMsgHandler(q *data.Queue) func(ctx *neptulon.ReqCtx) error {
+// Allows clients to send messages to each other or to groups, online or offline.
+// Response is the result of each message in the same order, so clients can retry only the ones that failed.
+func initSendMsgHandler(s *msgSender) func(ctx *neptulon.ReqCtx) error {
 	return func(ctx *neptulon.ReqCtx) error {
+		var raw json.RawMessage
+		if err := ctx.Params(&raw); err != nil {
+			return err
+		}
+		if len(raw) > s.limits.MaxRequestSize {
+			ctx.Err = &neptulon.ResError{
+				Code:    errMsgRequestTooLarge,
+				Message: fmt.Sprintf("Request exceeds the maximum size of %v bytes.", s.limits.MaxRequestSize),
+				Data:    models.LimitError{Limit: models.LimitRequestSize, Max: s.limits.MaxRequestSize},
+			}
+			return nil
+		}
+
 		var sMsgs []models.Message
-		if err := ctx.Params(&sMsgs); err != nil {
+		if err := json.Unmarshal(raw, &sMsgs); err != nil {
+			return fmt.Errorf("route: msg.send: cannot deserialize request params: %v", err)
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+		res, resErr := s.send(uid, sMsgs)
+		if resErr != nil {
+			ctx.Err = resErr
+			return nil
+		}
+
+		ctx.Res = res
+		return ctx.Next()
+	}
+}
+
+// msgSender handles the messages sent by users, regardless of the transport they arrive through (i.e. msg.send requests over WebSocket or upstream GCM messages).
+// Messages are stored in the message history, and the ones that are not delivered within their time-to-live (msgTTL by default) expire.
+// Offline recipients are sent push notifications to wake up their devices.
+type msgSender struct {
+	q      *data.Queue
+	db     *data.DB
+	pu     *push
+	msgTTL time.Duration
+	limits Msg
+	bots   *botRegistry
+	ids    *msgIDCache
+	rate   *rateLimiter
+}
+
+func newMsgSender(q *data.Queue, db *data.DB, pu *push, msgTTL time.Duration, limits Msg, bots *botRegistry) *msgSender {
+	return &msgSender{
+		q:      q,
+		db:     db,
+		pu:     pu,
+		bots:   bots,
+		msgTTL: msgTTL,
+		limits: limits,
+		ids:    newMsgIDCache(msgKeyTTL),
+		rate:   newRateLimiter(limits.RateLimit, time.Minute),
+	}
+}
+
+// send stores and queues a batch of messages sent by the user, and returns the result of each message.
+// If the batch as a whole exceeds the limits, nothing is queued and an error response for the user is returned instead.
+func (s *msgSender) send(uid string, sMsgs []models.Message) ([]models.SendResult, *neptulon.ResError) {
+	if len(sMsgs) > s.limits.MaxBatchSize {
+		return nil, &neptulon.ResError{
+			Code:    errMsgBatchTooLarge,
+			Message: fmt.Sprintf("Request exceeds the maximum batch size of %v messages.", s.limits.MaxBatchSize),
+			Data:    models.LimitError{Limit: models.LimitBatchSize, Max: s.limits.MaxBatchSize},
+		}
+	}
+
+	res := make([]models.SendResult, len(sMsgs))
+	groups := make(map[string]*models.Group)
+	for i, sMsg := range sMsgs {
+		res[i] = s.sendOne(uid, sMsg, groups)
+	}
+	return res, nil
+}
+
+// sendOne stores and queues a single message, using and populating the given cache of the groups resolved so far.
+func (s *msgSender) sendOne(uid string, sMsg models.Message, groups map[string]*models.Group) models.SendResult {
+	if len(sMsg.Message) > s.limits.MaxBodySize {
+		return models.SendResult{Status: models.SendTooLarge}
+	}
+
+	var g *models.Group
+	var dropped bool
+	if sMsg.Group != "" {
+		if g = groups[sMsg.Group]; g == nil {
+			var ok bool
+			if g, ok = (*s.db).GetGroup(sMsg.Group); !ok || groupMember(g, uid) == -1 {
+				return models.SendResult{Status: models.SendUnknownRecipient}
+			}
+			groups[sMsg.Group] = g
+		}
+	} else {
+		to, ok := s.recipient(sMsg.To)
+		if !ok {
+			return models.SendResult{Status: models.SendUnknownRecipient}
+		}
+		sMsg.To = to
+
+		// users cannot message the users they blocked, and the messages to the users who blocked them are dropped
+		if _, bot := s.bots.get(to); !bot {
+			blocked, err := (*s.db).IsBlocked(uid, to)
+			if err == nil && !blocked {
+				dropped, err = (*s.db).IsBlocked(to, uid)
+			}
+			if err != nil {
+				log.Printf("route: msg.send: failed to retrieve blocked users: %v", err)
+				return models.SendResult{Status: models.SendFailed}
+			}
+			if blocked {
+				return models.SendResult{Status: models.SendBlocked}
+			}
+		}
+	}
+
+	id, err := newMsgID(uid, sMsg.Key)
+	if err != nil {
+		log.Printf("route: msg.send: failed to generate message ID: %v", err)
+		return models.SendResult{Status: models.SendFailed}
+	}
+
+	// suppress the duplicates of the messages that were already sent, if client is retrying
+	if sMsg.Key != "" && !s.ids.add(id) {
+		return models.SendResult{ID: id, Status: models.SendAccepted}
+	}
+
+	if !s.rate.allow(uid) {
+		s.ids.remove(id)
+		return models.SendResult{Status: models.SendRateLimited}
+	}
+
+	// dropped messages look just like the accepted ones, so the sender cannot tell that they are blocked
+	if err := s.queue(uid, sMsg, id, g, dropped); err != nil {
+		log.Printf("route: msg.send: %v", err)
+		s.ids.remove(id)
+		return models.SendResult{Status: models.SendFailed}
+	}
+	return models.SendResult{ID: id, Status: models.SendAccepted}
+}
+
+// recipient resolves the recipient of a message, given as a bot ID, a user ID or an e-mail address, to a bot or user ID.
+// Bot IDs and e-mail addresses are case-insensitive, while user IDs are case-sensitive as generated IDs are mixed case.
+// Returns false if there is no such bot or user.
+func (s *msgSender) recipient(to string) (string, bool) {
+	if to == "" {
+		return "", false
+	}
+
+	lto := strings.ToLower(to)
+	if _, ok := s.bots.get(lto); ok {
+		return lto, true
+	}
+
+	getUser := (*s.db).GetByID
+	if strings.Contains(to, "@") {
+		getUser, to = (*s.db).GetByEmail, lto
+	}
+	u, ok := getUser(to)
+	if !ok {
+		return "", false
+	}
+	return u.ID, true
+}
+
+// queue stores a message with the given ID and queues it to be delivered to its recipients.
+// Recipient of the message should already be resolved to a user ID.
+// Dropped messages are only stored in the history of the sender, and never delivered.
+func (s *msgSender) queue(uid string, sMsg models.Message, id string, g *models.Group, dropped bool) error {
+	// message time is always set by the server, as it orders the history and read markers
+	m := models.Message{ID: id, From: uid, To: sMsg.To, Group: sMsg.Group, Time: time.Now(), Message: sMsg.Message}
+	if m.Group != "" {
+		m.To = ""
+	}
+
+	if dropped {
+		if err := (*s.db).SaveDroppedMessage(&m); err != nil {
+			return fmt.Errorf("failed to save dropped message: %v", err)
+		}
+		return nil
+	}
+
+	if err := (*s.db).SaveMessage(&m); err != nil {
+		return fmt.Errorf("failed to save message: %v", err)
+	}
+
+	// client supplied time-to-live can only shorten the default one, which also keeps the duration from overflowing
+	ttl := s.msgTTL
+	if sMsg.TTL > 0 && int64(sMsg.TTL) < int64(s.msgTTL/time.Second) {
+		ttl = time.Duration(sMsg.TTL) * time.Second
+	}
+	expires := time.Now().Add(ttl)
+
+	// fan out group messages to all the members except the sender, skipping the members who blocked the sender or whom the sender blocked
+	if g != nil {
+		for _, gm := range g.Members {
+			if gm.UserID == uid {
+				continue
+			}
+			if blocked, err := blockedPair(*s.db, uid, gm.UserID); err != nil {
+				log.Printf("route: msg.send: failed to retrieve blocked users, skipping group member %v: %v", gm.UserID, err)
+				continue
+			} else if blocked {
+				continue
+			}
+			if err := s.queueMsg(gm.UserID, m, expires, false); err != nil {
+				return err
+			}
+			s.pu.notify(gm.UserID, m, expires)
+		}
+		return nil
+	}
+
+	if b, ok := s.bots.get(m.To); ok {
+		s.sendToBot(b, m, expires)
+		return nil
+	}
+
+	if err := s.queueMsg(m.To, m, expires, false); err != nil {
+		return err
+	}
+	s.pu.notify(m.To, m, expires)
+	return nil
+}
+
+// queueMsg queues a message to be delivered to the given recipient.
+// Sender is notified when the message is delivered, or if the message cannot be delivered. Bots are not notified.
+func (s *msgSender) queueMsg(to string, m models.Message, expires time.Time, bot bool) error {
+	from := m.From
+	rMsg := models.Message{ID: m.ID, From: m.From, Group: m.Group, Time: m.Time, Message: m.Message}
+
+	resHandler := func(ctx *neptulon.ResCtx) error {
+		if bot {
+			return nil
+		}
+
+		// failed delivery attempts are retried by the queue
+		var res string
+		ctx.Result(&res)
+		if res != client.ACK {
+			return nil
+		}
+
+		// let the sender know that the message was delivered (as soon as they are online, if not already)
+		d := []models.Delivery{models.Delivery{ID: m.ID, To: to, Group: m.Group, Time: m.Time, Delivered: time.Now()}}
+		return queueNotice(s.q, from, "msg.delivered", d, s.msgTTL)
+	}
+
+	// queue gave up on delivering the message, or the message expired, so let the sender know
+	failHandler := func(reason string) error {
+		if bot {
+			return nil
+		}
+		f := []models.Failure{models.Failure{ID: m.ID, To: to, Group: m.Group, Time: m.Time, Reason: reason}}
+		return queueNotice(s.q, from, "msg.failed", f, s.msgTTL)
+	}
+
+	err := (*s.q).AddExpiringRequest(to, "msg.recv", []models.Message{rMsg}, expires, resHandler, failHandler)
+
+	if err != nil {
+		return fmt.Errorf("route: msg.recv: failed to add request to queue with error: %v", err)
+	}
+	return nil
+}
+
+// queueNotice queues a notice about a message (i.e. a receipt or a failure notice) to be sent to the given user.
+// Notices expire just like messages, so they do not pile up for the users who never come back.
+func queueNotice(q *data.Queue, to, method string, params interface{}, ttl time.Duration) error {
+	if err := (*q).AddExpiringRequest(to, method, params, time.Now().Add(ttl), ignoreRes, nil); err != nil {
+		return fmt.Errorf("route: %v: failed to add request to queue with error: %v", method, err)
+	}
+	return nil
+}
+
+// Allows clients to mark the messages in a conversation as read, up to a given point.
+// The other party of the conversation is notified, and the marker is stored so that user's other sessions can sync it.
+func initReadMsgHandler(q *data.Queue, db *data.DB, b *botRegistry, ttl time.Duration) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var rms []models.ReadMarker
+		if err := ctx.Params(&rms); err != nil {
 			return err
 		}
 
 		uid := ctx.Conn.Session.Get("userid").(string)
 
-		for _, sMsg := range sMsgs {
-			from := uid
-			to := strings.ToLower(sMsg.To)
-
-			// handle messages to bots
-			if to == "echo" {
-				from = "echo"
-				to = uid
-			}
-
-			// submit the messages to send queue
-			err := (*q).AddRequest(to, "msg.recv", []models.Message{models.Message{From: from, Message: sMsg.Message}}, func(ctx *neptulon.ResCtx) error {
-				var res string
-				ctx.Result(&res)
-				if res == client.ACK {
-					// todo: send 'delivered' message to sender (as a request?) about this message (or failed, depending on output)
-					// todo: q.AddRequest(uid, "msg.delivered", ... // requeue if failed or handle resends automatically in the queue type, which is prefered)
-				} else {
-					// todo: auto retry or "msg.failed" ?
-				}
+		ms, err := (*db).GetReadMarkers(uid)
+		if err != nil {
+			return fmt.Errorf("route: msg.read: failed to retrieve read markers: %v", err)
+		}
+		last := make(map[string]time.Time)
+		for _, m := range ms {
+			last[m.Peer] = m.Time
+		}
+
+		for _, rm := range rms {
+			rm.From = uid
+
+			// peer should be a bot or an existing user, and markers of unknown peers are dropped
+			// bot IDs are case-insensitive while user IDs are not
+			_, bot := b.get(rm.Peer)
+			if bot {
+				rm.Peer = strings.ToLower(rm.Peer)
+			} else if _, ok := (*db).GetByID(rm.Peer); !ok {
+				continue
+			}
+
+			// read markers can only move forward
+			if t, ok := last[rm.Peer]; ok && !rm.Time.After(t) {
+				continue
+			}
+			last[rm.Peer] = rm.Time
+
+			if err := (*db).SaveReadMarker(&rm); err != nil {
+				return fmt.Errorf("route: msg.read: failed to save read marker: %v", err)
+			}
+
+			// bots are not interested in read receipts, and the users who blocked the reader (or whom the reader blocked) are not sent any
+			if bot {
+				continue
+			}
+			if blocked, err := blockedPair(*db, uid, rm.Peer); err != nil {
+				return fmt.Errorf("route: msg.read: failed to retrieve blocked users: %v", err)
+			} else if blocked {
+				continue
+			}
+
+			if err := queueNotice(q, rm.Peer, "msg.read", []models.ReadMarker{rm}, ttl); err != nil {
+				return err
+			}
+		}
+
+		ctx.Res = client.ACK
+		return ctx.Next()
+	}
+}
+
+// Allows clients to retrieve the message history of a conversation, one page at a time going backwards.
+func initHistoryHandler(db *data.DB, b *botRegistry) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var hq models.HistoryQuery
+		if err := ctx.Params(&hq); err != nil {
+			return err
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+
+		limit := hq.Limit
+		if limit <= 0 {
+			limit = historyLimitDefault
+		} else if limit > historyLimitMax {
+			limit = historyLimitMax
+		}
+
+		var ms []models.Message
+		var cursor string
+		var err error
+		if hq.Group != "" {
+			g, ok := (*db).GetGroup(hq.Group)
+			if !ok || groupMember(g, uid) == -1 {
+				ctx.Err = &neptulon.ResError{Code: errGroupNotFound, Message: "Group not found: " + hq.Group}
 				return nil
-			})
+			}
+			ms, cursor, err = (*db).GetGroupMessages(hq.Group, hq.Cursor, limit)
+		} else {
+			ms, cursor, err = (*db).GetMessages(uid, b.peerID(hq.Peer), hq.Cursor, limit)
+		}
+		if err != nil {
+			return fmt.Errorf("route: msg.history: failed to retrieve messages: %v", err)
+		}
+
+		ctx.Res = models.History{Messages: ms, Cursor: cursor}
+		return ctx.Next()
+	}
+}
 
+// Allows clients to subscribe to the presence of their contacts, replacing any previous subscriptions of the user.
+// Current presence state of the contacts is returned, and presence.update requests are sent whenever a contact comes online or goes offline.
+// Subscriptions last until the user goes offline. Users can only see the presence of the users who have them in their contact list.
+// Other users, along with the ones who blocked the subscriber, always look offline to them, and are not subscribed to.
+func initPresenceSubscribeHandler(db *data.DB, p *presence) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var ids []string
+		if err := ctx.Params(&ids); err != nil {
+			return err
+		}
+
+		if len(ids) > presenceMaxUsers {
+			ctx.Err = &neptulon.ResError{
+				Code:    errPresenceTooManyUsers,
+				Message: fmt.Sprintf("Request exceeds the maximum of %v presence subscriptions.", presenceMaxUsers),
+				Data:    models.LimitError{Limit: models.LimitBatchSize, Max: presenceMaxUsers},
+			}
+			return nil
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+		var subIDs []string
+		hidden := make(map[string]bool)
+		for i := range ids {
+			visible, err := presenceVisible(*db, ids[i], uid)
 			if err != nil {
-				return fmt.Errorf("route: msg.recv: failed to add request to queue with error: %v", err)
+				return fmt.Errorf("route: presence.subscribe: %v", err)
+			}
+			if !visible {
+				hidden[ids[i]] = true
+				continue
+			}
+			subIDs = append(subIDs, ids[i])
+		}
+
+		// keep the states in the requested order
+		ps := []models.Presence{}
+		subPs := p.subscribe(uid, subIDs)
+		for _, id := range ids {
+			if hidden[id] {
+				ps = append(ps, models.Presence{UserID: id})
+				continue
+			}
+			ps = append(ps, subPs[0])
+			subPs = subPs[1:]
+		}
+
+		ctx.Res = ps
+		return ctx.Next()
+	}
+}
+
+// presenceVisible tells whether the user lets the subscriber see their presence, by having them in their contact list without blocking them.
+func presenceVisible(db data.DB, userID, subscriberID string) (bool, error) {
+	ok, err := db.IsContact(userID, subscriberID)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve contacts: %v", err)
+	}
+	if !ok {
+		return false, nil
+	}
+	blocked, err := db.IsBlocked(userID, subscriberID)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve blocked users: %v", err)
+	}
+	return !blocked, nil
+}
+
+// Allows clients to send ephemeral signals (i.e. typing indicators) to users or groups.
+// Signals are only delivered to the recipients that are online, as signal.recv requests, and are dropped otherwise.
+func initSendSignalHandler(db *data.DB, p *presence) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var sigs []models.Signal
+		if err := ctx.Params(&sigs); err != nil {
+			return err
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+
+		for _, sig := range sigs {
+			// signal types that we don't know of are dropped
+			if sig.Type != models.SignalTypingStart && sig.Type != models.SignalTypingStop {
+				continue
+			}
+
+			rSig := []models.Signal{models.Signal{From: uid, Group: sig.Group, Type: sig.Type}}
+
+			if sig.Group != "" {
+				g, ok := (*db).GetGroup(sig.Group)
+				if !ok || groupMember(g, uid) == -1 {
+					continue
+				}
+				for _, m := range g.Members {
+					if m.UserID == uid {
+						continue
+					}
+					if blocked, err := blockedPair(*db, uid, m.UserID); err != nil || blocked {
+						continue
+					}
+					p.send(m.UserID, "signal.recv", rSig)
+				}
+				continue
+			}
+
+			if blocked, err := (*db).IsBlocked(sig.To, uid); err != nil || blocked {
+				continue
 			}
+			p.send(sig.To, "signal.recv", rSig)
 		}
 
 		ctx.Res = client.ACK
@@ -10,13 +10,13 @@ import (
 // so we can swap databases whenever we want using Server.SetDB(...)
 //
 // Also we don't do `return ctx.Next()` so that request won't reach the private routes.
-func initPubRoutes(r *middleware.Router, db *data.DB, pass string) {
-	r.Request("auth.google", initGoogleAuthHandler(db, pass))
+func initPubRoutes(r *middleware.Router, db *data.DB, pass, pepper string) {
+	r.Request("auth.google", initGoogleAuthHandler(db, pass, pepper))
 }
 
-func initGoogleAuthHandler(db *data.DB, pass string) func(ctx *neptulon.ReqCtx) error {
+func initGoogleAuthHandler(db *data.DB, pass, pepper string) func(ctx *neptulon.ReqCtx) error {
 	return func(ctx *neptulon.ReqCtx) error {
-		if err := googleAuth(ctx, *db, pass); err != nil {
+		if err := googleAuth(ctx, *db, pass, pepper); err != nil {
 			return err
 		}
 
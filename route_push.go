@@ -0,0 +1,88 @@
+package titan
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// Error codes returned by the push routes.
+const (
+	errPushBadRequest = 3001 // Subscription is missing or invalid.
+)
+
+// maximum number of Web Push subscriptions (browsers) per user, after which the oldest ones are dropped
+const webPushMaxSubs = 10
+
+func initPushRoutes(r *middleware.Router, db *data.DB, insecure bool) {
+	r.Request("push.subscribe", initPushSubscribeHandler(db, insecure))
+	r.Request("push.unsubscribe", initPushUnsubscribeHandler(db))
+}
+
+// Allows browsers to subscribe to Web Push messages, which are sent when the user is offline.
+// Params is the JSON serialization of a browser PushSubscription object. Subscribing again with the same endpoint updates the keys.
+// Insecure flag allows plain HTTP and local network endpoints, which is only meant for testing.
+func initPushSubscribeHandler(db *data.DB, insecure bool) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var sub models.WebPushSubscription
+		if err := ctx.Params(&sub); err != nil {
+			return err
+		}
+
+		if msg := validateWebPushSub(sub, insecure); msg != "" {
+			ctx.Err = &neptulon.ResError{Code: errPushBadRequest, Message: msg}
+			return nil
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+		if err := (*db).AddWebPushSub(uid, sub, webPushMaxSubs); err != nil {
+			return fmt.Errorf("route: push.subscribe: failed to add subscription: %v", err)
+		}
+
+		ctx.Res = client.ACK
+		return ctx.Next()
+	}
+}
+
+// Allows browsers to remove their Web Push subscriptions, given the endpoint of the subscription.
+func initPushUnsubscribeHandler(db *data.DB) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var sub models.WebPushSubscription
+		if err := ctx.Params(&sub); err != nil {
+			return err
+		}
+
+		uid := ctx.Conn.Session.Get("userid").(string)
+		if err := (*db).RemoveWebPushSub(uid, sub.Endpoint); err != nil {
+			return fmt.Errorf("route: push.unsubscribe: failed to remove subscription: %v", err)
+		}
+
+		ctx.Res = client.ACK
+		return ctx.Next()
+	}
+}
+
+// validateWebPushSub checks that the subscription has an HTTPS endpoint on a public host along with valid encryption keys,
+// as the server would otherwise make requests to internal services on behalf of the clients.
+// Returns a message describing the problem if the subscription is invalid.
+func validateWebPushSub(sub models.WebPushSubscription, insecure bool) string {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(insecure && u.Scheme == "http")) {
+		return "Subscription endpoint should be an HTTPS URL."
+	}
+	if !insecure && !webPushPublicHost(u.Host) {
+		return "Subscription endpoint should be on a public host."
+	}
+	if k, err := webPushDecode(sub.Keys.P256dh); err != nil || len(k) != 65 || k[0] != 4 {
+		return "Subscription p256dh key should be a base64url encoded uncompressed P-256 public key."
+	}
+	if k, err := webPushDecode(sub.Keys.Auth); err != nil || len(k) != 16 {
+		return "Subscription auth secret should be a base64url encoded 16 byte value."
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package titan
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/neptulon/neptulon"
+	"github.com/neptulon/neptulon/middleware"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// Error codes returned by users.lookup for requests that exceed the lookup limits. Error data is a models.LimitError.
+const (
+	errLookupBatchTooLarge = 6001 // Request has more hashes than the maximum batch size.
+	errLookupRateLimited   = 6002 // User is looking up too many hashes, so the request should be retried later.
+)
+
+// Period that the users.lookup rate limit applies to (see models.LimitRate).
+const lookupRateWindow = 24 * time.Hour
+
+func initUserRoutes(r *middleware.Router, db *data.DB, limits Lookup) {
+	r.Request("users.lookup", initLookupUsersHandler(db, limits, newRateLimiter(limits.RateLimit, lookupRateWindow)))
+}
+
+// updateLookupHashes stores the lookup keys of the user peppered with the current server secret, if they are missing or stale
+// (i.e. the e-mail address or phone number has changed, or the pepper is new). Users are re-hashed upon each login, so that
+// the users saved before the pepper was set or changed become discoverable again once they log in.
+func updateLookupHashes(db data.DB, u *models.User, pepper string) error {
+	// retrieved user objects can be shared so modify a copy
+	uc := *u
+	if !uc.SetLookupHashes(pepper) {
+		return nil
+	}
+	return db.SaveUser(&uc)
+}
+
+// Allows clients to discover which of their contacts are Titan users, without sending their contacts' e-mail addresses or phone numbers to the server.
+// Params are the hashes of the normalized e-mail addresses and E.164 phone numbers (see models.HashEmail and models.HashPhoneNumber).
+// Response has the matching users only. Users who blocked the requesting user are found like any others, so that lookups do not reveal blocks.
+func initLookupUsersHandler(db *data.DB, limits Lookup, rate *rateLimiter) func(ctx *neptulon.ReqCtx) error {
+	return func(ctx *neptulon.ReqCtx) error {
+		var hashes []string
+		if err := ctx.Params(&hashes); err != nil {
+			return err
+		}
+
+		if len(hashes) > limits.MaxBatchSize {
+			ctx.Err = &neptulon.ResError{
+				Code:    errLookupBatchTooLarge,
+				Message: fmt.Sprintf("Request exceeds the maximum batch size of %v hashes.", limits.MaxBatchSize),
+				Data:    models.LimitError{Limit: models.LimitBatchSize, Max: limits.MaxBatchSize},
+			}
+			return nil
+		}
+
+		if !rate.allowN(ctx.Conn.Session.Get("userid").(string), len(hashes)) {
+			ctx.Err = &neptulon.ResError{
+				Code:    errLookupRateLimited,
+				Message: fmt.Sprintf("Request exceeds the rate limit of %v hashes per day.", limits.RateLimit),
+				Data:    models.LimitError{Limit: models.LimitRate, Max: limits.RateLimit},
+			}
+			return nil
+		}
+
+		res := []models.LookupResult{}
+		seen := make(map[string]bool)
+		for _, h := range hashes {
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+
+			u, ok := (*db).GetByContactHash(models.PepperHash(limits.Pepper, h))
+			if !ok {
+				continue
+			}
+			res = append(res, models.LookupResult{Hash: h, ID: u.ID, Name: u.Name, Picture: u.Picture})
+		}
+
+		ctx.Res = res
+		return ctx.Next()
+	}
+}
@@ -1,9 +1,11 @@
 package titan
 
 import (
+	"log"
+	"time"
+
 	"github.com/neptulon/neptulon"
 	"github.com/neptulon/neptulon/middleware"
-	"github.com/neptulon/neptulon/middleware/jwt"
 	"github.com/titan-x/titan/data"
 	"github.com/titan-x/titan/data/inmem"
 )
@@ -16,8 +18,11 @@ type Server struct {
 	privRouter *middleware.Router
 
 	// titan server components
-	db    data.DB
-	queue data.Queue
+	db       data.DB
+	queue    data.Queue
+	presence *presence
+	push     *push
+	bots     *botRegistry
 }
 
 // NewServer creates a new server.
@@ -27,6 +32,39 @@ func NewServer(addr string) (*Server, error) {
 	}
 
 	s := Server{neptulon: neptulon.NewServer(addr)}
+	s.presence = newPresence(s.neptulon.SendRequest)
+	s.push = newPush(&s.db, s.presence)
+	s.bots = newBotRegistry()
+	if err := s.bots.add(echoBot{}); err != nil {
+		return nil, err
+	}
+	ws, err := Conf.Bots.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range ws {
+		if err := s.bots.add(newWebhookBot(w, Conf.Bots.WebhookTimeout, Conf.Bots.WebhookMaxAttempts, Conf.Queue.RetryBackoff)); err != nil {
+			return nil, err
+		}
+	}
+	ms := newMsgSender(&s.queue, &s.db, s.push, Conf.Queue.MessageTTL, Conf.Msg, s.bots)
+	if Conf.GCM.CCSHost != "" && Conf.GCM.SenderID != "" {
+		s.push.gcm = newGCMClient(Conf.GCM.CCSHost, Conf.GCM.SenderID, Conf.GCM.APIKey(), Conf.App.Debug, gcmUpstreamHandler(&s.db, ms), s.push.removeGCMRegID)
+	}
+	if Conf.APNS.Topic != "" {
+		a, err := newAPNSClientFromConf(Conf.APNS)
+		if err != nil {
+			return nil, err
+		}
+		s.push.apns = a
+	}
+	if Conf.WebPush.VAPIDPrivateKey != "" {
+		w, err := newWebPushClient(Conf.WebPush.Subject, Conf.WebPush.VAPIDPrivateKey, Conf.WebPush.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		s.push.webPush = w
+	}
 
 	if err := s.SetDB(inmem.NewDB()); err != nil {
 		return nil, err
@@ -38,20 +76,22 @@ func NewServer(addr string) (*Server, error) {
 	s.neptulon.MiddlewareFunc(middleware.Logger)
 	s.pubRouter = middleware.NewRouter()
 	s.neptulon.Middleware(s.pubRouter)
-	initPubRoutes(s.pubRouter, &s.db, Conf.App.JWTPass())
+	initPubRoutes(s.pubRouter, &s.db, Conf.App.JWTPass(), Conf.Lookup.Pepper)
 
 	//all communication below this point is authenticated
-	s.neptulon.MiddlewareFunc(jwt.HMAC(Conf.App.JWTPass()))
-	s.neptulon.Middleware(s.queue)
+	s.neptulon.MiddlewareFunc(jwtAuth(Conf.App.JWTPass()))
+	s.neptulon.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error { return s.queue.Middleware(ctx) }) // resolve queue on each call so SetQueue can swap it
+	s.neptulon.MiddlewareFunc(s.presence.Middleware)
 	s.privRouter = middleware.NewRouter()
 	s.neptulon.Middleware(s.privRouter)
-	initPrivRoutes(s.privRouter, &s.queue)
+	initPrivRoutes(s.privRouter, &s.queue, &s.db, s.presence, ms, s.bots)
 	// todo: r.Middleware(NotFoundHandler()) - 404-like handler, if any request reaches this point without being handled
 
 	s.neptulon.DisconnHandler(func(c *neptulon.Conn) {
 		// only handle this event for previously authenticated
 		if id, ok := c.Session.GetOk("userid"); ok {
-			s.queue.RemoveConn(id.(string))
+			s.queue.RemoveConn(id.(string), c.ID)
+			s.presence.removeConn(id.(string), c.ID)
 		}
 	})
 
@@ -68,19 +108,64 @@ func (s *Server) SetDB(db data.DB) error {
 	return nil
 }
 
+// RegisterBot registers a bot that users can send messages to, by the ID in the bot metadata.
+// Bot IDs are case-insensitive, and they take precedence over user IDs. An echo bot with the ID "echo" is registered by default.
+func (s *Server) RegisterBot(b Bot) error {
+	return s.bots.add(b)
+}
+
 // SetQueue sets the queue implementation to be used by the server. If not supplied, in-memory queue implementation is used.
+// Queue settings in Config.Queue are applied to the queue, if the queue implementation supports them.
 func (s *Server) SetQueue(queue data.Queue) error {
+	if q, ok := queue.(queueSettings); ok {
+		q.SetAckTimeout(Conf.Queue.AckTimeout)
+		q.SetRetryPolicy(Conf.Queue.MaxAttempts, Conf.Queue.RetryBackoff)
+		q.SetDeviceTTL(Conf.Queue.DeviceTTL)
+	}
+
 	s.queue = queue
 	return nil
 }
 
-// ListenAndServe starts the Titan server. This function blocks until server is closed.
+// queueSettings is implemented by the queues that take the delivery settings in Config.Queue (i.e. inmem.Queue and diskqueue.Queue).
+type queueSettings interface {
+	SetAckTimeout(d time.Duration)
+	SetRetryPolicy(maxAttempts int, backoff time.Duration)
+	SetDeviceTTL(d time.Duration)
+}
+
+// DeadLetters returns the dead-letter store of the queue in use, if the queue implementation has one.
+// Dead-letters are the requests that could not be delivered to users within the retry budget of the queue.
+func (s *Server) DeadLetters() (data.DeadLetterStore, bool) {
+	dl, ok := s.queue.(data.DeadLetterStore)
+	return dl, ok
+}
+
+// SendRequest sends a JSON-RPC request through the connection denoted by the connection ID.
+// This is meant to be used as the sender function of custom queue implementations.
+func (s *Server) SendRequest(connID string, method string, params interface{}, resHandler func(ctx *neptulon.ResCtx) error) (reqID string, err error) {
+	return s.neptulon.SendRequest(connID, method, params, resHandler)
+}
+
+// SendEphemeral sends a request to all the connected sessions of a user, on a best-effort basis.
+// Unlike the requests sent through the queue, the request is dropped if the user is offline, and it is not redelivered if the client does not ACK it.
+// This is meant for events that are worthless if delayed, like typing indicators. Returns the number of sessions that the request was sent to.
+func (s *Server) SendEphemeral(userID, method string, params interface{}) int {
+	return s.presence.send(userID, method, params)
+}
+
+// ListenAndServe starts the Titan server, along with the GCM CCS connection if GCM is configured.
+// This function blocks until server is closed.
 func (s *Server) ListenAndServe() error {
+	s.push.start()
 	return s.neptulon.ListenAndServe()
 }
 
 // Close the server and all of the active connections, discarding any read/writes that is going on currently.
 // This is not a problem as we always require an ACK but it will also mean that message deliveries will be at-least-once; to-and-from the server.
 func (s *Server) Close() error {
+	if err := s.push.close(); err != nil {
+		log.Printf("server: failed to close push notification connections: %v", err)
+	}
 	return s.neptulon.Close()
 }
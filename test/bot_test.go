@@ -1,6 +1,10 @@
 package test
 
 import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/titan-x/titan/data"
@@ -26,3 +30,109 @@ func TestEchoBot(t *testing.T) {
 		t.Fatalf("expected message from: Ola!, got: %v", msg.Message)
 	}
 }
+
+// countBot replies with the number of words in each message, and fails on empty messages.
+type countBot struct{}
+
+func (countBot) Info() models.BotInfo {
+	return models.BotInfo{ID: "Count", Name: "Count", Description: "Counts words."}
+}
+
+func (countBot) Receive(m models.Message) ([]models.Message, error) {
+	n := len(strings.Fields(m.Message))
+	if n == 0 {
+		return nil, errors.New("nothing to count")
+	}
+	return []models.Message{models.Message{Message: m.Message}, models.Message{Message: strconv.Itoa(n)}}, nil
+}
+
+func TestCustomBot(t *testing.T) {
+	sh := NewServerHelper(t)
+	if err := sh.server.RegisterBot(countBot{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.server.RegisterBot(countBot{}); err == nil {
+		t.Fatal("expected duplicate bot registration to fail")
+	}
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+
+	ch := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch.CloseWait()
+
+	bs := ch.ListBotsSync()
+	if len(bs) != 2 || bs[0].ID != "Count" || bs[1].ID != "echo" || bs[1].Name == "" {
+		t.Fatalf("unexpected bots: %+v", bs)
+	}
+
+	// replies are delivered from the bot ID
+	ch.SendMessagesSync([]models.Message{models.Message{To: "count", Message: "one two three"}})
+	var got []string
+	for len(got) < 2 {
+		for _, m := range ch.GetMessagesWait() {
+			if m.From != "count" {
+				t.Fatalf("expected message from: count, got: %v", m.From)
+			}
+			got = append(got, m.Message)
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "3,one two three" {
+		t.Fatalf("unexpected replies: %v", got)
+	}
+
+	// bot failures are reported as delivery failures
+	res, _ := ch.TrySendMessagesSync([]models.Message{models.Message{To: "count", Message: " "}})
+	f := ch.GetFailuresWait()
+	if len(f) != 1 || f[0].ID != res[0].ID || f[0].To != "count" || f[0].Reason == "" {
+		t.Fatalf("expected a failure notice for the message, got: %+v", f)
+	}
+}
+
+// slowBot holds off the replies to user 1 until released, and replies to others right away.
+type slowBot struct {
+	release chan bool
+}
+
+func (slowBot) Info() models.BotInfo {
+	return models.BotInfo{ID: "slow", Name: "Slow", Description: "Takes its time with user 1."}
+}
+
+func (b slowBot) Receive(m models.Message) ([]models.Message, error) {
+	if m.From == "1" {
+		<-b.release
+	}
+	return []models.Message{models.Message{Message: m.Message}}, nil
+}
+
+func TestBotBacklog(t *testing.T) {
+	b := slowBot{release: make(chan bool)}
+	sh := NewServerHelper(t)
+	if err := sh.server.RegisterBot(b); err != nil {
+		t.Fatal(err)
+	}
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+	defer close(b.release)
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	// flood the bot while it is stuck on the first message, beyond what it is willing to hold for a single sender
+	var ms []models.Message
+	for i := 0; i < 60; i++ {
+		ms = append(ms, models.Message{To: "slow", Message: strconv.Itoa(i)})
+	}
+	ch1.SendMessagesSync(ms)
+	if f := ch1.GetFailuresWait(); len(f) == 0 || f[0].To != "slow" || f[0].Reason == "" {
+		t.Fatalf("expected failure notices for the overflowing messages, got: %+v", f)
+	}
+
+	// other senders are not held up by the slow conversation
+	ch2.SendMessagesSync([]models.Message{models.Message{To: "slow", Message: "hi"}})
+	if m := ch2.GetMessagesWait(); len(m) != 1 || m[0].From != "slow" || m[0].Message != "hi" {
+		t.Fatalf("expected a reply from the bot, got: %+v", m)
+	}
+}
@@ -0,0 +1,349 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-xmpp"
+	"github.com/soygul/gcm/ccs"
+)
+
+const (
+	ccsStreamHeader = "<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' id='%v' from='gcm.googleapis.com' version='1.0'>"
+	ccsAuthFeatures = "<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>"
+	ccsBindFeatures = "<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>"
+	ccsAuthSuccess  = "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>"
+	ccsBindResult   = "<iq type='result' id='%v'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>sender@gcm.googleapis.com/titan</jid></bind></iq>"
+	ccsMessage      = "<message><gcm xmlns='google:mobile:data'>%v</gcm></message>"
+)
+
+// CCSHelper is a fake GCM CCS server for testing.
+// It speaks just enough XMPP for a CCS client to connect, records all the downstream messages it receives,
+// and sends upstream and control messages over the latest connection.
+type CCSHelper struct {
+	Addr string // Listener address of the server in host:port format.
+
+	testing  *testing.T
+	listener net.Listener
+	msgChan  chan ccs.OutMsg
+	ackChan  chan string   // IDs of the upstream messages ACKed by the client
+	nackChan chan string   // NACK error codes to respond to the next downstream messages with
+	connChan chan *ccsConn // connections that completed the XMPP handshake
+	wg       sync.WaitGroup
+
+	mutex sync.Mutex
+	seq   int // last upstream message ID
+	conns []net.Conn
+	conn  *ccsConn // latest connection
+}
+
+// ccsConn is a client connection to the fake CCS server, which is written to by both the server and the test.
+type ccsConn struct {
+	net.Conn
+	mutex sync.Mutex
+}
+
+func (c *ccsConn) writeMsg(m interface{}) error {
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	xml.EscapeText(&b, j)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err = fmt.Fprintf(c, ccsMessage, b.String())
+	return err
+}
+
+// ccsStanza is an XMPP stanza sent by a CCS client.
+type ccsStanza struct {
+	XMLName xml.Name
+	ID      string `xml:"id,attr"`
+	Type    string `xml:"type,attr"`
+	GCM     string `xml:"gcm"`
+}
+
+// NewCCSHelper creates and starts a fake CCS server listening on a random local port, with a self-signed TLS certificate.
+func NewCCSHelper(t *testing.T) *CCSHelper {
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal("Failed to create TLS certificate for fake CCS server:", err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal("Failed to start fake CCS server:", err)
+	}
+
+	// certificate is self-signed
+	xmpp.DefaultConfig.InsecureSkipVerify = true
+
+	ch := &CCSHelper{
+		Addr:     l.Addr().String(),
+		testing:  t,
+		listener: l,
+		msgChan:  make(chan ccs.OutMsg, 5000),
+		ackChan:  make(chan string, 5000),
+		nackChan: make(chan string, 100),
+		connChan: make(chan *ccsConn, 100),
+	}
+
+	ch.wg.Add(1)
+	go ch.accept()
+	return ch
+}
+
+// GetMessageWait waits for a downstream message and returns it.
+func (ch *CCSHelper) GetMessageWait() ccs.OutMsg {
+	select {
+	case m := <-ch.msgChan:
+		return m
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not receive any downstream message in time")
+	}
+	return ccs.OutMsg{}
+}
+
+// WaitConn waits for a client to connect and complete the XMPP handshake. Subsequent upstream and control messages are sent over this connection.
+func (ch *CCSHelper) WaitConn() {
+	select {
+	case c := <-ch.connChan:
+		ch.mutex.Lock()
+		ch.conn = c
+		ch.mutex.Unlock()
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("client did not connect in time")
+	}
+}
+
+// SendUpstream sends an upstream message with the given data payload, as if it was sent by the device with the given registration ID.
+// Returns the ID of the message.
+func (ch *CCSHelper) SendUpstream(regID string, data map[string]string) string {
+	ch.mutex.Lock()
+	ch.seq++
+	id := fmt.Sprintf("up-%v", ch.seq)
+	ch.mutex.Unlock()
+
+	ch.ResendUpstream(id, regID, data)
+	return id
+}
+
+// ResendUpstream sends an upstream message with the given ID, as CCS does when it does not receive an ACK for a message in time.
+func (ch *CCSHelper) ResendUpstream(id, regID string, data map[string]string) {
+	ch.mutex.Lock()
+	c := ch.conn
+	ch.mutex.Unlock()
+
+	if err := c.writeMsg(map[string]interface{}{"from": regID, "message_id": id, "category": "com.titan", "data": data}); err != nil {
+		ch.testing.Fatalf("failed to send upstream message: %v", err)
+	}
+}
+
+// GetAckWait waits for the client to ACK an upstream message and returns the ID of the message.
+func (ch *CCSHelper) GetAckWait() string {
+	select {
+	case id := <-ch.ackChan:
+		return id
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not receive ACK for upstream message in time")
+	}
+	return ""
+}
+
+// NackNext makes the server respond to the next downstream message with a NACK with the given error code.
+func (ch *CCSHelper) NackNext(errCode string) {
+	ch.nackChan <- errCode
+}
+
+// Drain sends a connection draining control message over the latest connection.
+func (ch *CCSHelper) Drain() {
+	ch.mutex.Lock()
+	c := ch.conn
+	ch.mutex.Unlock()
+
+	if err := c.writeMsg(map[string]string{"message_type": "control", "control_type": "CONNECTION_DRAINING"}); err != nil {
+		ch.testing.Fatalf("failed to send control message: %v", err)
+	}
+}
+
+// DropConns closes all the client connections, without stopping the server.
+func (ch *CCSHelper) DropConns() {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	for _, c := range ch.conns {
+		c.Close()
+	}
+}
+
+// NoMessages verifies that no downstream message was received.
+func (ch *CCSHelper) NoMessages() {
+	select {
+	case m := <-ch.msgChan:
+		ch.testing.Fatalf("expected no downstream messages, got: %+v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// CloseWait closes the server along with all the client connections, and waits till all of them are done.
+func (ch *CCSHelper) CloseWait() {
+	ch.listener.Close()
+	ch.mutex.Lock()
+	for _, c := range ch.conns {
+		c.Close()
+	}
+	ch.mutex.Unlock()
+	ch.wg.Wait()
+}
+
+func (ch *CCSHelper) accept() {
+	defer ch.wg.Done()
+	for {
+		c, err := ch.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		ch.mutex.Lock()
+		ch.conns = append(ch.conns, c)
+		ch.mutex.Unlock()
+
+		ch.wg.Add(1)
+		go func() {
+			defer ch.wg.Done()
+			defer c.Close()
+			if err := ch.serve(&ccsConn{Conn: c}); err != nil {
+				ch.testing.Logf("fake CCS server: connection closed: %v", err)
+			}
+		}()
+	}
+}
+
+// serve does the XMPP handshake (stream, SASL PLAIN auth, resource binding) and then reads the downstream messages until the connection is closed.
+func (ch *CCSHelper) serve(c *ccsConn) error {
+	d := xml.NewDecoder(c)
+
+	if err := ccsStartStream(d, c, 1, ccsAuthFeatures); err != nil {
+		return err
+	}
+	var auth ccsStanza
+	if err := ccsNext(d, &auth); err != nil {
+		return err
+	}
+	if auth.XMLName.Local != "auth" {
+		return fmt.Errorf("expected auth, got: %v", auth.XMLName.Local)
+	}
+	if _, err := fmt.Fprint(c, ccsAuthSuccess); err != nil {
+		return err
+	}
+
+	if err := ccsStartStream(d, c, 2, ccsBindFeatures); err != nil {
+		return err
+	}
+	var bind ccsStanza
+	if err := ccsNext(d, &bind); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c, ccsBindResult, bind.ID); err != nil {
+		return err
+	}
+	ch.connChan <- c
+
+	for {
+		var s ccsStanza
+		if err := ccsNext(d, &s); err != nil {
+			return err
+		}
+		if s.XMLName.Local != "message" {
+			continue
+		}
+
+		var m ccs.OutMsg
+		if err := json.Unmarshal([]byte(s.GCM), &m); err != nil {
+			return fmt.Errorf("malformed downstream message: %v: %v", err, s.GCM)
+		}
+		if m.MessageType == "ack" {
+			ch.ackChan <- m.ID
+			continue
+		}
+		if m.MessageType != "" {
+			continue
+		}
+
+		ch.msgChan <- m
+		res := map[string]string{"from": m.To, "message_id": m.ID, "message_type": "ack"}
+		select {
+		case errCode := <-ch.nackChan:
+			res["message_type"] = "nack"
+			res["error"] = errCode
+		default:
+		}
+		if err := c.writeMsg(res); err != nil {
+			return err
+		}
+	}
+}
+
+// ccsStartStream waits for the client to open an XMPP stream and responds with a stream of its own along with the given stream features.
+func ccsStartStream(d *xml.Decoder, c *ccsConn, id int, features string) error {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if se, ok := t.(xml.StartElement); ok && se.Name.Local == "stream" {
+			break
+		}
+	}
+	_, err := fmt.Fprintf(c, ccsStreamHeader+features, id)
+	return err
+}
+
+// ccsNext decodes the next stanza.
+func ccsNext(d *xml.Decoder, s *ccsStanza) error {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return d.DecodeElement(s, &se)
+		}
+	}
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -6,7 +6,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/neptulon/neptulon/middleware"
+	"github.com/titan-x/titan"
 	"github.com/titan-x/titan/client"
 	"github.com/titan-x/titan/models"
 )
@@ -20,6 +22,11 @@ type ClientHelper struct {
 	testing    *testing.T
 	serverAddr string
 	inMsgsChan chan []models.Message
+	delChan    chan []models.Delivery
+	readChan   chan []models.ReadMarker
+	failChan   chan []models.Failure
+	presChan   chan []models.Presence
+	sigChan    chan []models.Signal
 }
 
 // NewClientHelper creates a new client helper object.
@@ -39,9 +46,19 @@ func NewClientHelper(t *testing.T, addr string) *ClientHelper {
 		testing:    t,
 		serverAddr: addr,
 		inMsgsChan: make(chan []models.Message, 5000),
+		delChan:    make(chan []models.Delivery, 5000),
+		readChan:   make(chan []models.ReadMarker, 5000),
+		failChan:   make(chan []models.Failure, 5000),
+		presChan:   make(chan []models.Presence, 5000),
+		sigChan:    make(chan []models.Signal, 5000),
 	}
 	c.MiddlewareFunc(middleware.LoggerWithPrefix("client"))
 	c.InMsgHandler(ch.inMsgHandler)
+	c.DeliveredHandler(ch.deliveredHandler)
+	c.ReadHandler(ch.readHandler)
+	c.FailedHandler(ch.failedHandler)
+	c.PresenceHandler(ch.presenceHandler)
+	c.SignalHandler(ch.signalHandler)
 	return ch
 }
 
@@ -75,6 +92,24 @@ func (ch *ClientHelper) AsUser(u *models.User) *ClientHelper {
 	return ch
 }
 
+// AsDevice is the same as AsUser, except that a JWT token with the given device ID is issued for the user,
+// so the connection is treated as one of the many devices of the user.
+func (ch *ClientHelper) AsDevice(u *models.User, deviceID string) *ClientHelper {
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["userid"] = u.ID
+	token.Claims["deviceid"] = deviceID
+	token.Claims["created"] = u.Registered.Unix()
+	t, err := token.SignedString([]byte(titan.Conf.App.JWTPass()))
+	if err != nil {
+		ch.testing.Fatalf("failed to sign device JWT token: %v", err)
+	}
+
+	du := *u
+	du.JWTToken = t
+	ch.User = &du
+	return ch
+}
+
 // GoogleAuthSync is synchronous version of Client.GoogleAuth method.
 // Google OAuth token is exchanged for a JWT token. If any user was assigned with AsUser, the new JWT token is stored in the user's profile.
 func (ch *ClientHelper) GoogleAuthSync(oauthToken string) *ClientHelper {
@@ -144,13 +179,57 @@ func (ch *ClientHelper) EchoSync(message string) *ClientHelper {
 	return ch
 }
 
-// SendMessagesSync is synchronous version of Client.SendMessages method.
+// SendMessagesSync is synchronous version of Client.SendMessages method. Test fails unless all the messages are accepted.
 func (ch *ClientHelper) SendMessagesSync(messages []models.Message) *ClientHelper {
+	res, err := ch.TrySendMessagesSync(messages)
+	if err != nil {
+		ch.testing.Fatalf("failed to send message to user %v: %v", messages[0].To, err)
+	}
+	for i, r := range res {
+		if r.Status != models.SendAccepted || r.ID == "" {
+			ch.testing.Fatalf("message to user %v was not accepted: %+v", messages[i].To, r)
+		}
+	}
+	return ch
+}
+
+// TrySendMessagesSync is the same as SendMessagesSync, except that it returns the results or the error response of the server instead of failing the test.
+func (ch *ClientHelper) TrySendMessagesSync(messages []models.Message) ([]models.SendResult, *client.Error) {
+	type result struct {
+		res []models.SendResult
+		err error
+	}
+	resChan := make(chan result, 1)
+
+	if err := ch.Client.SendMessages(messages, func(res []models.SendResult, err error) error {
+		resChan <- result{res, err}
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case r := <-resChan:
+		if r.err != nil {
+			return nil, r.err.(*client.Error)
+		}
+		if len(r.res) != len(messages) {
+			ch.testing.Fatalf("expected %v results for msg.send request, got: %+v", len(messages), r.res)
+		}
+		return r.res, nil
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get an msg.send response in time")
+	}
+	return nil, nil
+}
+
+// ReadMessagesSync is synchronous version of Client.ReadMessages method.
+func (ch *ClientHelper) ReadMessagesSync(markers []models.ReadMarker) *ClientHelper {
 	gotRes := make(chan bool)
 
-	if err := ch.Client.SendMessages(messages, func(ack string) error {
+	if err := ch.Client.ReadMessages(markers, func(ack string) error {
 		if ack != client.ACK {
-			ch.testing.Fatalf("failed to send hello message to user %v: %v", messages[0].To, ack)
+			ch.testing.Fatalf("server did not ACK our msg.read request: %v", ack)
 		}
 		gotRes <- true
 		return nil
@@ -161,11 +240,359 @@ func (ch *ClientHelper) SendMessagesSync(messages []models.Message) *ClientHelpe
 	select {
 	case <-gotRes:
 	case <-time.After(time.Second * 3):
-		ch.testing.Fatal("did not get an msg.send response in time")
+		ch.testing.Fatal("did not get an msg.read response in time")
+	}
+	return ch
+}
+
+// GetHistorySync is synchronous version of Client.GetHistory method.
+func (ch *ClientHelper) GetHistorySync(q models.HistoryQuery) *models.History {
+	res := make(chan *models.History)
+
+	if err := ch.Client.GetHistory(q, func(h *models.History) error {
+		res <- h
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case h := <-res:
+		return h
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get an msg.history response in time")
+	}
+	return nil
+}
+
+// SubscribePresenceSync is synchronous version of Client.SubscribePresence method.
+func (ch *ClientHelper) SubscribePresenceSync(userIDs []string) []models.Presence {
+	p, err := ch.TrySubscribePresenceSync(userIDs)
+	if err != nil {
+		ch.testing.Fatalf("presence.subscribe request failed: %v", err)
+	}
+	return p
+}
+
+// TrySubscribePresenceSync is synchronous version of Client.SubscribePresence method. Returned error is the error response from the server, if any.
+func (ch *ClientHelper) TrySubscribePresenceSync(userIDs []string) ([]models.Presence, error) {
+	type result struct {
+		p   []models.Presence
+		err error
+	}
+	res := make(chan result, 1)
+
+	if err := ch.Client.SubscribePresence(userIDs, func(p []models.Presence, err error) error {
+		res <- result{p, err}
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case r := <-res:
+		return r.p, r.err
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get a presence.subscribe response in time")
+	}
+	return nil, nil
+}
+
+// CreateGroupSync is synchronous version of Client.CreateGroup method.
+func (ch *ClientHelper) CreateGroupSync(name string, members []string) *models.Group {
+	return ch.groupSync("group.create", func(handler func(g *models.Group, err error) error) error {
+		return ch.Client.CreateGroup(name, members, handler)
+	})
+}
+
+// TryCreateGroupSync is synchronous version of Client.CreateGroup method. Returned error is the error response from the server, if any.
+func (ch *ClientHelper) TryCreateGroupSync(name string, members []string) (*models.Group, error) {
+	var err error
+	g := ch.groupSync("group.create", func(handler func(g *models.Group, err error) error) error {
+		return ch.Client.CreateGroup(name, members, func(g *models.Group, e error) error {
+			err = e
+			return handler(g, nil)
+		})
+	})
+	return g, err
+}
+
+// RemoveGroupMembersSync is synchronous version of Client.RemoveGroupMembers method.
+func (ch *ClientHelper) RemoveGroupMembersSync(groupID string, members []string) *models.Group {
+	return ch.groupSync("group.remove", func(handler func(g *models.Group, err error) error) error {
+		return ch.Client.RemoveGroupMembers(groupID, members, handler)
+	})
+}
+
+// GetGroupSync is synchronous version of Client.GetGroup method. Returned error is the error response from the server, if any.
+func (ch *ClientHelper) GetGroupSync(groupID string) (*models.Group, error) {
+	var err error
+	g := ch.groupSync("group.info", func(handler func(g *models.Group, err error) error) error {
+		return ch.Client.GetGroup(groupID, func(g *models.Group, e error) error {
+			err = e
+			return handler(g, nil)
+		})
+	})
+	return g, err
+}
+
+// LeaveGroupSync is synchronous version of Client.LeaveGroup method.
+func (ch *ClientHelper) LeaveGroupSync(groupID string) *ClientHelper {
+	gotRes := make(chan bool)
+
+	if err := ch.Client.LeaveGroup(groupID, func(err error) error {
+		if err != nil {
+			ch.testing.Fatalf("failed to leave group %v: %v", groupID, err)
+		}
+		gotRes <- true
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case <-gotRes:
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get a group.leave response in time")
+	}
+	return ch
+}
+
+func (ch *ClientHelper) groupSync(method string, send func(handler func(g *models.Group, err error) error) error) *models.Group {
+	res := make(chan *models.Group, 1)
+
+	if err := send(func(g *models.Group, err error) error {
+		if err != nil {
+			ch.testing.Fatalf("%v request failed: %v", method, err)
+		}
+		res <- g
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case g := <-res:
+		return g
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatalf("did not get a %v response in time", method)
+	}
+	return nil
+}
+
+// ListContactsSync is synchronous version of Client.ListContacts method.
+func (ch *ClientHelper) ListContactsSync() *models.Roster {
+	return ch.mustRoster(ch.rosterSync("contacts.list", ch.Client.ListContacts))
+}
+
+// AddContactSync is synchronous version of Client.AddContact method. Returned error is the error response from the server, if any.
+func (ch *ClientHelper) AddContactSync(c models.Contact) (*models.Roster, error) {
+	return ch.rosterSync("contacts.add", func(handler func(r *models.Roster, err error) error) error {
+		return ch.Client.AddContact(c, handler)
+	})
+}
+
+// RemoveContactSync is synchronous version of Client.RemoveContact method.
+func (ch *ClientHelper) RemoveContactSync(userID string) *models.Roster {
+	return ch.mustRoster(ch.rosterSync("contacts.remove", func(handler func(r *models.Roster, err error) error) error {
+		return ch.Client.RemoveContact(userID, handler)
+	}))
+}
+
+// BlockContactSync is synchronous version of Client.BlockContact method.
+func (ch *ClientHelper) BlockContactSync(userID string) *models.Roster {
+	return ch.mustRoster(ch.rosterSync("contacts.block", func(handler func(r *models.Roster, err error) error) error {
+		return ch.Client.BlockContact(userID, handler)
+	}))
+}
+
+// UnblockContactSync is synchronous version of Client.UnblockContact method.
+func (ch *ClientHelper) UnblockContactSync(userID string) *models.Roster {
+	return ch.mustRoster(ch.rosterSync("contacts.unblock", func(handler func(r *models.Roster, err error) error) error {
+		return ch.Client.UnblockContact(userID, handler)
+	}))
+}
+
+func (ch *ClientHelper) rosterSync(method string, send func(handler func(r *models.Roster, err error) error) error) (*models.Roster, error) {
+	type result struct {
+		r   *models.Roster
+		err error
+	}
+	res := make(chan result, 1)
+
+	if err := send(func(r *models.Roster, err error) error {
+		res <- result{r, err}
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case r := <-res:
+		return r.r, r.err
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatalf("did not get a %v response in time", method)
+	}
+	return nil, nil
+}
+
+func (ch *ClientHelper) mustRoster(r *models.Roster, err error) *models.Roster {
+	if err != nil {
+		ch.testing.Fatalf("contacts request failed: %v", err)
+	}
+	return r
+}
+
+// SendSignalsSync is synchronous version of Client.SendSignals method.
+func (ch *ClientHelper) SendSignalsSync(signals []models.Signal) *ClientHelper {
+	gotRes := make(chan bool)
+
+	if err := ch.Client.SendSignals(signals, func(ack string) error {
+		if ack != client.ACK {
+			ch.testing.Fatalf("server did not ACK our signal.send request: %v", ack)
+		}
+		gotRes <- true
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case <-gotRes:
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get a signal.send response in time")
+	}
+	return ch
+}
+
+// RegisterDeviceSync is synchronous version of Client.RegisterDevice method.
+func (ch *ClientHelper) RegisterDeviceSync(d models.Device) *ClientHelper {
+	if err := ch.TryRegisterDeviceSync(d); err != nil {
+		ch.testing.Fatalf("server did not ACK our device.register request: %v", err)
+	}
+	return ch
+}
+
+// TryRegisterDeviceSync is the same as RegisterDeviceSync, except that it returns the error response of the server instead of failing the test.
+func (ch *ClientHelper) TryRegisterDeviceSync(d models.Device) *client.Error {
+	errChan := make(chan *client.Error, 1)
+
+	if err := ch.Client.RegisterDevice(d, func(ack string, err error) error {
+		if err != nil {
+			errChan <- err.(*client.Error)
+			return nil
+		}
+		if ack != client.ACK {
+			ch.testing.Fatalf("server did not ACK our device.register request: %v", ack)
+		}
+		errChan <- nil
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get a device.register response in time")
+	}
+	return nil
+}
+
+// UnregisterDeviceSync is synchronous version of Client.UnregisterDevice method.
+func (ch *ClientHelper) UnregisterDeviceSync() *ClientHelper {
+	return ch.ackSync("device.unregister", ch.Client.UnregisterDevice)
+}
+
+// ackSync sends a request with the given send function, and waits for the server to ACK it.
+func (ch *ClientHelper) ackSync(method string, send func(handler func(ack string) error) error) *ClientHelper {
+	gotRes := make(chan bool)
+
+	if err := send(func(ack string) error {
+		if ack != client.ACK {
+			ch.testing.Fatalf("server did not ACK our %v request: %v", method, ack)
+		}
+		gotRes <- true
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case <-gotRes:
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatalf("did not get a %v response in time", method)
 	}
 	return ch
 }
 
+// SubscribePushSync is synchronous version of Client.SubscribePush method.
+func (ch *ClientHelper) SubscribePushSync(sub models.WebPushSubscription) *ClientHelper {
+	gotRes := make(chan bool)
+
+	if err := ch.Client.SubscribePush(sub, func(ack string) error {
+		if ack != client.ACK {
+			ch.testing.Fatalf("server did not ACK our push.subscribe request: %v", ack)
+		}
+		gotRes <- true
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case <-gotRes:
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get a push.subscribe response in time")
+	}
+	return ch
+}
+
+// LookupUsersSync is synchronous version of Client.LookupUsers method. Returned error is the error response from the server, if any.
+func (ch *ClientHelper) LookupUsersSync(hashes []string) ([]models.LookupResult, error) {
+	type result struct {
+		res []models.LookupResult
+		err error
+	}
+	res := make(chan result, 1)
+
+	if err := ch.Client.LookupUsers(hashes, func(r []models.LookupResult, err error) error {
+		res <- result{r, err}
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case r := <-res:
+		return r.res, r.err
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get a users.lookup response in time")
+	}
+	return nil, nil
+}
+
+// ListBotsSync is synchronous version of Client.ListBots method.
+func (ch *ClientHelper) ListBotsSync() []models.BotInfo {
+	res := make(chan []models.BotInfo, 1)
+
+	if err := ch.Client.ListBots(func(b []models.BotInfo) error {
+		res <- b
+		return nil
+	}); err != nil {
+		ch.testing.Fatal(err)
+	}
+
+	select {
+	case b := <-res:
+		return b
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("did not get a bots.list response in time")
+	}
+	return nil
+}
+
 // GetMessagesWait waits for and returns incoming messages.
 // If no message arrives within the timeout, test fails.
 func (ch *ClientHelper) GetMessagesWait() []models.Message {
@@ -178,6 +605,66 @@ func (ch *ClientHelper) GetMessagesWait() []models.Message {
 	return nil
 }
 
+// GetDeliveriesWait waits for and returns incoming delivery receipts.
+// If no receipt arrives within the timeout, test fails.
+func (ch *ClientHelper) GetDeliveriesWait() []models.Delivery {
+	select {
+	case d := <-ch.delChan:
+		return d
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("GetDeliveriesWait timeout")
+	}
+	return nil
+}
+
+// GetReadMarkersWait waits for and returns incoming read markers.
+// If no read marker arrives within the timeout, test fails.
+func (ch *ClientHelper) GetReadMarkersWait() []models.ReadMarker {
+	select {
+	case m := <-ch.readChan:
+		return m
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("GetReadMarkersWait timeout")
+	}
+	return nil
+}
+
+// GetFailuresWait waits for and returns incoming delivery failure notices.
+// If no failure notice arrives within the timeout, test fails.
+func (ch *ClientHelper) GetFailuresWait() []models.Failure {
+	select {
+	case f := <-ch.failChan:
+		return f
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("GetFailuresWait timeout")
+	}
+	return nil
+}
+
+// GetPresenceWait waits for and returns incoming presence updates.
+// If no presence update arrives within the timeout, test fails.
+func (ch *ClientHelper) GetPresenceWait() []models.Presence {
+	select {
+	case p := <-ch.presChan:
+		return p
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("GetPresenceWait timeout")
+	}
+	return nil
+}
+
+// GetSignalsWait waits for and returns incoming signals.
+// If no signal arrives within the timeout, test fails.
+func (ch *ClientHelper) GetSignalsWait() []models.Signal {
+	select {
+	case s := <-ch.sigChan:
+		return s
+	case <-time.After(time.Second * 3):
+		ch.testing.Fatal("GetSignalsWait timeout")
+	}
+	return nil
+}
+
 // CloseWait closes a connection.
 // Waits till all the goroutines handling messages quit.
 func (ch *ClientHelper) CloseWait() {
@@ -196,3 +683,28 @@ func (ch *ClientHelper) inMsgHandler(m []models.Message) error {
 	ch.inMsgsChan <- m
 	return nil
 }
+
+func (ch *ClientHelper) deliveredHandler(d []models.Delivery) error {
+	ch.delChan <- d
+	return nil
+}
+
+func (ch *ClientHelper) readHandler(m []models.ReadMarker) error {
+	ch.readChan <- m
+	return nil
+}
+
+func (ch *ClientHelper) failedHandler(f []models.Failure) error {
+	ch.failChan <- f
+	return nil
+}
+
+func (ch *ClientHelper) presenceHandler(p []models.Presence) error {
+	ch.presChan <- p
+	return nil
+}
+
+func (ch *ClientHelper) signalHandler(s []models.Signal) error {
+	ch.sigChan <- s
+	return nil
+}
@@ -0,0 +1,105 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+func TestContacts(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch.CloseWait()
+
+	if r := ch.ListContactsSync(); len(r.Contacts) != 0 || len(r.Blocked) != 0 {
+		t.Fatalf("expected empty roster, got: %+v", r)
+	}
+
+	r, err := ch.AddContactSync(models.Contact{ID: "2", Name: "Morgan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Contacts) != 1 || r.Contacts[0].ID != "2" || r.Contacts[0].Name != "Morgan" || r.Contacts[0].Added.IsZero() {
+		t.Fatalf("unexpected roster: %+v", r)
+	}
+
+	// unknown users and the user themselves cannot be added
+	for _, id := range []string{"", "no-such-user", "1"} {
+		if _, err := ch.AddContactSync(models.Contact{ID: id}); err == nil || err.(*client.Error).Code != 5001 {
+			t.Fatalf("expected contact %q to be rejected, got: %v", id, err)
+		}
+	}
+
+	// blocking is independent of the contact list
+	if r := ch.BlockContactSync("2"); len(r.Contacts) != 1 || len(r.Blocked) != 1 || r.Blocked[0] != "2" {
+		t.Fatalf("unexpected roster: %+v", r)
+	}
+	if r := ch.RemoveContactSync("2"); len(r.Contacts) != 0 || len(r.Blocked) != 1 {
+		t.Fatalf("unexpected roster: %+v", r)
+	}
+	if r := ch.UnblockContactSync("2"); len(r.Contacts) != 0 || len(r.Blocked) != 0 {
+		t.Fatalf("unexpected roster: %+v", r)
+	}
+}
+
+func TestBlocking(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	ch2.BlockContactSync("1")
+
+	// messages to the user who blocked the sender look accepted, but they are never delivered
+	res, err := ch1.TrySendMessagesSync([]models.Message{models.Message{To: "2", Message: "hello?"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Status != models.SendAccepted || res[0].ID == "" {
+		t.Fatalf("expected blocked message to look accepted, got: %+v", res[0])
+	}
+	ch1.SendSignalsSync([]models.Signal{models.Signal{To: "2", Type: models.SignalTypingStart}})
+
+	// read receipts are not sent either way
+	ch1.ReadMessagesSync([]models.ReadMarker{models.ReadMarker{Peer: "2", Time: time.Now()}})
+	ch2.ReadMessagesSync([]models.ReadMarker{models.ReadMarker{Peer: "1", Time: time.Now()}})
+	select {
+	case m := <-ch2.inMsgsChan:
+		t.Fatalf("expected message from blocked user to be dropped, got: %+v", m)
+	case s := <-ch2.sigChan:
+		t.Fatalf("expected signal from blocked user to be dropped, got: %+v", s)
+	case r := <-ch2.readChan:
+		t.Fatalf("expected read receipt from blocked user to be dropped, got: %+v", r)
+	case r := <-ch1.readChan:
+		t.Fatalf("expected read receipt to blocked user to be dropped, got: %+v", r)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// dropped messages are kept in the sender's history only
+	if h := ch1.GetHistorySync(models.HistoryQuery{Peer: "2"}); len(h.Messages) != 1 || h.Messages[0].ID != res[0].ID {
+		t.Fatalf("expected dropped message in sender's history, got: %+v", h)
+	}
+	if h := ch2.GetHistorySync(models.HistoryQuery{Peer: "1"}); len(h.Messages) != 0 {
+		t.Fatalf("expected dropped message to be hidden from the recipient, got: %+v", h)
+	}
+
+	// blocking user cannot message the blocked user either, and is told so
+	res, _ = ch2.TrySendMessagesSync([]models.Message{models.Message{To: "1", Message: "go away"}})
+	if res[0].Status != models.SendBlocked || res[0].ID != "" {
+		t.Fatalf("expected message to blocked user to be rejected, got: %+v", res[0])
+	}
+
+	ch2.UnblockContactSync("1")
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "hello again"}})
+	if msgs := ch2.GetMessagesWait(); len(msgs) != 1 || msgs[0].Message != "hello again" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+func TestMultiDevice(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	phone := sh.GetClientHelper().AsDevice(&data.SeedUser2, "phone").Connect().JWTAuthSync()
+	browser := sh.GetClientHelper().AsDevice(&data.SeedUser2, "browser").Connect().JWTAuthSync()
+	defer browser.CloseWait()
+
+	// both devices get the message while the sender gets a single delivery receipt
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "hello devices"}})
+	for _, ch := range []*ClientHelper{phone, browser} {
+		if m := ch.GetMessagesWait(); len(m) != 1 || m[0].Message != "hello devices" {
+			t.Fatalf("expected message on every device, got: %+v", m)
+		}
+	}
+	if d := ch1.GetDeliveriesWait(); len(d) != 1 || d[0].To != "2" {
+		t.Fatalf("expected a delivery receipt, got: %+v", d)
+	}
+
+	// disconnected device gets only the messages it has missed, once it is back
+	phone.CloseWait()
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "hello browser"}})
+	if m := browser.GetMessagesWait(); len(m) != 1 || m[0].Message != "hello browser" {
+		t.Fatalf("expected message on the connected device, got: %+v", m)
+	}
+
+	phone = sh.GetClientHelper().AsDevice(&data.SeedUser2, "phone").Connect().JWTAuthSync()
+	defer phone.CloseWait()
+	if m := phone.GetMessagesWait(); len(m) != 1 || m[0].Message != "hello browser" {
+		t.Fatalf("expected only the missed message after reconnect, got: %+v", m)
+	}
+}
+
+func TestDeviceTokenMove(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	d := models.Device{Platform: models.PlatformAndroid, PushToken: "gcm-reg-id-shared"}
+	ch1 := sh.GetClientHelper().AsDevice(&data.SeedUser1, "phone").Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch1.RegisterDeviceSync(d)
+
+	// push token moves to another user who presents it, and it is removed from the old one
+	ch2 := sh.GetClientHelper().AsDevice(&data.SeedUser2, "phone").Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	ch2.RegisterDeviceSync(d)
+	if dt, ok := sh.db.GetDeviceByToken(d.PushToken); !ok || dt.UserID != "2" {
+		t.Fatalf("expected device to be registered to the new user, got: %+v", dt)
+	}
+	if ds, _ := sh.db.GetDevices("1"); len(ds) != 0 {
+		t.Fatalf("expected push token to be removed from the old user, got: %+v", ds)
+	}
+	if u, ok := sh.db.GetByGCMRegID(d.PushToken); !ok || u.ID != "2" {
+		t.Fatalf("expected push token to belong to the new user, got: %+v", u)
+	}
+
+	// token can still move between the devices of the same user
+	ch3 := sh.GetClientHelper().AsDevice(&data.SeedUser2, "tablet").Connect().JWTAuthSync()
+	defer ch3.CloseWait()
+	ch3.RegisterDeviceSync(d)
+	if ds, _ := sh.db.GetDevices("2"); len(ds) != 1 || ds[0].ID != "tablet" {
+		t.Fatalf("expected push token to move to the new device, got: %+v", ds)
+	}
+
+	// registration ID in the user record of the old owner is cleared as well, and the default device is stored with its own ID
+	ch4 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch4.CloseWait()
+	ch4.RegisterDeviceSync(models.Device{Platform: models.PlatformAndroid, PushToken: data.SeedUser1.GCMRegID})
+	if u, ok := sh.db.GetByID("1"); !ok || u.GCMRegID != "" {
+		t.Fatalf("expected registration ID of the old user to be cleared, got: %+v", u)
+	}
+	if u, ok := sh.db.GetByGCMRegID(data.SeedUser1.GCMRegID); !ok || u.ID != "2" {
+		t.Fatalf("expected registration ID to belong to the new user, got: %+v", u)
+	}
+	if dt, ok := sh.db.GetDeviceByToken(data.SeedUser1.GCMRegID); !ok || dt.ID != "default" {
+		t.Fatalf("expected default device to be stored with the default device ID, got: %+v", dt)
+	}
+}
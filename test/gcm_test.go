@@ -0,0 +1,231 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// newGCMServerHelper creates a server helper with GCM configured to use the given fake CCS server.
+// Returned function restores the original GCM configuration.
+func newGCMServerHelper(t *testing.T, ccsh *CCSHelper) (*ServerHelper, func()) {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	gcm := titan.Conf.GCM
+	titan.Conf.GCM = titan.GCM{CCSHost: ccsh.Addr, SenderID: "1234"}
+	return NewServerHelper(t), func() { titan.Conf.GCM = gcm }
+}
+
+func TestGCMPush(t *testing.T) {
+	ccsh := NewCCSHelper(t)
+	defer ccsh.CloseWait()
+
+	sh, restore := newGCMServerHelper(t, ccsh)
+	defer restore()
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+	ccsh.WaitConn()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// offline user gets a notification with a preview of the message
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "wake up"}})
+	m := ccsh.GetMessageWait()
+	if m.To != data.SeedUser2.GCMRegID || m.Data["n.message_type"] != "message" || m.Data["n.from"] != "1" || m.Data["n.message"] != "wake up" {
+		t.Fatalf("expected a GCM notification with message preview, got: %+v", m)
+	}
+
+	// messages too big for GCM are signaled to be fetched over WebSocket
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: strings.Repeat("a", 5000)}})
+	m = ccsh.GetMessageWait()
+	if m.Data["n.message_type"] != "fetch" || m.Data["n.from"] != "1" || m.Data["n.message"] != "" {
+		t.Fatalf("expected a GCM fetch notification, got: %+v", m)
+	}
+
+	// online user is not notified
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	ch2.GetMessagesWait()
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "you are online"}})
+	ch2.GetMessagesWait()
+	ccsh.NoMessages()
+}
+
+func TestGCMUpstream(t *testing.T) {
+	ccsh := NewCCSHelper(t)
+	defer ccsh.CloseWait()
+
+	sh, restore := newGCMServerHelper(t, ccsh)
+	defer restore()
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+	ccsh.WaitConn()
+
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	// upstream messages from devices are routed like the ones sent over WebSocket
+	id := ccsh.SendUpstream(data.SeedUser1.GCMRegID, map[string]string{"n.message_type": "message", "n.to": "2", "n.message": "from android"})
+	if ack := ccsh.GetAckWait(); ack != id {
+		t.Fatalf("expected ACK for upstream message %v, got: %v", id, ack)
+	}
+	if m := ch2.GetMessagesWait(); len(m) != 1 || m[0].From != "1" || m[0].Message != "from android" {
+		t.Fatalf("expected upstream message to be delivered, got: %+v", m)
+	}
+
+	// redelivered upstream messages are not sent twice
+	d := map[string]string{"n.message_type": "message", "n.to": "2", "n.message": "only once"}
+	id = ccsh.SendUpstream(data.SeedUser1.GCMRegID, d)
+	ccsh.GetAckWait()
+	ch2.GetMessagesWait()
+	ccsh.ResendUpstream(id, data.SeedUser1.GCMRegID, d)
+	ccsh.GetAckWait()
+	ccsh.SendUpstream(data.SeedUser1.GCMRegID, map[string]string{"n.message_type": "message", "n.to": "2", "n.message": "next"})
+	ccsh.GetAckWait()
+	if m := ch2.GetMessagesWait(); len(m) != 1 || m[0].Message != "next" {
+		t.Fatalf("expected duplicate upstream message to be suppressed, got: %+v", m)
+	}
+}
+
+func TestGCMConnection(t *testing.T) {
+	ccsh := NewCCSHelper(t)
+	defer ccsh.CloseWait()
+
+	sh, restore := newGCMServerHelper(t, ccsh)
+	defer restore()
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+	ccsh.WaitConn()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// messages that are NACKed with a temporary error are sent again
+	ccsh.NackNext("SERVICE_UNAVAILABLE")
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "retry"}})
+	m1, m2 := ccsh.GetMessageWait(), ccsh.GetMessageWait()
+	if m1.ID != m2.ID || m2.Data["n.message"] != "retry" {
+		t.Fatalf("expected NACKed message to be sent again, got: %+v and %+v", m1, m2)
+	}
+
+	// a new connection is opened once CCS starts draining the current one
+	ccsh.Drain()
+	ccsh.WaitConn()
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "after drain"}})
+	if m := ccsh.GetMessageWait(); m.Data["n.message"] != "after drain" {
+		t.Fatalf("expected message to be sent over the new connection, got: %+v", m)
+	}
+
+	// dropped connections are re-established
+	ccsh.DropConns()
+	ccsh.WaitConn()
+	id := ccsh.SendUpstream(data.SeedUser1.GCMRegID, map[string]string{"n.message_type": "message", "n.to": "2", "n.message": "after reconnect"})
+	if ack := ccsh.GetAckWait(); ack != id {
+		t.Fatalf("expected ACK for upstream message %v, got: %v", id, ack)
+	}
+}
+
+func TestGCMDevices(t *testing.T) {
+	ccsh := NewCCSHelper(t)
+	defer ccsh.CloseWait()
+
+	sh, restore := newGCMServerHelper(t, ccsh)
+	defer restore()
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+	ccsh.WaitConn()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	for _, id := range []string{"phone", "tablet"} {
+		sh.GetClientHelper().AsDevice(&data.SeedUser2, id).Connect().JWTAuthSync().
+			RegisterDeviceSync(models.Device{Platform: models.PlatformAndroid, PushToken: "gcm-" + id, AppVersion: "1.0"}).
+			CloseWait()
+	}
+
+	// every device of the offline user is notified, along with the one in the user record
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "wake up"}})
+	to := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		to[ccsh.GetMessageWait().To] = true
+	}
+	if !to["gcm-phone"] || !to["gcm-tablet"] || !to[data.SeedUser2.GCMRegID] {
+		t.Fatalf("expected a GCM notification for every device, got: %+v", to)
+	}
+	ccsh.NoMessages()
+
+	// unregistered device is not notified anymore
+	sh.GetClientHelper().AsDevice(&data.SeedUser2, "tablet").Connect().JWTAuthSync().UnregisterDeviceSync().CloseWait()
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "wake up again"}})
+	for i := 0; i < 2; i++ {
+		if m := ccsh.GetMessageWait(); m.To == "gcm-tablet" {
+			t.Fatalf("expected no GCM notification for unregistered device, got: %+v", m)
+		}
+	}
+	ccsh.NoMessages()
+
+	// upstream messages from registered devices are routed as well
+	ccsh.SendUpstream("gcm-phone", map[string]string{"n.message_type": "message", "n.to": "1", "n.message": "from phone"})
+	ccsh.GetAckWait()
+	if m := ch1.GetMessagesWait(); len(m) != 1 || m[0].From != "2" || m[0].Message != "from phone" {
+		t.Fatalf("expected upstream message from registered device to be delivered, got: %+v", m)
+	}
+}
+
+func TestGCMStaleRegID(t *testing.T) {
+	ccsh := NewCCSHelper(t)
+	defer ccsh.CloseWait()
+
+	sh, restore := newGCMServerHelper(t, ccsh)
+	defer restore()
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+	ccsh.WaitConn()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// registration ID in the user record is cleared once GCM reports it as unregistered
+	ccsh.NackNext("DEVICE_UNREGISTERED")
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "wake up"}})
+	ccsh.GetMessageWait()
+	waitCond(t, "registration ID to be cleared", func() bool {
+		u, ok := sh.db.GetByID("2")
+		return ok && u.GCMRegID == ""
+	})
+
+	// registered device is removed once GCM reports its registration ID as invalid
+	sh.GetClientHelper().AsDevice(&data.SeedUser2, "phone").Connect().JWTAuthSync().
+		RegisterDeviceSync(models.Device{Platform: models.PlatformAndroid, PushToken: "gcm-phone", AppVersion: "1.0"}).
+		CloseWait()
+	ccsh.NackNext("BAD_REGISTRATION")
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "wake up again"}})
+	if m := ccsh.GetMessageWait(); m.To != "gcm-phone" {
+		t.Fatalf("expected a GCM notification for the registered device, got: %+v", m)
+	}
+	waitCond(t, "device to be removed", func() bool {
+		ds, err := sh.db.GetDevices("2")
+		return err == nil && len(ds) == 0
+	})
+
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "no one to wake up"}})
+	ccsh.NoMessages()
+}
+
+// waitCond waits for a condition to hold, polling it until it does or the wait times out.
+func waitCond(t *testing.T, desc string, cond func() bool) {
+	for i := 0; i < 300; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("timed out waiting for %v", desc)
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+func TestGroupMessage(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	g := ch1.CreateGroupSync("friends", []string{"2"})
+	if g.ID == "" || g.Name != "friends" || len(g.Members) != 2 || g.Members[0].UserID != "1" || g.Members[0].Role != models.GroupRoleAdmin {
+		t.Fatalf("unexpected group: %+v", g)
+	}
+
+	// group messages should be fanned out to all members except the sender
+	ch1.SendMessagesSync([]models.Message{models.Message{Group: g.ID, Message: "Hello group!"}})
+	msgs := ch2.GetMessagesWait()
+	if len(msgs) != 1 || msgs[0].Group != g.ID || msgs[0].From != "1" || msgs[0].Message != "Hello group!" {
+		t.Fatalf("unexpected group message: %+v", msgs)
+	}
+	if d := ch1.GetDeliveriesWait(); len(d) != 1 || d[0].Group != g.ID || d[0].To != "2" {
+		t.Fatalf("unexpected delivery receipt: %+v", d)
+	}
+
+	h := ch1.GetHistorySync(models.HistoryQuery{Group: g.ID})
+	if len(h.Messages) != 1 || h.Messages[0].ID != msgs[0].ID {
+		t.Fatalf("unexpected group history: %+v", h)
+	}
+
+	// non-members should not be able to access the group
+	ch2.LeaveGroupSync(g.ID)
+	if _, err := ch2.GetGroupSync(g.ID); err == nil {
+		t.Fatal("expected group to be inaccessible after leaving it")
+	} else if e, ok := err.(*client.Error); !ok || e.Code == 0 {
+		t.Fatalf("expected an error response, got: %v", err)
+	}
+
+	g, err := ch1.GetGroupSync(g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Members) != 1 {
+		t.Fatalf("expected a single group member, got: %+v", g.Members)
+	}
+
+	// only existing users can be group members
+	if _, err := ch1.TryCreateGroupSync("strangers", []string{"2", "no-such-user"}); err == nil {
+		t.Fatal("expected group with an unknown member to be rejected")
+	} else if e, ok := err.(*client.Error); !ok || e.Code != 2003 {
+		t.Fatalf("expected error code 2003, got: %v", err)
+	}
+}
+
+func TestGroupBlocking(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	g := ch1.CreateGroupSync("friends", []string{"2"})
+	ch2.BlockContactSync("1")
+
+	// messages and signals of blocked members are not fanned out to the members who blocked them
+	ch1.SendMessagesSync([]models.Message{models.Message{Group: g.ID, Message: "hello?"}})
+	ch1.SendSignalsSync([]models.Signal{models.Signal{Group: g.ID, Type: models.SignalTypingStart}})
+	select {
+	case m := <-ch2.inMsgsChan:
+		t.Fatalf("expected group message from blocked user to be dropped, got: %+v", m)
+	case s := <-ch2.sigChan:
+		t.Fatalf("expected group signal from blocked user to be dropped, got: %+v", s)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// users cannot add the users who blocked them to groups
+	if g := ch1.CreateGroupSync("friends again", []string{"2"}); len(g.Members) != 1 {
+		t.Fatalf("expected user who blocked the creator to be skipped, got: %+v", g.Members)
+	}
+
+	ch2.UnblockContactSync("1")
+	ch1.SendMessagesSync([]models.Message{models.Message{Group: g.ID, Message: "hello again"}})
+	if msgs := ch2.GetMessagesWait(); len(msgs) != 1 || msgs[0].Message != "hello again" {
+		t.Fatalf("unexpected group messages: %+v", msgs)
+	}
+}
@@ -0,0 +1,87 @@
+package test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/titan-x/titan"
+	"github.com/titan-x/titan/client"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+func TestLookupUsers(t *testing.T) {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	lookup := titan.Conf.Lookup
+	titan.Conf.Lookup = titan.Lookup{MaxBatchSize: 5, RateLimit: 9, Pepper: "pepper"}
+	defer func() { titan.Conf.Lookup = lookup }()
+
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// users are hashed with the current pepper upon login, so they are not found before
+	phone, email := models.HashPhoneNumber(data.SeedUser2.PhoneNumber), models.HashEmail(strings.ToUpper(data.SeedUser1.Email))
+	if res, err := ch1.LookupUsersSync([]string{phone}); err != nil || len(res) != 0 {
+		t.Fatalf("expected user who never logged in to be left out of the results, got: %+v, %v", res, err)
+	}
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	// e-mail addresses are normalized before hashing, and unknown hashes are left out of the results
+	res, err := ch1.LookupUsersSync([]string{phone, models.HashEmail("nobody@titan"), email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Hash != phone || res[0].ID != "2" || res[0].Name != data.SeedUser2.Name || res[1].Hash != email || res[1].ID != "1" {
+		t.Fatalf("unexpected lookup results: %+v", res)
+	}
+
+	// users who blocked us are found like any others, so that the lookups do not reveal the blocks
+	ch2.BlockContactSync("1")
+	if res, err := ch1.LookupUsersSync([]string{phone}); err != nil || len(res) != 1 || res[0].ID != "2" {
+		t.Fatalf("expected user who blocked us in lookup results, got: %+v, %v", res, err)
+	}
+
+	// users hashed with an old pepper are re-hashed upon their next login
+	u, _ := sh.db.GetByID("2")
+	uc := *u
+	uc.SetLookupHashes("old pepper")
+	if err := sh.db.SaveUser(&uc); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ch1.LookupUsersSync([]string{phone}); err != nil || len(res) != 0 {
+		t.Fatalf("expected user hashed with old pepper to be left out of the results, got: %+v, %v", res, err)
+	}
+	sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync().CloseWait()
+	if res, err := ch1.LookupUsersSync([]string{phone}); err != nil || len(res) != 1 || res[0].ID != "2" {
+		t.Fatalf("expected user to be found after login, got: %+v, %v", res, err)
+	}
+
+	// requests beyond the limits are rejected as a whole
+	_, err = ch1.LookupUsersSync([]string{"a", "b", "c", "d", "e", "f"})
+	assertLimitError(t, err, 6001, models.LimitError{Limit: models.LimitBatchSize, Max: 5})
+	_, err = ch1.LookupUsersSync([]string{"a", "b", "c", "d"})
+	assertLimitError(t, err, 6002, models.LimitError{Limit: models.LimitRate, Max: 9})
+
+	// rate limit is per user
+	if _, err := ch2.LookupUsersSync([]string{email}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertLimitError(t *testing.T, err error, code int, limit models.LimitError) {
+	cerr, ok := err.(*client.Error)
+	if !ok || cerr.Code != code {
+		t.Fatalf("expected error code %v, got: %v", code, err)
+	}
+	var l models.LimitError
+	if jerr := json.Unmarshal(cerr.Data, &l); jerr != nil || l != limit {
+		t.Fatalf("expected limit error %+v, got: %+v (%v)", limit, l, jerr)
+	}
+}
@@ -1,9 +1,13 @@
 package test
 
 import (
+	"encoding/json"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/titan-x/titan"
 	"github.com/titan-x/titan/data"
 	"github.com/titan-x/titan/models"
 )
@@ -120,9 +124,344 @@ func TestSendMsgOffline(t *testing.T) {
 	// todo: verify that there are no pending requests for either user 1 or 2
 }
 
+func TestDeliveryReceipt(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	// send a message from user 1 and have it delivered to user 2, with the time set by the server rather than the client
+	before := time.Now()
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Time: before.Add(-time.Hour), Message: "Hello!"}})
+	msgs := ch2.GetMessagesWait()
+	sent := msgs[0].Time
+	if sent.Before(before) || sent.After(time.Now()) {
+		t.Fatalf("expected message time to be set by the server, got: %v", sent)
+	}
+
+	// user 1 should receive a delivery receipt once user 2 ACKs the message
+	d := ch1.GetDeliveriesWait()
+	if len(d) != 1 {
+		t.Fatalf("expected receipt count: 1, got: %v", len(d))
+	}
+	if d[0].To != "2" || !d[0].Time.Equal(sent) || d[0].Delivered.Before(sent) {
+		t.Fatalf("unexpected delivery receipt: %+v", d[0])
+	}
+}
+
+func TestReadReceipt(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "Hello!"}})
+	msgs := ch2.GetMessagesWait()
+
+	// user 1 should be notified when user 2 reads the message
+	ch2.ReadMessagesSync([]models.ReadMarker{models.ReadMarker{Peer: "1", Time: msgs[0].Time}})
+	// markers for unknown users are dropped, so they are not synced below
+	ch2.ReadMessagesSync([]models.ReadMarker{models.ReadMarker{Peer: "no-such-user", Time: msgs[0].Time}})
+	rms := ch1.GetReadMarkersWait()
+	if len(rms) != 1 || rms[0].From != "2" || rms[0].Peer != "1" || !rms[0].Time.Equal(msgs[0].Time) {
+		t.Fatalf("unexpected read receipt: %+v", rms)
+	}
+
+	// read marker should be synced to each of user 2's next sessions, exactly once
+	for i := 0; i < 2; i++ {
+		ch2.CloseWait()
+		ch2 = sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+		rms = ch2.GetReadMarkersWait()
+		if len(rms) != 1 || rms[0].From != "2" || rms[0].Peer != "1" || !rms[0].Time.Equal(msgs[0].Time) {
+			t.Fatalf("unexpected read marker: %+v", rms)
+		}
+		select {
+		case rms := <-ch2.readChan:
+			t.Fatalf("read markers were synced more than once: %+v", rms)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	ch2.CloseWait()
+}
+
+func TestDuplicateSend(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	// retry the same message as if the connection was dropped before we got the response
+	m := models.Message{Key: "retry-key-1", To: "2", Message: "Hello!"}
+	ch1.SendMessagesSync([]models.Message{m})
+	ch1.SendMessagesSync([]models.Message{m})
+
+	msgs := ch2.GetMessagesWait()
+	if len(msgs) != 1 || msgs[0].ID == "" || msgs[0].Key != "" {
+		t.Fatalf("unexpected message: %+v", msgs)
+	}
+
+	select {
+	case m := <-ch2.inMsgsChan:
+		t.Fatalf("duplicate message was delivered: %+v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// delivery receipt should carry the same message ID
+	if d := ch1.GetDeliveriesWait(); d[0].ID != msgs[0].ID {
+		t.Fatalf("expected delivery receipt for message ID: %v, got: %v", msgs[0].ID, d[0].ID)
+	}
+}
+
+func TestSendLimits(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	lim := titan.Conf.Msg
+	batch := func(n, size int) []models.Message {
+		ms := make([]models.Message, n)
+		for i := range ms {
+			ms[i] = models.Message{To: "2", Message: strings.Repeat("a", size)}
+		}
+		return ms
+	}
+
+	cases := []struct {
+		msgs  []models.Message
+		code  int
+		limit models.LimitError
+	}{
+		{batch(lim.MaxBatchSize+1, 10), 7001, models.LimitError{Limit: models.LimitBatchSize, Max: lim.MaxBatchSize}},
+		{batch(lim.MaxRequestSize/lim.MaxBodySize+1, lim.MaxBodySize), 7002, models.LimitError{Limit: models.LimitRequestSize, Max: lim.MaxRequestSize}},
+	}
+
+	for _, c := range cases {
+		_, err := ch1.TrySendMessagesSync(c.msgs)
+		if err == nil || err.Code != c.code {
+			t.Fatalf("expected error code %v, got: %v", c.code, err)
+		}
+		var l models.LimitError
+		if jerr := json.Unmarshal(err.Data, &l); jerr != nil || l != c.limit {
+			t.Fatalf("expected limit error %+v, got: %+v (%v)", c.limit, l, jerr)
+		}
+	}
+
+	// none of the messages in rejected requests are queued
+	ch1.SendMessagesSync(batch(1, lim.MaxBodySize))
+	if m := ch2.GetMessagesWait(); len(m) != 1 || len(m[0].Message) != lim.MaxBodySize {
+		t.Fatalf("expected only the message within limits to be delivered, got %v messages", len(m))
+	}
+	select {
+	case m := <-ch2.inMsgsChan:
+		t.Fatalf("rejected message was delivered: %v messages", len(m))
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestSendResults(t *testing.T) {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	msg := titan.Conf.Msg
+	titan.Conf.Msg.RateLimit = 4
+	defer func() { titan.Conf.Msg = msg }()
+
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	res, err := ch1.TrySendMessagesSync([]models.Message{
+		models.Message{To: "2", Message: "first"},
+		models.Message{To: "2", Message: strings.Repeat("a", msg.MaxBodySize+1)},
+		models.Message{Group: "no-such-group", Message: "hello group"},
+		models.Message{To: "2", Message: "second", Key: "key-1"},
+		models.Message{To: "2", Message: "second", Key: "key-1"},
+		models.Message{To: "2", Message: "third"},
+		models.Message{To: "2", Message: "fourth"},
+		models.Message{To: "2", Message: "fifth"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := []string{
+		models.SendAccepted, models.SendTooLarge, models.SendUnknownRecipient, models.SendAccepted,
+		models.SendAccepted, models.SendAccepted, models.SendAccepted, models.SendRateLimited,
+	}
+	for i, s := range statuses {
+		if res[i].Status != s || (s == models.SendAccepted) != (res[i].ID != "") {
+			t.Fatalf("expected status %v for message %v, got: %+v", s, i, res[i])
+		}
+	}
+	if res[3].ID != res[4].ID {
+		t.Fatalf("expected duplicate message to have the same ID: %+v", res)
+	}
+
+	// only the accepted messages are delivered, once
+	var got []string
+	for len(got) < 4 {
+		for _, m := range ch2.GetMessagesWait() {
+			got = append(got, m.Message)
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "first,fourth,second,third" {
+		t.Fatalf("unexpected messages: %v", got)
+	}
+}
+
+func TestSendRecipients(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	if err := sh.db.SaveUser(&models.User{ID: "MiXeD", Email: "mixed@titan.x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// bot IDs and e-mail addresses are case-insensitive while user IDs are not
+	res, err := ch1.TrySendMessagesSync([]models.Message{
+		models.Message{To: "no-such-user", Message: "typo"},
+		models.Message{To: "nobody@titan", Message: "typo"},
+		models.Message{To: "", Message: "no recipient"},
+		models.Message{To: "mixed", Message: "wrong case"},
+		models.Message{To: "MiXeD", Message: "by user ID"},
+		models.Message{To: "ECHO", Message: "to bot"},
+		models.Message{To: strings.ToUpper(data.SeedUser2.Email), Message: "by e-mail"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := []string{models.SendUnknownRecipient, models.SendUnknownRecipient, models.SendUnknownRecipient, models.SendUnknownRecipient,
+		models.SendAccepted, models.SendAccepted, models.SendAccepted}
+	for i, s := range statuses {
+		if res[i].Status != s {
+			t.Fatalf("expected status %v for message %v, got: %+v", s, i, res[i])
+		}
+	}
+
+	// messages sent by e-mail are delivered as if they were sent to the user ID
+	msgs := ch2.GetMessagesWait()
+	if len(msgs) != 1 || msgs[0].Message != "by e-mail" || msgs[0].From != "1" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	if hist, _, _ := sh.db.GetMessages("1", "2", "", 10); len(hist) != 1 || hist[0].To != "2" {
+		t.Fatalf("expected message to be stored with the recipient user ID, got: %+v", hist)
+	}
+}
+
 func TestSendAsync(t *testing.T) {
 	// test case to do all of the following simultaneously to test the async nature of titan server
 	// - cert.auth
 	// - msg.recv
 	// - msg.send (bath to multiple people where some of whom are online)
 }
+
+func TestHistory(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	ch1.SendMessagesSync([]models.Message{
+		models.Message{To: "2", Message: "msg-1"},
+		models.Message{To: "2", Message: "msg-2"},
+		models.Message{To: "2", Message: "msg-3"},
+	})
+
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	h := ch2.GetHistorySync(models.HistoryQuery{Peer: "1", Limit: 2})
+	if len(h.Messages) != 2 || h.Messages[0].Message != "msg-3" || h.Messages[1].Message != "msg-2" || h.Cursor == "" {
+		t.Fatalf("unexpected first history page: %+v", h)
+	}
+	if h.Messages[0].ID == "" || h.Messages[0].From != "1" || h.Messages[0].To != "2" {
+		t.Fatalf("expected message details in history, got: %+v", h.Messages[0])
+	}
+
+	h = ch2.GetHistorySync(models.HistoryQuery{Peer: "1", Limit: 2, Cursor: h.Cursor})
+	if len(h.Messages) != 1 || h.Messages[0].Message != "msg-1" || h.Cursor != "" {
+		t.Fatalf("unexpected second history page: %+v", h)
+	}
+}
+
+func TestMixedCaseUserID(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	// generated user IDs are mixed case, so user IDs are never lowercased
+	u := &models.User{ID: "MixedCase", Email: "mixed.case@titan.x"}
+	if err := sh.db.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	chm := sh.GetClientHelper().AsDevice(u, "").Connect().JWTAuthSync()
+	defer chm.CloseWait()
+	chm.AddContactSync(models.Contact{ID: "1"})
+
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "MixedCase", Message: "hi"}})
+	if m := chm.GetMessagesWait(); len(m) != 1 || m[0].Message != "hi" {
+		t.Fatalf("expected message to be delivered, got: %+v", m)
+	}
+	ch1.GetDeliveriesWait()
+
+	if h := ch1.GetHistorySync(models.HistoryQuery{Peer: "MixedCase"}); len(h.Messages) != 1 || h.Messages[0].Message != "hi" {
+		t.Fatalf("expected message in history, got: %+v", h.Messages)
+	}
+
+	chm.ReadMessagesSync([]models.ReadMarker{models.ReadMarker{Peer: "1", Time: time.Now()}})
+	if r := ch1.GetReadMarkersWait(); len(r) != 1 || r[0].From != "MixedCase" {
+		t.Fatalf("expected read marker from user, got: %+v", r)
+	}
+
+	if p := ch1.SubscribePresenceSync([]string{"MixedCase"}); len(p) != 1 || p[0].UserID != "MixedCase" || !p[0].Online {
+		t.Fatalf("expected user to be online, got: %+v", p)
+	}
+
+	ch1.SendSignalsSync([]models.Signal{models.Signal{To: "MixedCase", Type: models.SignalTypingStart}})
+	if s := chm.GetSignalsWait(); len(s) != 1 || s[0].From != "1" {
+		t.Fatalf("expected signal to be delivered, got: %+v", s)
+	}
+
+	g := ch1.CreateGroupSync("mixed", []string{"MixedCase"})
+	if len(g.Members) != 2 || memberIndex(g, "MixedCase") == -1 {
+		t.Fatalf("expected user to be added to group, got: %+v", g.Members)
+	}
+	if g = ch1.RemoveGroupMembersSync(g.ID, []string{"MixedCase"}); len(g.Members) != 1 || memberIndex(g, "MixedCase") != -1 {
+		t.Fatalf("expected user to be removed from group, got: %+v", g.Members)
+	}
+}
+
+// memberIndex returns the index of the user in the group members, or -1 if the user is not a member.
+func memberIndex(g *models.Group, userID string) int {
+	for i, m := range g.Members {
+		if m.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
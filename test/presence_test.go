@@ -0,0 +1,85 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+func TestPresence(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// presence of the users who do not have us as a contact is hidden
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	if p := ch1.SubscribePresenceSync([]string{"2"}); len(p) != 1 || p[0].UserID != "2" || p[0].Online || !p[0].LastSeen.IsZero() {
+		t.Fatalf("expected user 2 to look offline, got: %+v", p)
+	}
+	ch2.AddContactSync(models.Contact{ID: "1"})
+	ch2.CloseWait()
+
+	p := ch1.SubscribePresenceSync([]string{"2"})
+	if len(p) != 1 || p[0].UserID != "2" || p[0].Online || p[0].LastSeen.IsZero() {
+		t.Fatalf("expected user 2 to be offline, got: %+v", p)
+	}
+
+	ch2 = sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	if p := ch1.GetPresenceWait(); len(p) != 1 || p[0].UserID != "2" || !p[0].Online {
+		t.Fatalf("expected user 2 to come online, got: %+v", p)
+	}
+
+	ch2.CloseWait()
+	if p := ch1.GetPresenceWait(); len(p) != 1 || p[0].UserID != "2" || p[0].Online || p[0].LastSeen.IsZero() {
+		t.Fatalf("expected user 2 to go offline, got: %+v", p)
+	}
+}
+
+func TestPresenceBlocking(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	ch2.AddContactSync(models.Contact{ID: "1"})
+
+	if p := ch1.SubscribePresenceSync([]string{"2"}); len(p) != 1 || !p[0].Online {
+		t.Fatalf("expected user 2 to be online, got: %+v", p)
+	}
+
+	// blocking drops the existing subscription of the blocked user
+	ch2.BlockContactSync("1")
+	ch2.CloseWait()
+	select {
+	case p := <-ch1.presChan:
+		t.Fatalf("expected no presence updates from the user who blocked the subscriber, got: %+v", p)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// users who blocked the subscriber always look offline, with no last seen time
+	ch2 = sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	if p := ch1.SubscribePresenceSync([]string{"2"}); len(p) != 1 || p[0].UserID != "2" || p[0].Online || !p[0].LastSeen.IsZero() {
+		t.Fatalf("expected user 2 to look offline, got: %+v", p)
+	}
+}
+
+func TestPresenceLimit(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	ids := make([]string, 1001)
+	for i := range ids {
+		ids[i] = "2"
+	}
+	_, err := ch1.TrySubscribePresenceSync(ids)
+	assertLimitError(t, err, 8001, models.LimitError{Limit: models.LimitBatchSize, Max: 1000})
+}
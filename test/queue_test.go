@@ -1,8 +1,14 @@
 package test
 
 import (
+	"errors"
+	"math"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/neptulon/neptulon"
+	"github.com/titan-x/titan"
 	"github.com/titan-x/titan/data"
 	"github.com/titan-x/titan/models"
 )
@@ -50,3 +56,204 @@ func TestMultipleConcurrentQueuedMessages(t *testing.T) {
 		t.Fatalf("expected 4 messages, got %v", len(msgs))
 	}
 }
+
+func TestAckTimeoutRedelivery(t *testing.T) {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	queueConf := titan.Conf.Queue
+	titan.Conf.Queue.AckTimeout = time.Millisecond * 100
+	titan.Conf.Queue.RetryBackoff = time.Millisecond * 10
+	defer func() { titan.Conf.Queue = queueConf }()
+
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2)
+
+	// delay the ACK for the first delivery beyond the ACK timeout
+	var n int32
+	msgs := make(chan models.Message, 10)
+	ch2.Client.InMsgHandler(func(m []models.Message) error {
+		msgs <- m[0]
+		if atomic.AddInt32(&n, 1) == 1 {
+			time.Sleep(time.Millisecond * 300)
+		}
+		return nil
+	})
+	ch2.Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "Hello!"}})
+
+	var ids []string
+	for len(ids) < 2 {
+		select {
+		case m := <-msgs:
+			ids = append(ids, m.ID)
+		case <-time.After(time.Second):
+			t.Fatal("message was not redelivered after ACK timeout")
+		}
+	}
+	if ids[0] != ids[1] {
+		t.Fatalf("expected redelivery of the same message, got message IDs: %v", ids)
+	}
+}
+
+func TestDisconnectRedelivery(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// fail to handle the incoming message, which drops the connection without an ACK
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2)
+	failed := make(chan models.Message, 1)
+	ch2.Client.InMsgHandler(func(m []models.Message) error {
+		failed <- m[0]
+		return errors.New("failed to handle message")
+	})
+	ch2.Connect().JWTAuthSync()
+
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "Hello!"}})
+	var m models.Message
+	select {
+	case m = <-failed:
+	case <-time.After(time.Second * 3):
+		t.Fatal("message was not delivered")
+	}
+	ch2.CloseWait()
+
+	// message should be redelivered upon reconnect
+	ch2 = sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	msgs := ch2.GetMessagesWait()
+	if msgs[0].ID != m.ID {
+		t.Fatalf("expected redelivery of message ID: %v, got: %v", m.ID, msgs[0].ID)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	queueConf := titan.Conf.Queue
+	titan.Conf.Queue.AckTimeout = time.Millisecond * 50
+	titan.Conf.Queue.MaxAttempts = 2
+	titan.Conf.Queue.RetryBackoff = time.Millisecond * 10
+	defer func() { titan.Conf.Queue = queueConf }()
+
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// hold off the ACK for all delivery attempts till the end of the test
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2)
+	block := make(chan bool)
+	ch2.Client.InMsgHandler(func(m []models.Message) error {
+		<-block
+		return nil
+	})
+	ch2.Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	defer close(block)
+
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "Hello!"}})
+
+	f := ch1.GetFailuresWait()
+	if len(f) != 1 || f[0].To != "2" || f[0].ID == "" || f[0].Reason == "" {
+		t.Fatalf("expected a failure notice for the message, got: %+v", f)
+	}
+
+	dls, ok := sh.server.DeadLetters()
+	if !ok {
+		t.Fatal("expected queue to have a dead-letter store")
+	}
+	l := dls.DeadLetters()
+	if len(l) != 1 || l[0].UserID != "2" || l[0].Method != "msg.recv" || l[0].Attempts != 2 {
+		t.Fatalf("expected the message in dead-letters, got: %+v", l)
+	}
+
+	dls.PurgeDeadLetters(l[0].ID)
+	if l := dls.DeadLetters(); len(l) != 0 {
+		t.Fatalf("expected dead-letters to be purged, got: %+v", l)
+	}
+}
+
+func TestClientErrorIsNotFailure(t *testing.T) {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	queueConf := titan.Conf.Queue
+	titan.Conf.Queue.RetryBackoff = time.Millisecond * 10
+	defer func() { titan.Conf.Queue = queueConf }()
+
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// respond to the first deliveries with the error codes that the queue once used for failures
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2)
+	var n int32
+	ch2.Client.MiddlewareFunc(func(ctx *neptulon.ReqCtx) error {
+		if ctx.Method != "msg.recv" {
+			return ctx.Next()
+		}
+		if i := atomic.AddInt32(&n, 1); i <= 2 {
+			ctx.Res = nil
+			ctx.Err = &neptulon.ResError{Code: 1000 + int(i), Message: "request expired before delivery"}
+		}
+		return ctx.Next()
+	})
+	ch2.Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+
+	// client errors are only failed attempts, so the message is retried rather than reported as failed
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "Hello!"}})
+	if d := ch1.GetDeliveriesWait(); len(d) != 1 || d[0].To != "2" {
+		t.Fatalf("expected a delivery receipt, got: %+v", d)
+	}
+	select {
+	case f := <-ch1.failChan:
+		t.Fatalf("expected no failure notice, got: %+v", f)
+	default:
+	}
+}
+
+func TestMessageExpiry(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// send a short lived message to an offline user
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", TTL: 1, Message: "Hello!"}})
+
+	f := ch1.GetFailuresWait()
+	if len(f) != 1 || f[0].To != "2" || f[0].ID == "" {
+		t.Fatalf("expected an expiry notice for the message, got: %+v", f)
+	}
+
+	// expired message should not be delivered when user comes online
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	select {
+	case m := <-ch2.inMsgsChan:
+		t.Fatalf("expected expired message not to be delivered, got: %+v", m)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	// time-to-live values beyond the server default are capped rather than overflowing into the past
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", TTL: math.MaxInt64, Message: "Hello again!"}})
+	if m := ch2.GetMessagesWait(); len(m) != 1 || m[0].Message != "Hello again!" {
+		t.Fatalf("expected long lived message to be delivered, got: %+v", m)
+	}
+}
@@ -0,0 +1,34 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+func TestTypingSignal(t *testing.T) {
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// signals to offline users should be dropped
+	ch1.SendSignalsSync([]models.Signal{models.Signal{To: "2", Type: models.SignalTypingStart}})
+
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	defer ch2.CloseWait()
+	select {
+	case s := <-ch2.sigChan:
+		t.Fatalf("expected signal to offline user to be dropped, got: %+v", s)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	ch1.SendSignalsSync([]models.Signal{models.Signal{To: "2", Type: models.SignalTypingStop}})
+	s := ch2.GetSignalsWait()
+	if len(s) != 1 || s[0].From != "1" || s[0].Type != models.SignalTypingStop {
+		t.Fatalf("unexpected signal: %+v", s)
+	}
+}
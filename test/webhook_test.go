@@ -0,0 +1,147 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+func TestWebhookBot(t *testing.T) {
+	reqs := make(chan models.Message, 10)
+	var flaky int32
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts := r.Header.Get("X-Titan-Timestamp")
+		h := hmac.New(sha256.New, []byte("secret"))
+		h.Write([]byte(ts + "."))
+		h.Write(body)
+		if !hmac.Equal([]byte(r.Header.Get("X-Titan-Signature")), []byte("sha256="+hex.EncodeToString(h.Sum(nil)))) {
+			t.Errorf("invalid webhook signature: %v", r.Header.Get("X-Titan-Signature"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if sec, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(sec, 0)) > time.Minute || time.Until(time.Unix(sec, 0)) > time.Minute {
+			t.Errorf("invalid webhook timestamp: %v", ts)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var m models.Message
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Errorf("malformed webhook request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reqs <- m
+
+		switch m.Message {
+		case "flaky":
+			// fail the first attempt only
+			if atomic.AddInt32(&flaky, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "down":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "reject":
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case "silent":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode([]models.Message{models.Message{Message: "re: " + m.Message}})
+	}))
+	defer ws.Close()
+
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	conf := titan.Conf
+	titan.Conf.Queue.RetryBackoff = time.Millisecond * 10
+	titan.Conf.Bots = titan.Bots{WebhookTimeout: time.Second, WebhookMaxAttempts: 2}
+	defer func() { titan.Conf = conf }()
+	hooks, _ := json.Marshal([]titan.Webhook{titan.Webhook{ID: "hook", Description: "Replies over HTTP.", URL: ws.URL, Secret: "secret"}})
+	os.Setenv("BOT_WEBHOOKS", string(hooks))
+	defer os.Unsetenv("BOT_WEBHOOKS")
+
+	sh := NewServerHelper(t).ListenAndServe()
+	defer sh.CloseWait()
+
+	ch := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch.CloseWait()
+
+	if bs := ch.ListBotsSync(); len(bs) != 2 || bs[1].ID != "hook" || bs[1].Name != "hook" || bs[1].Description != "Replies over HTTP." {
+		t.Fatalf("expected webhook bot to be listed, got: %+v", bs)
+	}
+
+	// message is forwarded to the webhook, and the response is sent back as a reply
+	res, _ := ch.TrySendMessagesSync([]models.Message{models.Message{To: "hook", Message: "hello"}})
+	if m := getWebhookReqWait(t, reqs); m.ID != res[0].ID || m.From != "1" || m.To != "hook" || m.Message != "hello" {
+		t.Fatalf("unexpected webhook request: %+v", m)
+	}
+	if msgs := ch.GetMessagesWait(); len(msgs) != 1 || msgs[0].From != "hook" || msgs[0].Message != "re: hello" {
+		t.Fatalf("unexpected reply: %+v", msgs)
+	}
+
+	// failed requests are retried
+	ch.SendMessagesSync([]models.Message{models.Message{To: "hook", Message: "flaky"}})
+	getWebhookReqWait(t, reqs)
+	getWebhookReqWait(t, reqs)
+	if msgs := ch.GetMessagesWait(); len(msgs) != 1 || msgs[0].Message != "re: flaky" {
+		t.Fatalf("unexpected reply: %+v", msgs)
+	}
+
+	// webhooks do not have to reply
+	ch.SendMessagesSync([]models.Message{models.Message{To: "hook", Message: "silent"}})
+	getWebhookReqWait(t, reqs)
+
+	// sender is notified when the webhook is down after all attempts, or rejects the message right away
+	res, _ = ch.TrySendMessagesSync([]models.Message{models.Message{To: "hook", Message: "down"}})
+	getWebhookReqWait(t, reqs)
+	getWebhookReqWait(t, reqs)
+	if f := ch.GetFailuresWait(); len(f) != 1 || f[0].ID != res[0].ID || f[0].To != "hook" {
+		t.Fatalf("expected a failure notice for the message, got: %+v", f)
+	}
+
+	res, _ = ch.TrySendMessagesSync([]models.Message{models.Message{To: "hook", Message: "reject"}})
+	getWebhookReqWait(t, reqs)
+	if f := ch.GetFailuresWait(); len(f) != 1 || f[0].ID != res[0].ID {
+		t.Fatalf("expected a failure notice for the message, got: %+v", f)
+	}
+
+	select {
+	case m := <-reqs:
+		t.Fatalf("expected no more webhook requests, got: %+v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+	select {
+	case m := <-ch.inMsgsChan:
+		t.Fatalf("expected no more replies, got: %+v", m)
+	default:
+	}
+}
+
+func getWebhookReqWait(t *testing.T, reqs chan models.Message) models.Message {
+	select {
+	case m := <-reqs:
+		return m
+	case <-time.After(time.Second * 3):
+		t.Fatal("did not receive webhook request in time")
+	}
+	return models.Message{}
+}
@@ -0,0 +1,246 @@
+package test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/titan-x/titan/models"
+)
+
+// WebPushHelper is a fake Web Push service for testing, standing in for the push service of a single browser.
+// It verifies the VAPID signature of the incoming push messages and decrypts their payloads with the keys of the browser.
+type WebPushHelper struct {
+	testing *testing.T
+	server  *httptest.Server
+	key     *ecdsa.PrivateKey // ECDH key pair of the browser
+	auth    []byte            // authentication secret of the browser
+	msgChan chan map[string]string
+
+	mutex sync.Mutex
+	gone  bool // whether the subscription is expired
+}
+
+// NewWebPushHelper creates and starts a fake Web Push service listening on a random local port.
+func NewWebPushHelper(t *testing.T) *WebPushHelper {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to create browser key pair:", err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal("Failed to create browser auth secret:", err)
+	}
+
+	wh := &WebPushHelper{testing: t, key: key, auth: auth, msgChan: make(chan map[string]string, 100)}
+	wh.server = httptest.NewServer(http.HandlerFunc(wh.handle))
+	return wh
+}
+
+// Subscription returns the subscription that a browser would register with the application server.
+func (wh *WebPushHelper) Subscription() models.WebPushSubscription {
+	return models.WebPushSubscription{
+		Endpoint: wh.server.URL + "/push/1",
+		Keys: models.WebPushSubKeys{
+			P256dh: base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), wh.key.X, wh.key.Y)),
+			Auth:   base64.RawURLEncoding.EncodeToString(wh.auth),
+		},
+	}
+}
+
+// Expire makes the service respond to the subsequent push messages with 410 Gone, as if the browser unsubscribed.
+func (wh *WebPushHelper) Expire() {
+	wh.mutex.Lock()
+	wh.gone = true
+	wh.mutex.Unlock()
+}
+
+// GetMessageWait waits for a push message and returns its decrypted payload.
+func (wh *WebPushHelper) GetMessageWait() map[string]string {
+	select {
+	case m := <-wh.msgChan:
+		return m
+	case <-time.After(time.Second * 3):
+		wh.testing.Fatal("did not receive any push message in time")
+	}
+	return nil
+}
+
+// NoMessages verifies that no push message was received.
+func (wh *WebPushHelper) NoMessages() {
+	select {
+	case m := <-wh.msgChan:
+		wh.testing.Fatalf("expected no push messages, got: %+v", m)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// Close stops the service.
+func (wh *WebPushHelper) Close() {
+	wh.server.Close()
+}
+
+func (wh *WebPushHelper) handle(w http.ResponseWriter, r *http.Request) {
+	if err := wh.verifyVAPID(r); err != nil {
+		wh.testing.Errorf("fake Web Push service: invalid VAPID authorization: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("TTL") == "" || r.Header.Get("Content-Encoding") != "aes128gcm" {
+		wh.testing.Errorf("fake Web Push service: missing or invalid headers: %v", r.Header)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	wh.mutex.Lock()
+	gone := wh.gone
+	wh.mutex.Unlock()
+	if gone {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p, err := wh.decrypt(body)
+	if err != nil {
+		wh.testing.Errorf("fake Web Push service: failed to decrypt payload: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var m map[string]string
+	if err := json.Unmarshal(p, &m); err != nil {
+		wh.testing.Errorf("fake Web Push service: malformed payload: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	wh.msgChan <- m
+	w.WriteHeader(http.StatusCreated)
+}
+
+// verifyVAPID verifies the VAPID token in the authorization header (vapid t=<token>, k=<public key>).
+func (wh *WebPushHelper) verifyVAPID(r *http.Request) error {
+	var t, k string
+	for _, p := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "vapid "), ",") {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "t=") {
+			t = p[2:]
+		} else if strings.HasPrefix(p, "k=") {
+			k = p[2:]
+		}
+	}
+
+	kb, err := base64.RawURLEncoding.DecodeString(k)
+	if err != nil {
+		return err
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), kb)
+	if x == nil {
+		return errors.New("invalid public key")
+	}
+
+	jt, err := jwt.Parse(t, func(token *jwt.Token) (interface{}, error) {
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	})
+	if err != nil || !jt.Valid {
+		return fmt.Errorf("invalid token: %v", err)
+	}
+	if jt.Claims["aud"] != wh.server.URL {
+		return fmt.Errorf("unexpected audience: %v", jt.Claims["aud"])
+	}
+	return nil
+}
+
+// decrypt decrypts an aes128gcm encoded payload as per RFC 8291.
+func (wh *WebPushHelper) decrypt(body []byte) ([]byte, error) {
+	if len(body) < 21 || len(body) < 21+int(body[20]) {
+		return nil, errors.New("truncated header")
+	}
+	salt, rs, idLen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	asPub, ciphertext := body[21:21+idLen], body[21+idLen:]
+	if uint32(len(ciphertext)) > rs {
+		return nil, errors.New("payload spans multiple records")
+	}
+
+	c := elliptic.P256()
+	ax, ay := elliptic.Unmarshal(c, asPub)
+	if ax == nil {
+		return nil, errors.New("invalid application server public key")
+	}
+	sx, _ := c.ScalarMult(ax, ay, wh.key.D.Bytes())
+	secret := make([]byte, 32)
+	sb := sx.Bytes()
+	copy(secret[32-len(sb):], sb)
+
+	uaPub := elliptic.Marshal(c, wh.key.X, wh.key.Y)
+	info := append(append([]byte("WebPush: info\x00"), uaPub...), asPub...)
+	ikm := webPushHKDF(wh.auth, secret, info, 32)
+	cek := webPushHKDF(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := webPushHKDF(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	p, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// strip the padding, which ends with the last record delimiter
+	i := len(p) - 1
+	for i >= 0 && p[i] == 0 {
+		i--
+	}
+	if i < 0 || p[i] != 2 {
+		return nil, errors.New("missing last record delimiter")
+	}
+	return p[:i], nil
+}
+
+func webPushHKDF(salt, ikm, info []byte, length int) []byte {
+	h := hmac.New(sha256.New, salt)
+	h.Write(ikm)
+	h = hmac.New(sha256.New, h.Sum(nil))
+	h.Write(info)
+	h.Write([]byte{1})
+	return h.Sum(nil)[:length]
+}
+
+// newVAPIDKey creates a base64url encoded VAPID private key.
+func newVAPIDKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to create VAPID key:", err)
+	}
+	d := make([]byte, 32)
+	db := new(big.Int).Set(key.D).Bytes()
+	copy(d[32-len(db):], db)
+	return base64.RawURLEncoding.EncodeToString(d)
+}
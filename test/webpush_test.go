@@ -0,0 +1,70 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/titan-x/titan"
+	"github.com/titan-x/titan/data"
+	"github.com/titan-x/titan/models"
+)
+
+// newWebPushServerHelper creates a server helper with Web Push configured with a new VAPID key.
+// Insecure endpoints are allowed as the fake push service listens on plain HTTP on the loopback interface.
+// Returned function restores the original Web Push configuration.
+func newWebPushServerHelper(t *testing.T) (*ServerHelper, func()) {
+	if (titan.Conf == titan.Config{}) {
+		titan.InitConf("test")
+	}
+	wp := titan.Conf.WebPush
+	titan.Conf.WebPush = titan.WebPush{Subject: "mailto:admin@titan.x", VAPIDPrivateKey: newVAPIDKey(t), Insecure: true}
+	return NewServerHelper(t), func() { titan.Conf.WebPush = wp }
+}
+
+func TestWebPush(t *testing.T) {
+	wh := NewWebPushHelper(t)
+	defer wh.Close()
+
+	sh, restore := newWebPushServerHelper(t)
+	defer restore()
+	sh.ListenAndServe()
+	defer sh.CloseWait()
+
+	ch1 := sh.GetClientHelper().AsUser(&data.SeedUser1).Connect().JWTAuthSync()
+	defer ch1.CloseWait()
+
+	// browser subscribes and then the tab is closed
+	ch2 := sh.GetClientHelper().AsUser(&data.SeedUser2).Connect().JWTAuthSync()
+	ch2.SubscribePushSync(wh.Subscription())
+	ch2.SubscribePushSync(wh.Subscription()) // subscribing again is a no-op
+	ch2.CloseWait()
+	if u, ok := sh.db.GetByID("2"); !ok || len(u.WebPush) != 1 {
+		t.Fatalf("expected a single Web Push subscription, got: %+v", u)
+	}
+
+	// offline user gets an encrypted push message with a preview of the message
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "wake up"}})
+	m := wh.GetMessageWait()
+	if m["n.message_type"] != "message" || m["n.from"] != "1" || m["n.message"] != "wake up" || m["n.id"] == "" {
+		t.Fatalf("expected a push message with message preview, got: %+v", m)
+	}
+
+	// messages too big for a push message are signaled to be fetched over WebSocket
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: strings.Repeat("a", 5000)}})
+	m = wh.GetMessageWait()
+	if m["n.message_type"] != "fetch" || m["n.from"] != "1" || m["n.message"] != "" {
+		t.Fatalf("expected a fetch push message, got: %+v", m)
+	}
+
+	// expired subscriptions are removed
+	wh.Expire()
+	ch1.SendMessagesSync([]models.Message{models.Message{To: "2", Message: "are you there"}})
+	for i := 0; i < 300; i++ {
+		if u, _ := sh.db.GetByID("2"); len(u.WebPush) == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("expected expired Web Push subscription to be removed")
+}
@@ -0,0 +1,148 @@
+package titan
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/titan-x/titan/models"
+)
+
+// Maximum size of a webhook response body.
+const webhookMaxResponseSize = 1024 * 1024
+
+// Webhook describes a bot that is hosted outside of the server, to which the messages sent to the bot are forwarded over HTTP.
+//
+// Each message is POSTed to the webhook URL as a JSON encoded models.Message, signed with the shared secret.
+// Request time is sent in the X-Titan-Timestamp header as Unix time in seconds, and the signature is sent in the X-Titan-Signature header
+// as "sha256=" followed by the hex encoded HMAC-SHA256 of the timestamp, a dot, and the request body (i.e. "1500000000.{...}").
+// Receivers should compute the same HMAC and compare it in constant time, and reject the requests with timestamps that are
+// more than a few minutes off, so a captured request cannot be replayed later.
+// Response body can be empty, or a JSON array of messages to be sent back to the sender as replies.
+type Webhook struct {
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url"`
+	Secret      string `json:"secret"`
+}
+
+// webhookBot forwards the messages sent to the bot to a webhook.
+type webhookBot struct {
+	hook        Webhook
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// newWebhookBot creates a webhook bot that makes up to maxAttempts requests for each message, waiting for backoff before the first retry and doubling the wait after each failed retry.
+func newWebhookBot(w Webhook, timeout time.Duration, maxAttempts int, backoff time.Duration) *webhookBot {
+	return &webhookBot{hook: w, client: &http.Client{Timeout: timeout}, maxAttempts: maxAttempts, backoff: backoff}
+}
+
+func (b *webhookBot) Info() models.BotInfo {
+	name := b.hook.Name
+	if name == "" {
+		name = b.hook.ID
+	}
+	return models.BotInfo{ID: b.hook.ID, Name: name, Description: b.hook.Description}
+}
+
+// Receive forwards the message to the webhook, retrying the failed requests unless the webhook rejects the message.
+func (b *webhookBot) Receive(m models.Message) ([]models.Message, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: failed to serialize message: %v", err)
+	}
+
+	backoff := b.backoff
+	for attempt := 1; ; attempt++ {
+		replies, err := b.post(body)
+		if err == nil {
+			return replies, nil
+		}
+
+		werr, ok := err.(*webhookError)
+		if !ok || !werr.temporary() || attempt >= b.maxAttempts {
+			return nil, err
+		}
+
+		log.Printf("webhook: %v: attempt %v failed, retrying in %v: %v", b.hook.ID, attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single webhook request with the given body, and returns the replies in the response.
+func (b *webhookBot) post(body []byte) ([]models.Message, error) {
+	req, err := http.NewRequest("POST", b.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("webhook: failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Titan-Bot", b.hook.ID)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Titan-Timestamp", ts)
+	req.Header.Set("X-Titan-Signature", webhookSignature(b.hook.Secret, ts, body))
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, &webhookError{Err: err.Error()}
+	}
+	defer res.Body.Close()
+
+	rb, err := ioutil.ReadAll(io.LimitReader(res.Body, webhookMaxResponseSize+1))
+	if err != nil {
+		return nil, &webhookError{Status: res.StatusCode, Err: err.Error()}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &webhookError{Status: res.StatusCode, Err: string(rb)}
+	}
+	if len(rb) > webhookMaxResponseSize {
+		return nil, fmt.Errorf("webhook: response exceeds the maximum size of %v bytes", webhookMaxResponseSize)
+	}
+	if len(bytes.TrimSpace(rb)) == 0 {
+		return nil, nil
+	}
+
+	var replies []models.Message
+	if err := json.Unmarshal(rb, &replies); err != nil {
+		return nil, fmt.Errorf("webhook: cannot deserialize response: %v", err)
+	}
+	return replies, nil
+}
+
+// webhookError is a failed webhook request. Status is zero if the request failed before a response was received (i.e. timeout).
+type webhookError struct {
+	Status int
+	Err    string
+}
+
+func (e *webhookError) Error() string {
+	if e.Status == 0 {
+		return "webhook: request failed: " + e.Err
+	}
+	return fmt.Sprintf("webhook: request failed with status %v: %v", e.Status, e.Err)
+}
+
+// temporary tells whether the request can be retried. Webhooks reject messages with 4xx statuses, except for timeouts and rate limiting.
+func (e *webhookError) temporary() bool {
+	return e.Status == 0 || e.Status >= 500 || e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests
+}
+
+// webhookSignature signs a webhook request body along with its timestamp, with the shared secret of the webhook.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
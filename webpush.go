@@ -0,0 +1,323 @@
+package titan
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/titan-x/titan/models"
+)
+
+const (
+	// record size of the encrypted content, which holds the entire payload in a single record
+	webPushRecordSize = 4096
+
+	// size of the aes128gcm content coding header: salt (16) + record size (4) + key ID length (1) + key ID (65 byte public key)
+	webPushHeaderSize = 86
+
+	// maximum size of the payload that fits in a single record, after the padding delimiter (1) and the AEAD tag (16)
+	webPushMaxPayload = webPushRecordSize - webPushHeaderSize - 17
+
+	// maximum time-to-live of a push message (4 weeks)
+	webPushMaxTTL = 2419200
+
+	// VAPID tokens should not be valid for more than 24 hours
+	webPushVAPIDTTL = time.Hour * 12
+
+	webPushTimeout = time.Second * 30
+)
+
+// networks that push services cannot be on: unspecified, loopback, private, shared (CGNAT), and link-local addresses
+var webPushBlockedNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	ns := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		ns[i] = n
+	}
+	return ns
+}
+
+// webPushClient sends Web Push messages to browsers, as per RFC 8030.
+// Payloads are encrypted with the keys of the subscription as per RFC 8291 (aes128gcm),
+// and requests are signed with the VAPID key of the application server as per RFC 8292.
+type webPushClient struct {
+	subject string // contact URI of the application server (mailto: or https:)
+	key     *ecdsa.PrivateKey
+	pubKey  string // base64url encoded VAPID public key
+	client  *http.Client
+}
+
+// webPushError is an error response returned by a push service.
+type webPushError struct {
+	Status int
+	Body   string
+}
+
+func (e *webPushError) Error() string {
+	return fmt.Sprintf("webpush: request failed with status %v: %v", e.Status, e.Body)
+}
+
+// expired returns true if the subscription is no longer valid, so it should not be used again.
+func (e *webPushError) expired() bool {
+	return e.Status == http.StatusNotFound || e.Status == http.StatusGone
+}
+
+// newWebPushClient creates a Web Push client with the given VAPID subject and base64url encoded VAPID private key.
+// Unless insecure is set, the client only connects to push services on public IP addresses.
+func newWebPushClient(subject, privateKey string, insecure bool) (*webPushClient, error) {
+	d, err := webPushDecode(privateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("webpush: VAPID private key should be a base64url encoded 32 byte P-256 private key")
+	}
+
+	c := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = c
+	key.PublicKey.X, key.PublicKey.Y = c.ScalarBaseMult(d)
+
+	hc := &http.Client{Timeout: webPushTimeout}
+	if !insecure {
+		hc.Transport = &http.Transport{Dial: webPushDial, TLSHandshakeTimeout: webPushTimeout}
+	}
+
+	return &webPushClient{
+		subject: subject,
+		key:     key,
+		pubKey:  base64.RawURLEncoding.EncodeToString(elliptic.Marshal(c, key.PublicKey.X, key.PublicKey.Y)),
+		client:  hc,
+	}, nil
+}
+
+// webPushDial connects to a push service only if its host resolves to public IP addresses,
+// so that host names pointing to the local network are rejected along with IP addresses.
+func webPushDial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !webPushPublicIP(ip) {
+			return nil, fmt.Errorf("webpush: push service host %v resolves to non-public address %v", host, ip)
+		}
+	}
+	return (&net.Dialer{Timeout: webPushTimeout}).Dial(network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// webPushPublicHost returns false if the host (with an optional port) is a local host name or a non-public IP address.
+func webPushPublicHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return webPushPublicIP(ip)
+	}
+	return true
+}
+
+func webPushPublicIP(ip net.IP) bool {
+	for _, n := range webPushBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// send encrypts and sends a payload to the given subscription. If the push service rejects the message, a *webPushError is returned.
+func (w *webPushClient) send(sub models.WebPushSubscription, payload []byte, ttl int) error {
+	if len(payload) > webPushMaxPayload {
+		return fmt.Errorf("webpush: payload size %v exceeds the limit of %v bytes", len(payload), webPushMaxPayload)
+	}
+
+	body, err := webPushEncrypt(sub, payload)
+	if err != nil {
+		return err
+	}
+
+	auth, err := w.vapidAuth(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webpush: failed to create request: %v", err)
+	}
+
+	if ttl > webPushMaxTTL {
+		ttl = webPushMaxTTL
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", auth)
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webpush: request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	return &webPushError{Status: res.StatusCode, Body: string(b)}
+}
+
+// vapidAuth creates the VAPID authorization header for the push service that the endpoint belongs to.
+func (w *webPushClient) vapidAuth(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("webpush: invalid endpoint: %v", err)
+	}
+
+	t := jwt.New(jwt.SigningMethodES256)
+	t.Claims["aud"] = u.Scheme + "://" + u.Host
+	t.Claims["exp"] = time.Now().Add(webPushVAPIDTTL).Unix()
+	t.Claims["sub"] = w.subject
+	s, err := t.SignedString(w.key)
+	if err != nil {
+		return "", fmt.Errorf("webpush: failed to sign VAPID token: %v", err)
+	}
+
+	return "vapid t=" + s + ", k=" + w.pubKey, nil
+}
+
+// webPushEncrypt encrypts the payload for the given subscription in a single aes128gcm record, as per RFC 8291.
+func webPushEncrypt(sub models.WebPushSubscription, payload []byte) ([]byte, error) {
+	uaPub, err := webPushDecode(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid p256dh key: %v", err)
+	}
+	authSecret, err := webPushDecode(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid auth secret: %v", err)
+	}
+
+	c := elliptic.P256()
+	ux, uy := elliptic.Unmarshal(c, uaPub)
+	if ux == nil {
+		return nil, errors.New("webpush: p256dh key is not a valid P-256 public key")
+	}
+
+	// ephemeral key pair of the application server, which is used only for this message
+	asPriv, ax, ay, err := elliptic.GenerateKey(c, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to generate key pair: %v", err)
+	}
+	asPub := elliptic.Marshal(c, ax, ay)
+
+	sx, _ := c.ScalarMult(ux, uy, asPriv)
+	ecdhSecret := make([]byte, 32)
+	sb := sx.Bytes()
+	copy(ecdhSecret[32-len(sb):], sb)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("webpush: failed to generate salt: %v", err)
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPub...), asPub...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to create cipher: %v", err)
+	}
+
+	// 0x02 delimiter marks the last (and only) record, with no further padding
+	plaintext := append(append([]byte{}, payload...), 2)
+
+	header := make([]byte, webPushHeaderSize)
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[16:], webPushRecordSize)
+	header[20] = byte(len(asPub))
+	copy(header[21:], asPub)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// hkdf derives a key of the given length (max 32 bytes) with HMAC-SHA-256 based key derivation function, as per RFC 5869.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	h := hmac.New(sha256.New, salt)
+	h.Write(ikm)
+	prk := h.Sum(nil)
+
+	h = hmac.New(sha256.New, prk)
+	h.Write(info)
+	h.Write([]byte{1})
+	return h.Sum(nil)[:length]
+}
+
+// webPushDecode decodes base64url encoded subscription keys, with or without padding.
+func webPushDecode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// webPushPayload creates the push message payload for a message, which has the same fields as GCM notifications.
+// Message text is left out if the payload does not fit in a push message, signaling the browser to fetch it over WebSocket.
+func webPushPayload(m models.Message) ([]byte, error) {
+	d := map[string]string{"n.message_type": "message", "n.id": m.ID, "n.from": m.From, "n.message": m.Message}
+	if m.Group != "" {
+		d["n.group"] = m.Group
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to serialize payload: %v", err)
+	}
+	if len(b) <= webPushMaxPayload {
+		return b, nil
+	}
+
+	d["n.message_type"] = "fetch"
+	delete(d, "n.message")
+	return json.Marshal(d)
+}
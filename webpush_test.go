@@ -0,0 +1,52 @@
+package titan
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/titan-x/titan/models"
+)
+
+func TestWebPushSubEndpoint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := models.WebPushSubscription{}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+
+	tests := []struct {
+		endpoint        string
+		valid, insecure bool
+	}{
+		{"https://push.example.com/send/1", true, false},
+		{"https://push.example.com:8443/send/1", true, false},
+		{"https://93.184.216.34/send/1", true, false},
+		{"http://push.example.com/send/1", false, false},
+		{"ftp://push.example.com/send/1", false, false},
+		{"https://localhost/send/1", false, false},
+		{"https://push.localhost./send/1", false, false},
+		{"https://127.0.0.1:8080/send/1", false, false},
+		{"https://10.1.2.3/send/1", false, false},
+		{"https://192.168.0.1/send/1", false, false},
+		{"https://169.254.169.254/latest/meta-data", false, false},
+		{"https://[::1]/send/1", false, false},
+		{"https://[fe80::1]/send/1", false, false},
+		{"https://[::ffff:127.0.0.1]/send/1", false, false},
+		{"http://127.0.0.1:8080/send/1", true, true},
+	}
+	for _, test := range tests {
+		sub.Endpoint = test.endpoint
+		if msg := validateWebPushSub(sub, test.insecure); (msg == "") != test.valid {
+			t.Errorf("expected endpoint %v to be valid: %v (insecure: %v), got: %v", test.endpoint, test.valid, test.insecure, msg)
+		}
+	}
+
+	if _, err := webPushDial("tcp", "localhost:443"); err == nil {
+		t.Fatal("expected dialing a local host to fail")
+	}
+}